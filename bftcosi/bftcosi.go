@@ -4,14 +4,28 @@ package bftcosi
 BFTCoSi is a byzantine-fault-tolerant protocol to sign a message given a
 verification-function. It uses two rounds of signing - the first round
 indicates the willingness of the rounds to sign the message, and the second
-round is only started if at least a 'threshold' number of nodes signed off in
-the first round.
+round is only started if the nodes that signed off in the first round
+satisfy the policy of the protocol. If the leader fails during a round, the other nodes restart
+the round with a new leader, see viewchange.go.
+
+The message is sent down the tree in the announcement, and every node
+verifies it before it commits. Nodes that refuse, and subtrees that don't
+commit in time, are left out of the bitmap of the signers. The challenge of
+both rounds is computed over the aggregate commitment and the aggregate key
+of the signers in the bitmap, so the signers are fixed before anybody
+responds and missing members only reduce the aggregate key. Every response
+reports the nodes of its subtree that committed but didn't respond. If the
+signature of a round is invalid because of them, the leader aborts the round
+and restarts it with new commitments on a tree without those nodes, as long
+as the remaining nodes can satisfy the policy.
 */
 
 import (
+	"bytes"
 	"crypto/sha512"
 	"errors"
 	"sync"
+	"time"
 
 	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/crypto.v0/cosi"
@@ -20,13 +34,17 @@ import (
 )
 
 // VerificationFunction can be passes to each protocol node. It will be called
-// (in a go routine) during the (start/handle) challenge prepare phase of the
-// protocol. The passed message is the same as sent in the challenge phase.
+// (in a go routine) during the announcement phase of the protocol, before
+// the node commits. The passed message is the same as sent in the
+// announcement.
 // The `Data`-part is only to help the VerificationFunction do it's job. In
 // the case of the services, this part should be replaced by the correct
 // passing of the service-configuration-data, which is not done yet.
 type VerificationFunction func(Msg []byte, Data []byte) bool
 
+// DefaultPhaseTimeout is the PhaseTimeout of new protocol instances.
+var DefaultPhaseTimeout = 10 * time.Second
+
 // ProtocolBFTCoSi is the main struct for running the protocol
 type ProtocolBFTCoSi struct {
 	// the node we are represented-in
@@ -42,18 +60,35 @@ type ProtocolBFTCoSi struct {
 	lastBlock string
 	// refusal to sign for the commit phase or not. This flag is set during the
 	// Challenge of the commit phase and will be used during the response of the
-	// commit phase to put an exception or to sign.
+	// commit phase to leave out our response.
 	signRefusal bool
-	// threshold for how much exception
-	threshold int
+	// prepareRefusal is set if we refused the challenge of the prepare
+	// phase and left out our response.
+	prepareRefusal bool
+	// Policy is how many nodes have to sign. The leader sends it to the
+	// followers and it is signed together with the message. Without a
+	// policy, DefaultPolicy is used and only the message is signed.
+	Policy *Policy
 	// our index in the Roster list
 	index int
+	// ViewChangeTimeout is how long the followers wait for the leader to
+	// send the challenge of the commit round before they replace it. The
+	// leader sends its value in the announcement, 0 disables view changes.
+	ViewChangeTimeout time.Duration
+	// state of the view change of a follower
+	viewChange viewChange
+	// PhaseTimeout is how long a node waits for the commitments or the
+	// responses of its children for every level of its subtree. Children
+	// that don't commit in time are left out of the signature, together
+	// with their subtree. The leader sends its value in the announcement,
+	// 0 waits forever.
+	PhaseTimeout time.Duration
 
 	// SDA-channels used to communicate the protocol
 	// channel for announcement
 	announceChan chan announceChan
 	// channel for commitment
-	commitChan chan []commitChan
+	commitChan chan commitChan
 	// Two channels for the challenge through the 2 rounds: difference is that
 	// during the commit round, we need the previous signature of the "prepare"
 	// round.
@@ -62,7 +97,7 @@ type ProtocolBFTCoSi struct {
 	// channel for challenge during the commit phase
 	challengeCommitChan chan challengeCommitChan
 	// channel for response
-	responseChan chan []responseChan
+	responseChan chan responseChan
 
 	// Internal communication channels
 	// channel used to wait for the verification of the block
@@ -76,13 +111,26 @@ type ProtocolBFTCoSi struct {
 	// onSignatureDone is the callback that will be called when a signature has
 	// been generated ( at the end of the response phase of the commit round)
 	onSignatureDone func(*BFTSignature)
+	// onViewChange is the callback that will be called on the new leader
+	// with the protocol of the new round after a view change
+	onViewChange func(*ProtocolBFTCoSi)
+	// onRoundEnd is the callback that will be called on a follower that
+	// verified the message, once its part of the round ended
+	onRoundEnd func(msg []byte, signed bool)
+	// doneOnce makes sure onDone is only called once
+	doneOnce sync.Once
+	// next is the round the leader restarted without the nodes that
+	// didn't respond. It finishes this round.
+	next *ProtocolBFTCoSi
 	// VerificationFunction will be called
-	// during the (start/handle) challenge prepare phase of the protocol
+	// during the announcement phase of the protocol
 	VerificationFunction VerificationFunction
 	// closing is true if the node is being shut down
 	closing bool
 	// mutex for closing down properly
 	closingMutex sync.Mutex
+	// finished is closed when the node is shut down
+	finished chan struct{}
 }
 
 // collectStructs holds the variables that are used during the protocol to hold
@@ -92,24 +140,27 @@ type collectStructs struct {
 	prepare *cosi.CoSi
 	// commit-round cosi
 	commit *cosi.CoSi
+	// committed holds the roster index of the children that committed in
+	// time. Only their responses are aggregated.
+	committed map[int]bool
+
+	// aggregate commitments of the signers of our subtree for both rounds,
+	// for the leader of all signers
+	prepareCommit abstract.Point
+	commitCommit  abstract.Point
+	// bitmap marks the signers whose commitments are aggregated. Once the
+	// challenge of the prepare round arrived, it is the bitmap of the leader.
+	bitmap []byte
 
 	// prepareSignature is the signature generated during the prepare phase
-	// This signature is adapted according to the exceptions that occured during
-	// the prepare phase.
 	prepareSignature []byte
+	// commitSignature is the signature generated during the commit phase
+	commitSignature []byte
+	// signedCommit is set once we added our response to the commit round
+	signedCommit bool
 
 	// mutex for all temporary structures
 	tmpMutex sync.Mutex
-	// exceptions given during the rounds that is used in the signature
-	tempExceptions []Exception
-	// temporary buffer of "prepare" commitments
-	tempPrepareCommit []abstract.Point
-	// temporary buffer of "commit" commitments
-	tempCommitCommit []abstract.Point
-	// temporary buffer of "prepare" responses
-	tempPrepareResponse []abstract.Scalar
-	// temporary buffer of "commit" responses
-	tempCommitResponse []abstract.Scalar
 }
 
 // NewBFTCoSiProtocol returns a new bftcosi struct
@@ -118,12 +169,17 @@ func NewBFTCoSiProtocol(n *onet.TreeNodeInstance, verify VerificationFunction) (
 	bft := &ProtocolBFTCoSi{
 		TreeNodeInstance: n,
 		collectStructs: collectStructs{
-			prepare: cosi.NewCosi(n.Suite(), n.Private(), n.Roster().Publics()),
-			commit:  cosi.NewCosi(n.Suite(), n.Private(), n.Roster().Publics()),
+			prepare:   cosi.NewCosi(n.Suite(), n.Private(), n.Roster().Publics()),
+			commit:    cosi.NewCosi(n.Suite(), n.Private(), n.Roster().Publics()),
+			committed: make(map[int]bool),
 		},
-		verifyChan:           make(chan bool),
+		// buffered, so that the verification doesn't block if the
+		// protocol is shut down in the meantime
+		verifyChan:           make(chan bool, 1),
+		finished:             make(chan struct{}),
 		VerificationFunction: verify,
-		threshold:            (len(n.Tree().List()) + 1) * 2 / 3,
+		ViewChangeTimeout:    DefaultViewChangeTimeout,
+		PhaseTimeout:         DefaultPhaseTimeout,
 		Msg:                  make([]byte, 0),
 		Data:                 make([]byte, 0),
 	}
@@ -138,33 +194,29 @@ func NewBFTCoSiProtocol(n *onet.TreeNodeInstance, verify VerificationFunction) (
 	if err != nil {
 		return nil, err
 	}
+	if err := bft.RegisterHandlers(bft.handleViewChange, bft.handleAbort); err != nil {
+		return nil, err
+	}
 
 	n.OnDoneCallback(bft.nodeDone)
 
 	return bft, nil
 }
 
-// Start will start both rounds "prepare" and "commit" at same time. The
-// "commit" round will wait till the end of the "prepare" round during its
-// challenge phase.
+// Start sends the announcement with the message down the tree. The
+// commitments of both rounds are collected together, the "commit" round
+// only starts its challenge at the end of the "prepare" round.
 func (bft *ProtocolBFTCoSi) Start() error {
-	if err := bft.startAnnouncement(RoundPrepare); err != nil {
-		return err
-	}
-	go func() {
-		//time.Sleep(time.Second)
-		bft.startAnnouncement(RoundCommit)
-	}()
-	return nil
+	return bft.startAnnouncement()
 }
 
 // Dispatch makes sure that the order of the messages is correct by waiting
-// on each channel in the correct order.
-// By closing the channels for the leafs we can avoid having
-// `if !bft.IsLeaf` in the code.
+// on each channel in the correct order. Only nodes with children wait for
+// their commitments and responses.
 func (bft *ProtocolBFTCoSi) Dispatch() error {
 	bft.closingMutex.Lock()
 	if bft.closing {
+		bft.closingMutex.Unlock()
 		return nil
 	}
 	// Close unused channels for the leaf nodes, so they won't listen
@@ -179,23 +231,27 @@ func (bft *ProtocolBFTCoSi) Dispatch() error {
 	}
 	bft.closingMutex.Unlock()
 
-	// Wait for both prepare and commit round
-	for i := 0; i < 2; i++ {
-		// Wait for announcement message
-		if err := bft.handleAnnouncement(<-bft.announceChan); err != nil {
-			return err
-		}
-		// Wait for commitment messages of all children
-		if err := bft.handleCommitment(<-bft.commitChan); err != nil {
-			return err
-		}
+	// Wait for the announcement and the commitments of the children
+	if err := bft.handleAnnouncement(<-bft.announceChan); err != nil {
+		return err
+	}
+	var commits []commitChan
+	if !bft.IsLeaf() {
+		commits = bft.collectCommitments()
+	}
+	if err := bft.handleCommitment(commits); err != nil {
+		return err
 	}
 
 	// Finish the preparation round
 	if err := bft.handleChallengePrepare(<-bft.challengePrepareChan); err != nil {
 		return err
 	}
-	if err := bft.handleResponse(<-bft.responseChan); err != nil {
+	var responses []responseChan
+	if !bft.IsLeaf() {
+		responses = bft.collectResponses(RoundPrepare)
+	}
+	if err := bft.handleResponse(RoundPrepare, responses); err != nil {
 		return err
 	}
 
@@ -203,31 +259,29 @@ func (bft *ProtocolBFTCoSi) Dispatch() error {
 	if err := bft.handleChallengeCommit(<-bft.challengeCommitChan); err != nil {
 		return err
 	}
-	if err := bft.handleResponse(<-bft.responseChan); err != nil {
-		return err
+	responses = nil
+	if !bft.IsLeaf() {
+		responses = bft.collectResponses(RoundCommit)
 	}
-
-	return nil
+	return bft.handleResponse(RoundCommit, responses)
 }
 
 // Signature will generate the final signature, the output of the BFTCoSi
 // protocol.
 // The signature contains the commit round signature, with the message.
-// If the prepare phase failed, the signature will be nil and the Exceptions
-// will contain the exception from the prepare phase. It can be useful to see
-// which cosigners refused to sign (each exceptions contains the index of a
-// refusing-to-sign signer).
+// If the prepare phase failed, the signature will be nil. The Bitmap marks
+// the cosigners that committed, use Signers to get them.
 // Expect this function to have an undefined behavior when called from a
 // non-root Node.
 func (bft *ProtocolBFTCoSi) Signature() *BFTSignature {
 	bftSig := &BFTSignature{
-		Sig:        bft.commit.Signature(),
-		Msg:        bft.Msg,
-		Exceptions: nil,
+		Sig:    bft.commitSignature,
+		Msg:    bft.Msg,
+		Policy: bft.Policy,
+		Bitmap: bft.bitmap,
 	}
 	if bft.signRefusal {
 		bftSig.Sig = nil
-		bftSig.Exceptions = bft.tempExceptions
 	}
 	return bftSig
 }
@@ -244,13 +298,73 @@ func (bft *ProtocolBFTCoSi) RegisterOnSignatureDone(fn func(*BFTSignature)) {
 	bft.onSignatureDone = fn
 }
 
+// RegisterOnRoundEnd registers a callback that is called on a follower once
+// its part of the round ended, if it verified the message: after its
+// response to the commit round, or when the round is aborted, replaced by a
+// view change or shut down. It gets the message and whether the follower
+// signed the commit round. The callback runs only after the verification
+// finished, even if the round ended before.
+func (bft *ProtocolBFTCoSi) RegisterOnRoundEnd(fn func(msg []byte, signed bool)) {
+	bft.onRoundEnd = fn
+}
+
+// Abort stops the round on the leader and sends Abort to the followers, so
+// that they drop the round and don't replace the leader with a view change.
+// The leader calls it instead of Done if it stops waiting for the signature.
+func (bft *ProtocolBFTCoSi) Abort() {
+	bft.closingMutex.Lock()
+	bft.closing = true
+	next := bft.next
+	bft.closingMutex.Unlock()
+	if next != nil {
+		// the restarted round finishes this one
+		next.Abort()
+		return
+	}
+	if bft.IsRoot() {
+		abortRound(bft.TreeNodeInstance)
+	}
+	bft.Done()
+}
+
+// handleAbort stops the round if the leader aborted it.
+func (bft *ProtocolBFTCoSi) handleAbort(msg abortChan) error {
+	if msg.TreeNode.RosterIndex != bft.Root().RosterIndex {
+		return errors.New("Only the leader can abort the round")
+	}
+	log.Lvl2(bft.Name(), "Leader aborted the round")
+	bft.Done()
+	return nil
+}
+
+// abortRound sends Abort to all nodes of the tree of the leader n, in
+// parallel so that unreachable nodes don't hold up the others.
+func abortRound(n *onet.TreeNodeInstance) {
+	var wg sync.WaitGroup
+	for _, tn := range n.Tree().List() {
+		if tn.RosterIndex == n.TreeNode().RosterIndex {
+			continue
+		}
+		wg.Add(1)
+		go func(tn *onet.TreeNode) {
+			defer wg.Done()
+			if err := n.SendTo(tn, &Abort{}); err != nil {
+				log.Lvl2(n.Name(), "Couldn't abort the round of", tn.ServerIdentity, err)
+			}
+		}(tn)
+	}
+	wg.Wait()
+}
+
 // Shutdown closes all channels in case we're done
 func (bft *ProtocolBFTCoSi) Shutdown() error {
 	defer func() {
 		// In case the channels were already closed
 		recover()
 	}()
+	bft.stopViewChangeTimer()
 	bft.setClosing()
+	close(bft.finished)
 	close(bft.announceChan)
 	close(bft.challengePrepareChan)
 	close(bft.challengeCommitChan)
@@ -261,95 +375,104 @@ func (bft *ProtocolBFTCoSi) Shutdown() error {
 	return nil
 }
 
-// handleAnnouncement passes the announcement to the right CoSi struct.
+// handleAnnouncement starts the verification of the message and passes the
+// announcement to the children.
 func (bft *ProtocolBFTCoSi) handleAnnouncement(msg announceChan) error {
 	ann := msg.Announce
 	if bft.isClosing() {
 		return errors.New("Closing")
 	}
+	if !bft.IsRoot() {
+		bft.Msg = ann.Msg
+		bft.Data = ann.Data
+		bft.Policy = ann.Policy
+		bft.PhaseTimeout = time.Duration(ann.PhaseTimeout) * time.Millisecond
+		bft.setViewChangeMsg(ann.Msg, ann.Data, ann.Policy)
+		bft.startViewChangeTimer(time.Duration(ann.Timeout) * time.Millisecond)
+	}
+	go func() {
+		verified := bft.VerificationFunction(bft.Msg, bft.Data)
+		bft.verifyChan <- verified
+		if verified && !bft.IsRoot() && bft.onRoundEnd != nil {
+			<-bft.finished
+			bft.tmpMutex.Lock()
+			signed := bft.signedCommit
+			bft.tmpMutex.Unlock()
+			bft.onRoundEnd(bft.Msg, signed)
+		}
+	}()
 	if bft.IsLeaf() {
-		return bft.startCommitment(ann.TYPE)
+		return nil
 	}
 	return bft.SendToChildrenInParallel(&ann)
 }
 
-// handleCommitment collects all commitments from children and passes them
-// to the parent or starts the challenge-round if it's the root.
+// handleCommitment waits for our verification and aggregates our
+// commitments for both rounds, if we agree to sign, with the ones of the
+// children. Then it passes them to the parent or starts the challenge-round
+// if it's the root.
 func (bft *ProtocolBFTCoSi) handleCommitment(msgs []commitChan) error {
+	verified := <-bft.verifyChan
 	bft.tmpMutex.Lock()
 	defer bft.tmpMutex.Unlock()
+	if bft.isClosing() {
+		return nil
+	}
+	bft.bitmap = make([]byte, bitmapLen(len(bft.Roster().List)))
+	bft.prepareCommit = bft.Suite().Point().Null()
+	bft.commitCommit = bft.Suite().Point().Null()
+	if verified {
+		bitmapSet(bft.bitmap, bft.index)
+		bft.prepareCommit.Add(bft.prepareCommit, bft.prepare.CreateCommitment(nil))
+		bft.commitCommit.Add(bft.commitCommit, bft.commit.CreateCommitment(nil))
+	} else {
+		log.Lvl2(bft.Name(), "Refused to sign")
+	}
 	for _, msg := range msgs {
 		comm := msg.Commitment
-		if bft.isClosing() {
-			return nil
-		}
-
-		var commitment abstract.Point
-		// store it and check if we have enough commitments
-		switch comm.TYPE {
-		case RoundPrepare:
-			bft.tempPrepareCommit = append(bft.tempPrepareCommit, comm.Commitment)
-			if len(bft.tempPrepareCommit) < len(bft.Children()) {
-				continue
-			}
-			commitment = bft.prepare.Commit(nil, bft.tempPrepareCommit)
-			if bft.IsRoot() {
-				if err := bft.startChallenge(RoundPrepare); err != nil {
-					return nil
-				}
-				continue
-			}
-		case RoundCommit:
-			bft.tempCommitCommit = append(bft.tempCommitCommit, comm.Commitment)
-			if len(bft.tempCommitCommit) < len(bft.Children()) {
-				continue
-			}
-			commitment = bft.commit.Commit(nil, bft.tempCommitCommit)
-			if bft.IsRoot() {
-				// do nothing:
-				// stop the processing of the round, wait the end of
-				// the "prepare" round: calls startChallengeCommit
-				continue
-			}
-		}
-		// set same RoundType as for the received commitment:
-		typedCommitment := &Commitment{
-			TYPE:       comm.TYPE,
-			Commitment: commitment,
-		}
-		if err := bft.SendToParent(typedCommitment); err != nil {
-			return err
+		bft.prepareCommit.Add(bft.prepareCommit, comm.Prepare)
+		bft.commitCommit.Add(bft.commitCommit, comm.Commit)
+		for i := range bft.bitmap {
+			bft.bitmap[i] |= comm.Bitmap[i]
 		}
 	}
-	return nil
+	if bft.IsRoot() {
+		// the challenge of the "commit" round waits for the end of the
+		// "prepare" round: see handleResponsePrepare
+		return bft.startChallenge(RoundPrepare)
+	}
+	return bft.SendToParent(&Commitment{
+		Prepare: bft.prepareCommit,
+		Commit:  bft.commitCommit,
+		Bitmap:  bft.bitmap,
+	})
 }
 
-// handleChallengePrepare collects the challenge-messages
+// handleChallengePrepare checks the challenge of the prepare round and
+// passes it to the children.
 func (bft *ProtocolBFTCoSi) handleChallengePrepare(msg challengePrepareChan) error {
 	if bft.isClosing() {
 		return nil
 	}
 	ch := msg.ChallengePrepare
 	if !bft.IsRoot() {
-		bft.Msg = ch.Msg
-		bft.Data = ch.Data
-		// start the verification of the message
-		// acknowledge the challenge and send it down
-		bft.prepare.Challenge(ch.Challenge)
+		// from now on we only need the signers of the whole tree
+		bft.bitmap = ch.Bitmap
+		data := sha512.Sum512(signedMessage(bft.Msg, bft.Policy))
+		if err := bft.checkChallenge(ch.Challenge, ch.Commitment, data[:]); err != nil {
+			log.Lvl2(bft.Name(), "Refusing challenge of the prepare round:", err)
+			bft.prepareRefusal = true
+		}
 	}
-	go func() {
-		bft.verifyChan <- bft.VerificationFunction(bft.Msg, bft.Data)
-	}()
-	// go to response if leaf
+	bft.prepare.Challenge(ch.Challenge)
 	if bft.IsLeaf() {
-		return bft.startResponse(RoundPrepare)
+		return nil
 	}
-	err := bft.SendToChildrenInParallel(&ch)
-	return err
+	return bft.SendToChildrenInParallel(&ch)
 }
 
-// handleChallengeCommit verifies the signature and checks if not more than
-// the threshold of participants refused to sign
+// handleChallengeCommit verifies the signature and checks if the participants
+// that signed satisfy the policy
 func (bft *ProtocolBFTCoSi) handleChallengeCommit(msg challengeCommitChan) error {
 	if bft.isClosing() {
 		return nil
@@ -357,106 +480,195 @@ func (bft *ProtocolBFTCoSi) handleChallengeCommit(msg challengeCommitChan) error
 
 	ch := msg.ChallengeCommit
 	if !bft.IsRoot() {
-		bft.commit.Challenge(ch.Challenge)
+		// the leader did its part, no need for a view change anymore
+		bft.stopViewChangeTimer()
+		if err := bft.checkChallengeCommit(&ch); err != nil {
+			log.Lvl3(bft.Name(), "Refusing to sign:", err)
+			bft.signRefusal = true
+		}
 	}
+	bft.commit.Challenge(ch.Challenge)
 
-	// verify if the signature is correct
-	data := sha512.Sum512(ch.Signature.Msg)
-	bftPrepareSig := &BFTSignature{
-		Sig:        ch.Signature.Sig,
-		Msg:        data[:],
-		Exceptions: ch.Signature.Exceptions,
-	}
-	if err := bftPrepareSig.Verify(bft.Suite(), bft.Roster().Publics()); err != nil {
-		log.Lvl3(bft.Name(), "Verification of the signature failed:", err)
-		bft.signRefusal = true
+	if bft.IsLeaf() {
+		return nil
 	}
+	return bft.SendToChildrenInParallel(&ch)
+}
 
-	// Check if we have no more than threshold failed nodes
-	if len(ch.Signature.Exceptions) >= int(bft.threshold) {
-		log.Lvlf3("%s: More than threshold (%d/%d) refused to sign - aborting.",
-			bft.Roster(), len(ch.Signature.Exceptions), len(bft.Roster().List))
-		bft.signRefusal = true
+// checkChallengeCommit returns an error if the signature of the prepare
+// round is not valid for our message and the signers of the prepare round,
+// if they don't satisfy the policy or if the challenge of the commit round
+// is not the one for our message.
+func (bft *ProtocolBFTCoSi) checkChallengeCommit(ch *ChallengeCommit) error {
+	if ch.Signature == nil {
+		return errors.New("Missing signature of the prepare round")
 	}
-
-	// store the exceptions for later usage
-	bft.tempExceptions = ch.Signature.Exceptions
-
-	if bft.IsLeaf() {
-		return bft.handleResponseCommit(nil)
+	if !bytes.Equal(ch.Signature.Bitmap, bft.bitmap) {
+		return errors.New("Signers changed since the prepare round")
+	}
+	data := sha512.Sum512(signedMessage(bft.Msg, bft.Policy))
+	prepare := &BFTSignature{
+		Sig:    ch.Signature.Sig,
+		Msg:    data[:],
+		Bitmap: bft.bitmap,
+	}
+	if err := prepare.Verify(bft.Suite(), bft.Roster().Publics()); err != nil {
+		return err
+	}
+	n := len(bft.Roster().List)
+	if err := bft.policy().Check(n, BitmapExceptions(bft.bitmap, n)); err != nil {
+		return err
 	}
+	return bft.checkChallenge(ch.Challenge, ch.Commitment,
+		signedMessage(bft.Msg, bft.Policy))
+}
 
-	return bft.SendToChildrenInParallel(&ch)
+// checkChallenge returns an error if ch is not the challenge on msg for the
+// aggregate commitment commit and the signers in our bitmap.
+func (bft *ProtocolBFTCoSi) checkChallenge(ch abstract.Scalar, commit abstract.Point,
+	msg []byte) error {
+	if ch == nil || commit == nil {
+		return errors.New("Incomplete challenge")
+	}
+	if err := checkBitmap(bft.bitmap, len(bft.Roster().List)); err != nil {
+		return err
+	}
+	k, err := challenge(bft.Suite(), commit,
+		aggregatePublic(bft.Suite(), bft.Roster().Publics(), bft.bitmap), msg)
+	if err != nil {
+		return err
+	}
+	if !k.Equal(ch) {
+		return errors.New("Wrong challenge")
+	}
+	return nil
 }
 
-// handleResponse is called when a response message arrives.
-func (bft *ProtocolBFTCoSi) handleResponse(msgs []responseChan) error {
+// handleResponse is called with the responses of the children in round t.
+// It adds our response, if we sign in this round, and passes the aggregate
+// response to the parent or finishes the round if it's the root.
+func (bft *ProtocolBFTCoSi) handleResponse(t RoundType, msgs []responseChan) error {
+	if bft.isClosing() {
+		return errors.New("Quitting instance")
+	}
+	resp := bft.Suite().Scalar().Zero()
+	failed := make([]byte, bitmapLen(len(bft.Roster().List)))
+	if bft.signs(t) {
+		r, err := bft.getCosi(t).CreateResponse()
+		if err != nil {
+			return err
+		}
+		resp.Add(resp, r)
+		if t == RoundCommit {
+			bft.tmpMutex.Lock()
+			bft.signedCommit = true
+			bft.tmpMutex.Unlock()
+		}
+	} else if bitmapIsSet(bft.bitmap, bft.index) {
+		bitmapSet(failed, bft.index)
+	}
+	responded := make(map[int]bool)
 	for _, msg := range msgs {
-		if bft.isClosing() {
-			return errors.New("Quitting instance")
+		resp.Add(resp, msg.Response.Response)
+		responded[msg.TreeNode.RosterIndex] = true
+		for i := range failed {
+			failed[i] |= msg.Response.Failed[i]
 		}
-		var resp *Response
-		if !bft.IsLeaf() {
-			resp = &msg.Response
+	}
+	for idx := range bft.committed {
+		if !responded[idx] {
+			log.Lvl2(bft.Name(), "Missing response of", idx, "in round", t)
+			bitmapSet(failed, idx)
 		}
-		if msg.Response.TYPE == RoundPrepare {
-			if err := bft.handleResponsePrepare(resp); err != nil {
-				return err
-			}
-		} else {
-			if err := bft.handleResponseCommit(resp); err != nil {
-				return err
-			}
+	}
+
+	if bft.IsRoot() {
+		if t == RoundPrepare {
+			return bft.handleResponsePrepare(resp, failed)
 		}
+		return bft.handleResponseCommit(resp, failed)
 	}
-	return nil
+	err := bft.SendToParent(&Response{TYPE: t, Response: resp, Failed: failed})
+	if t == RoundCommit {
+		// notify we have finished to participate in this signature
+		log.Lvl3(bft.Name(), "refusal=", bft.signRefusal)
+		bft.Done()
+	}
+	return err
 }
 
-// startAnnouncementPrepare create its announcement for the prepare round and
-// sends it down the tree.
-func (bft *ProtocolBFTCoSi) startAnnouncement(t RoundType) error {
-	bft.announceChan <- announceChan{Announce: Announce{TYPE: t}}
-	return nil
+// signs returns whether we add our response in round t: we have to be one
+// of the signers and must not have refused the round.
+func (bft *ProtocolBFTCoSi) signs(t RoundType) bool {
+	if !bitmapIsSet(bft.bitmap, bft.index) {
+		return false
+	}
+	if t == RoundPrepare {
+		return !bft.prepareRefusal
+	}
+	return !bft.signRefusal
 }
 
-// startCommitment sends the first commitment to the parent node
-func (bft *ProtocolBFTCoSi) startCommitment(t RoundType) error {
-	cm := bft.getCosi(t).CreateCommitment(nil)
-	return bft.SendToParent(&Commitment{TYPE: t, Commitment: cm})
+// startAnnouncement creates the announcement with the message and sends it
+// down the tree.
+func (bft *ProtocolBFTCoSi) startAnnouncement() error {
+	bft.closingMutex.Lock()
+	defer bft.closingMutex.Unlock()
+	if bft.closing {
+		return errors.New("Closing")
+	}
+	bft.announceChan <- announceChan{Announce: Announce{
+		Msg:          bft.Msg,
+		Data:         bft.Data,
+		Policy:       bft.Policy,
+		Timeout:      uint64(bft.ViewChangeTimeout / time.Millisecond),
+		PhaseTimeout: uint64(bft.PhaseTimeout / time.Millisecond),
+	}}
+	return nil
 }
 
-// startChallenge creates the challenge and sends it to its children
+// startChallenge creates the challenge for the signers in the bitmap and
+// sends it to its children
 func (bft *ProtocolBFTCoSi) startChallenge(t RoundType) error {
+	bft.closingMutex.Lock()
+	defer bft.closingMutex.Unlock()
+	if bft.closing {
+		return errors.New("Closing")
+	}
+	public := aggregatePublic(bft.Suite(), bft.Roster().Publics(), bft.bitmap)
 	switch t {
 	case RoundPrepare:
 		// need to hash the message before so challenge in both phases are not
 		// the same
-		data := sha512.Sum512(bft.Msg)
-		ch, err := bft.prepare.CreateChallenge(data[:])
+		data := sha512.Sum512(signedMessage(bft.Msg, bft.Policy))
+		ch, err := challenge(bft.Suite(), bft.prepareCommit, public, data[:])
 		if err != nil {
 			return err
 		}
 		bftChal := &ChallengePrepare{
-			Challenge: ch,
-			Msg:       bft.Msg,
-			Data:      bft.Data,
+			Challenge:  ch,
+			Commitment: bft.prepareCommit,
+			Bitmap:     bft.bitmap,
 		}
 
 		bft.challengePrepareChan <- challengePrepareChan{ChallengePrepare: *bftChal}
 	case RoundCommit:
 		// commit phase
-		ch, err := bft.commit.CreateChallenge(bft.Msg)
+		ch, err := challenge(bft.Suite(), bft.commitCommit, public,
+			signedMessage(bft.Msg, bft.Policy))
 		if err != nil {
 			return err
 		}
 
 		// send challenge + signature
 		cc := &ChallengeCommit{
-			Challenge: ch,
+			Challenge:  ch,
+			Commitment: bft.commitCommit,
 			Signature: &BFTSignature{
-				Msg:        bft.Msg,
-				Sig:        bft.prepareSignature,
-				Exceptions: bft.tempExceptions,
+				Msg:    bft.Msg,
+				Sig:    bft.prepareSignature,
+				Policy: bft.Policy,
+				Bitmap: bft.bitmap,
 			},
 		}
 		bft.challengeCommitChan <- challengeCommitChan{ChallengeCommit: *cc}
@@ -464,65 +676,37 @@ func (bft *ProtocolBFTCoSi) startChallenge(t RoundType) error {
 	return nil
 }
 
-// startResponse dispatches the response to the correct round-type
-func (bft *ProtocolBFTCoSi) startResponse(t RoundType) error {
-	bft.handleResponse([]responseChan{{Response: Response{TYPE: t}}})
-	return nil
-}
-
-// If 'r' is nil, it will starts the response process.
-func (bft *ProtocolBFTCoSi) handleResponsePrepare(r *Response) error {
-	if r != nil {
-		// check if we have enough responses
-		bft.tmpMutex.Lock()
-		bft.tempPrepareResponse = append(bft.tempPrepareResponse, r.Response)
-		bft.tempExceptions = append(bft.tempExceptions, r.Exceptions...)
-		if len(bft.tempPrepareResponse) < len(bft.Children()) {
-			bft.tmpMutex.Unlock()
-			return nil
-		}
-		bft.tmpMutex.Unlock()
-	}
-
-	// wait for verification
-	bzrReturn, ok := bft.waitResponseVerification()
-	// append response
-	if !ok {
-		log.Lvl2(bft.Roster(), "Refused to sign")
-	}
-
-	// Return if we're not root
-	if !bft.IsRoot() {
-		return bft.SendTo(bft.Parent(), bzrReturn)
-	}
-	// Since cosi does not support exceptions yet, we have to remove
-	// the responses that are not supposed to be there,i.e. exceptions.
-	cosiSig := bft.prepare.Signature()
-	correctResponseBuff, err := bzrReturn.Response.MarshalBinary()
+// handleResponsePrepare is called on the root with the aggregate response of
+// the prepare round and the nodes that failed to respond. It checks the
+// signature of the prepare round and starts the challenge of the
+// commit-round, or restarts the round without the failed nodes.
+func (bft *ProtocolBFTCoSi) handleResponsePrepare(resp abstract.Scalar, failed []byte) error {
+	sig, err := cosiSignature(bft.prepareCommit, resp)
 	if err != nil {
 		return err
 	}
-	// replace the old one with the corrected one
-	copy(cosiSig[32:64], correctResponseBuff)
-	bft.prepareSignature = cosiSig
+	bft.prepareSignature = sig
 
 	// Verify the signature is correct
-	data := sha512.Sum512(bft.Msg)
-	sig := &BFTSignature{
-		Msg:        data[:],
-		Sig:        cosiSig,
-		Exceptions: bft.tempExceptions,
-	}
-
-	aggCommit := bft.Suite().Point().Null()
-	for _, c := range bft.tempPrepareCommit {
-		aggCommit.Add(aggCommit, c)
-	}
-	if err := sig.Verify(bft.Suite(), bft.Roster().Publics()); err != nil {
-		log.Error(bft.Name(), "Verification of the signature failed:", err)
+	data := sha512.Sum512(signedMessage(bft.Msg, bft.Policy))
+	prepare := &BFTSignature{
+		Msg:    data[:],
+		Sig:    sig,
+		Bitmap: bft.bitmap,
+	}
+	n := len(bft.Roster().List)
+	if err := prepare.Verify(bft.Suite(), bft.Roster().Publics()); err != nil {
+		log.Lvl2(bft.Name(), "Verification of the signature failed:", err)
+		if bft.restart(failed) {
+			return nil
+		}
 		bft.signRefusal = true
+	} else if err := bft.policy().Check(n, BitmapExceptions(bft.bitmap, n)); err != nil {
+		log.Lvl3(bft.Name(), "Policy not satisfied - aborting:", err)
+		bft.signRefusal = true
+	} else {
+		log.Lvl3(bft.Name(), "Verification of signature successful")
 	}
-	log.Lvl3(bft.Name(), "Verification of signature successful")
 	// Start the challenge of the 'commit'-round
 	if err := bft.startChallenge(RoundCommit); err != nil {
 		log.Error(bft.Name(), err)
@@ -531,109 +715,264 @@ func (bft *ProtocolBFTCoSi) handleResponsePrepare(r *Response) error {
 	return nil
 }
 
-// handleResponseCommit collects all commits from the children and either
-// passes the aggregate commit to its parent or starts a response-round
-func (bft *ProtocolBFTCoSi) handleResponseCommit(r *Response) error {
-	if r != nil {
-		// check if we have enough
-		bft.tmpMutex.Lock()
-		bft.tempCommitResponse = append(bft.tempCommitResponse, r.Response)
-
-		if len(bft.tempCommitResponse) < len(bft.Children()) {
-			bft.tmpMutex.Unlock()
-			return nil
+// handleResponseCommit is called on the root with the aggregate response of
+// the commit round and the nodes that failed to respond. It finishes the
+// protocol, or restarts the round without the failed nodes if the signature
+// is invalid.
+func (bft *ProtocolBFTCoSi) handleResponseCommit(resp abstract.Scalar, failed []byte) error {
+	sig, err := cosiSignature(bft.commitCommit, resp)
+	if err != nil {
+		return err
+	}
+	bft.commitSignature = sig
+	log.Lvl3(bft.Name(), "refusal=", bft.signRefusal)
+	if !bft.signRefusal {
+		if err := bft.Signature().Verify(bft.Suite(), bft.Roster().Publics()); err != nil {
+			log.Lvl2(bft.Name(), "Verification of the signature failed:", err)
+			if bft.restart(failed) {
+				return nil
+			}
 		}
-		bft.tmpMutex.Unlock()
-	} else {
-		r = &Response{
-			TYPE:     RoundCommit,
-			Response: bft.Suite().Scalar().Zero(),
+	}
+	if bft.onSignatureDone != nil {
+		bft.onSignatureDone(bft.Signature())
+	}
+	bft.Done()
+	return nil
+}
+
+// restart starts a new round on our message with a tree without the nodes
+// in failed, which committed but didn't respond, and aborts this round. The
+// new round has new commitments, so that no signer responds to two
+// challenges with the same commitment, and it finishes this round. It
+// returns false if there are no failed nodes or if the nodes of the new tree
+// can't satisfy the policy.
+func (bft *ProtocolBFTCoSi) restart(failed []byte) bool {
+	n := len(bft.Roster().List)
+	if len(BitmapExceptions(failed, n)) == n || bitmapIsSet(failed, bft.index) {
+		return false
+	}
+	tree := bft.binaryTree(bft.TreeNode(), func(tn *onet.TreeNode) bool {
+		return bitmapIsSet(failed, tn.RosterIndex)
+	})
+	nodes := make([]byte, bitmapLen(n))
+	for _, tn := range tree.List() {
+		bitmapSet(nodes, tn.RosterIndex)
+	}
+	if err := bft.policy().Check(n, BitmapExceptions(nodes, n)); err != nil {
+		log.Lvl2(bft.Name(), "Can't restart the round:", err)
+		return false
+	}
+	pi, err := bft.CreateProtocol(bft.ProtocolName(), tree)
+	if err != nil {
+		log.Error(bft.Name(), "Couldn't restart the round:", err)
+		return false
+	}
+	next, ok := pi.(*ProtocolBFTCoSi)
+	if !ok {
+		log.Error(bft.Name(), "New protocol is not a BFTCoSi")
+		return false
+	}
+	next.Msg = bft.Msg
+	next.Data = bft.Data
+	next.Policy = bft.Policy
+	next.ViewChangeTimeout = bft.ViewChangeTimeout
+	next.PhaseTimeout = bft.PhaseTimeout
+	next.VerificationFunction = bft.VerificationFunction
+	next.RegisterOnSignatureDone(func(sig *BFTSignature) {
+		bft.commitSignature = sig.Sig
+		bft.bitmap = sig.Bitmap
+		bft.signRefusal = sig.Sig == nil
+		if bft.onSignatureDone != nil {
+			bft.onSignatureDone(sig)
 		}
+	})
+	next.RegisterOnDone(bft.Done)
+
+	bft.closingMutex.Lock()
+	if bft.closing {
+		bft.closingMutex.Unlock()
+		next.Done()
+		return true
+	}
+	bft.next = next
+	bft.closingMutex.Unlock()
+	log.Lvl2(bft.Name(), "Restarting the round without", BitmapExceptions(nodes, n))
+	abortRound(bft.TreeNodeInstance)
+	if err := next.Start(); err != nil {
+		log.Error(bft.Name(), "Couldn't restart the round:", err)
 	}
+	return true
+}
 
-	var err error
-	if bft.IsLeaf() {
-		r.Response, err = bft.commit.CreateResponse()
-	} else {
-		r.Response, err = bft.commit.Response(bft.tempCommitResponse)
+// binaryTree returns a binary tree of the nodes of our tree with root as
+// root, leaving out the nodes for which skip returns true.
+func (bft *ProtocolBFTCoSi) binaryTree(root *onet.TreeNode,
+	skip func(*onet.TreeNode) bool) *onet.Tree {
+	nodes := []*onet.TreeNode{onet.NewTreeNode(root.RosterIndex, root.ServerIdentity)}
+	for _, tn := range bft.Tree().List() {
+		if tn.RosterIndex == root.RosterIndex || skip(tn) {
+			continue
+		}
+		node := onet.NewTreeNode(tn.RosterIndex, tn.ServerIdentity)
+		nodes[(len(nodes)-1)/2].AddChild(node)
+		nodes = append(nodes, node)
 	}
+	return onet.NewTree(bft.Roster(), nodes[0])
+}
+
+// cosiSignature returns the signature made of the aggregate commitment and
+// the aggregate response of a round.
+func cosiSignature(commit abstract.Point, resp abstract.Scalar) ([]byte, error) {
+	c, err := commit.MarshalBinary()
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	if bft.signRefusal {
-		r.Exceptions = append(r.Exceptions, Exception{
-			Index:      bft.index,
-			Commitment: bft.commit.GetCommitment(),
-		})
-		// don't include our own!
-		r.Response.Sub(r.Response, bft.commit.GetResponse())
+	r, err := resp.MarshalBinary()
+	if err != nil {
+		return nil, err
 	}
+	return append(c, r...), nil
+}
 
-	// notify we have finished to participate in this signature
-	log.Lvl3(bft.Name(), "refusal=", bft.signRefusal)
-	// if root we have finished
-	if bft.IsRoot() {
-		sig := bft.Signature()
-		if bft.onSignatureDone != nil {
-			bft.onSignatureDone(sig)
+// collectCommitments returns the commitments of the children. Children that
+// didn't commit before the phase timeout are left out together with their
+// subtree.
+func (bft *ProtocolBFTCoSi) collectCommitments() []commitChan {
+	var msgs []commitChan
+	timeout := bft.phaseTimeout()
+	for len(bft.committed) < len(bft.Children()) {
+		select {
+		case msg, ok := <-bft.commitChan:
+			if !ok {
+				return msgs
+			}
+			idx := msg.TreeNode.RosterIndex
+			if bft.committed[idx] || !bft.validCommitment(msg) {
+				log.Lvl3(bft.Name(), "Ignoring commitment of", msg.TreeNode)
+				continue
+			}
+			bft.committed[idx] = true
+			msgs = append(msgs, msg)
+		case <-timeout:
+			log.Lvl2(bft.Name(), "Timeout while waiting for commitments")
+			return msgs
 		}
-		bft.Done()
-		return nil
 	}
+	return msgs
+}
 
-	// otherwise , send the response up
-	err = bft.SendTo(bft.Parent(), r)
-	bft.Done()
-	return err
+// validCommitment returns whether the commitment of a child is complete and
+// only marks signers of the subtree of the child.
+func (bft *ProtocolBFTCoSi) validCommitment(msg commitChan) bool {
+	comm := msg.Commitment
+	if comm.Prepare == nil || comm.Commit == nil {
+		return false
+	}
+	return bft.inSubtree(msg.TreeNode, comm.Bitmap)
 }
 
-// waitResponseVerification waits till the end of the verification and returns
-// the BFTCoSiResponse along with the flag:
-// true => no exception, the verification is correct
-// false => exception, the verification failed
-func (bft *ProtocolBFTCoSi) waitResponseVerification() (*Response, bool) {
-	log.Lvl3(bft.Name(), "Waiting for response verification:")
-	// wait the verification
-	verified := <-bft.verifyChan
+// inSubtree returns whether bitmap is valid and only marks nodes of the
+// subtree of tn.
+func (bft *ProtocolBFTCoSi) inSubtree(tn *onet.TreeNode, bitmap []byte) bool {
+	n := len(bft.Roster().List)
+	if checkBitmap(bitmap, n) != nil {
+		return false
+	}
+	sub := make(map[int]bool)
+	for _, c := range subtree(tn) {
+		sub[c.RosterIndex] = true
+	}
+	for i := 0; i < n; i++ {
+		if bitmapIsSet(bitmap, i) && !sub[i] {
+			return false
+		}
+	}
+	return true
+}
 
-	resp, err := bft.prepare.Response(bft.tempPrepareResponse)
-	if err != nil {
-		return nil, false
+// collectResponses returns the responses of the children that committed in
+// round t. Children that don't respond before the phase timeout are
+// reported as failed, see handleResponse.
+func (bft *ProtocolBFTCoSi) collectResponses(t RoundType) []responseChan {
+	var msgs []responseChan
+	responded := make(map[int]bool)
+	timeout := bft.phaseTimeout()
+	for len(responded) < len(bft.committed) {
+		select {
+		case msg, ok := <-bft.responseChan:
+			if !ok {
+				return msgs
+			}
+			idx := msg.TreeNode.RosterIndex
+			if msg.Response.TYPE != t || msg.Response.Response == nil ||
+				!bft.committed[idx] || responded[idx] ||
+				!bft.inSubtree(msg.TreeNode, msg.Response.Failed) {
+				log.Lvl3(bft.Name(), "Ignoring response of", msg.TreeNode)
+				continue
+			}
+			responded[idx] = true
+			msgs = append(msgs, msg)
+		case <-timeout:
+			log.Lvl2(bft.Name(), "Timeout while waiting for responses")
+			return msgs
+		}
 	}
+	return msgs
+}
 
-	if !verified {
-		// Add our exception
-		bft.tempExceptions = append(bft.tempExceptions, Exception{
-			Index:      bft.index,
-			Commitment: bft.prepare.GetCommitment(),
-		})
-		// Don't include our response!
-		resp = bft.Suite().Scalar().Set(resp).Sub(resp, bft.prepare.GetResponse())
-		log.Lvl3(bft.Name(), "Response verification: failed")
+// phaseTimeout returns a channel that fires when we stop waiting for our
+// children in the current phase. We wait PhaseTimeout for every level of our
+// subtree, so that our children time out on their children first. Without
+// PhaseTimeout the channel never fires.
+func (bft *ProtocolBFTCoSi) phaseTimeout() <-chan time.Time {
+	if bft.PhaseTimeout <= 0 {
+		return nil
 	}
+	return time.After(time.Duration(height(bft.TreeNode())) * bft.PhaseTimeout)
+}
 
-	r := &Response{
-		TYPE:       RoundPrepare,
-		Exceptions: bft.tempExceptions,
-		Response:   resp,
+// height returns the number of levels of the tree below tn.
+func height(tn *onet.TreeNode) int {
+	h := 0
+	for _, c := range tn.Children {
+		if hc := height(c) + 1; hc > h {
+			h = hc
+		}
 	}
+	return h
+}
 
-	log.Lvl3(bft.Name(), "Response verification:", verified)
-	return r, verified
+// subtree returns tn and all nodes below it.
+func subtree(tn *onet.TreeNode) []*onet.TreeNode {
+	tns := []*onet.TreeNode{tn}
+	for _, c := range tn.Children {
+		tns = append(tns, subtree(c)...)
+	}
+	return tns
 }
 
 // nodeDone is either called by the end of EndProtocol or by the end of the
 // response phase of the commit round.
 func (bft *ProtocolBFTCoSi) nodeDone() bool {
 	bft.Shutdown()
-	if bft.onDone != nil {
-		// only true for the root
-		bft.onDone()
-	}
+	bft.doneOnce.Do(func() {
+		if bft.onDone != nil {
+			// only true for the root
+			bft.onDone()
+		}
+	})
 	return true
 }
 
+// policy returns the policy of the protocol.
+func (bft *ProtocolBFTCoSi) policy() *Policy {
+	if bft.Policy != nil {
+		return bft.Policy
+	}
+	return DefaultPolicy(len(bft.Roster().List))
+}
+
 func (bft *ProtocolBFTCoSi) getCosi(t RoundType) *cosi.CoSi {
 	if t == RoundPrepare {
 		return bft.prepare
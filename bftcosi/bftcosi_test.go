@@ -1,6 +1,7 @@
 package bftcosi
 
 import (
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -11,9 +12,12 @@ import (
 
 	"fmt"
 
+	"github.com/dedis/paper_chainiac/bls"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
 )
 
 type Counter struct {
@@ -92,11 +96,289 @@ func TestThreshold(t *testing.T) {
 		node, err := local.CreateProtocol(TestProtocolName, tree)
 		log.ErrFatal(err)
 		bc := node.(*ProtocolBFTCoSi)
-		assert.Equal(t, thr, bc.threshold, "hosts was %d", hosts)
+		// Less than thr nodes may refuse
+		exceptions := make([]Exception, thr)
+		for i := range exceptions {
+			exceptions[i].Index = i
+		}
+		assert.Nil(t, bc.policy().Check(hosts, exceptions[:thr-1]), "hosts was %d", hosts)
+		assert.NotNil(t, bc.policy().Check(hosts, exceptions), "hosts was %d", hosts)
+		local.CloseAll()
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	exceptions := []Exception{{Index: 0}, {Index: 3}}
+	for _, p := range []struct {
+		policy *Policy
+		ok     bool
+	}{
+		{&Policy{Type: PolicyCount, Threshold: 3}, true},
+		{&Policy{Type: PolicyCount, Threshold: 4}, false},
+		{&Policy{Type: PolicyFraction, Numerator: 3, Denominator: 5}, true},
+		{&Policy{Type: PolicyFraction, Numerator: 2, Denominator: 3}, false},
+		{&Policy{Type: PolicyFraction, Numerator: 1}, false},
+		{&Policy{Type: PolicyWeighted, Weights: []int{5, 1, 1, 5, 1}, Threshold: 3}, true},
+		{&Policy{Type: PolicyWeighted, Weights: []int{5, 1, 1, 5, 1}, Threshold: 4}, false},
+		{&Policy{Type: PolicyWeighted, Weights: []int{1, 1}, Threshold: 1}, false},
+		{&Policy{Type: PolicyType(10)}, false},
+	} {
+		err := p.policy.Check(5, exceptions)
+		assert.Equal(t, p.ok, err == nil, "policy %+v: %v", p.policy, err)
+	}
+	assert.NotNil(t, (&Policy{}).Check(5, []Exception{{Index: 5}}))
+}
+
+func TestPolicySignature(t *testing.T) {
+	const TestProtocolName = "DummyBFTCoSiPolicy"
+
+	// The node at index 1 refuses to sign
+	onet.GlobalProtocolRegister(TestProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		if n.TreeNode().RosterIndex == 1 {
+			return NewBFTCoSiProtocol(n, func(m, d []byte) bool { return false })
+		}
+		return NewBFTCoSiProtocol(n, verifyTrue)
+	})
+
+	for _, p := range []struct {
+		policy *Policy
+		ok     bool
+	}{
+		{&Policy{Type: PolicyCount, Threshold: 3}, true},
+		{&Policy{Type: PolicyFraction, Numerator: 1, Denominator: 1}, false},
+		{&Policy{Type: PolicyWeighted, Weights: []int{1, 4, 1, 1}, Threshold: 4}, false},
+	} {
+		local := onet.NewLocalTest()
+		_, roster, tree := local.GenBigTree(4, 4, 2, true, true)
+		node, err := local.CreateProtocol(TestProtocolName, tree)
+		log.ErrFatal(err)
+		root := node.(*ProtocolBFTCoSi)
+		root.Msg = []byte("Hello BFTCoSi")
+		root.Policy = p.policy
+		done := make(chan *BFTSignature, 1)
+		root.RegisterOnSignatureDone(func(sig *BFTSignature) {
+			done <- sig
+		})
+		go node.Start()
+
+		select {
+		case sig := <-done:
+			err := sig.Verify(root.Suite(), roster.Publics())
+			assert.Equal(t, p.ok, err == nil, "policy %+v: %v", p.policy, err)
+			if p.ok {
+				// The policy is signed together with the message
+				sig.Policy = &Policy{Type: PolicyCount, Threshold: 2}
+				assert.NotNil(t, sig.Verify(root.Suite(), roster.Publics()))
+				sig.Policy = nil
+				assert.NotNil(t, sig.Verify(root.Suite(), roster.Publics()))
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Protocol didn't finish")
+		}
 		local.CloseAll()
 	}
 }
 
+func TestCompactSignature(t *testing.T) {
+	const refuseProtocol = "DummyBFTCoSiCompact"
+	const allProtocol = "DummyBFTCoSiCompactAll"
+
+	// The node at index 1 refuses to sign
+	onet.GlobalProtocolRegister(refuseProtocol, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		if n.TreeNode().RosterIndex == 1 {
+			return NewBFTCoSiProtocol(n, func(m, d []byte) bool { return false })
+		}
+		return NewBFTCoSiProtocol(n, verifyTrue)
+	})
+	onet.GlobalProtocolRegister(allProtocol, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		return NewBFTCoSiProtocol(n, verifyTrue)
+	})
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, roster, tree := local.GenBigTree(4, 4, 2, true, true)
+	publics := roster.Publics()
+	root, sig := runSignature(t, local, refuseProtocol, tree)
+	suite := root.Suite()
+	assert.Nil(t, sig.Verify(suite, publics))
+	assert.Equal(t, 0, len(sig.Exceptions))
+	assert.Nil(t, sig.ExceptionCommit)
+	assert.Equal(t, []byte{0x0d}, sig.Bitmap)
+	signers, err := sig.Signers(roster)
+	log.ErrFatal(err)
+	assert.Equal(t, []*network.ServerIdentity{roster.List[0], roster.List[2],
+		roster.List[3]}, signers)
+
+	// The bitmap is part of the verification
+	for _, bitmap := range [][]byte{{0x0f}, {0x09}, {0x1d}, {0x0d, 0x00}, {0x00}} {
+		tampered := *sig
+		tampered.Bitmap = bitmap
+		assert.NotNil(t, tampered.Verify(suite, publics), "%x", bitmap)
+	}
+	mixed := *sig
+	mixed.Exceptions = []Exception{{Index: 1}}
+	assert.NotNil(t, mixed.Verify(suite, publics))
+	_, err = sig.Signers(&onet.Roster{List: roster.List[:2]})
+	assert.NotNil(t, err)
+
+	// Signatures in the old format still verify if everybody signed and
+	// compact to a full bitmap
+	_, all := runSignature(t, local, allProtocol, tree)
+	assert.Equal(t, []byte{0x0f}, all.Bitmap)
+	legacy := *all
+	legacy.Bitmap = nil
+	assert.Nil(t, legacy.Verify(suite, publics))
+	compact, err := legacy.Compact(len(publics))
+	log.ErrFatal(err)
+	assert.Equal(t, all.Bitmap, compact.Bitmap)
+	assert.Nil(t, compact.Verify(suite, publics))
+
+	// Commitments of missing members are not covered by the challenge,
+	// so they could be chosen to forge a signature without any key:
+	// V - r*B + k*A
+	msg := signedMessage(all.Msg, all.Policy)
+	forge := func(full, reduced abstract.Point) ([]byte, abstract.Point) {
+		v := suite.Point().Mul(nil, suite.Scalar().SetInt64(7))
+		r := suite.Scalar().SetInt64(42)
+		k, err := challenge(suite, v, full, msg)
+		log.ErrFatal(err)
+		exCommit := suite.Point().Sub(v, suite.Point().Mul(nil, r))
+		exCommit.Add(exCommit, suite.Point().Mul(reduced, k))
+		forged, err := cosiSignature(v, r)
+		log.ErrFatal(err)
+		return forged, exCommit
+	}
+	full := aggregatePublic(suite, publics, all.Bitmap)
+	forged := *all
+	forged.Sig, forged.ExceptionCommit = forge(full, full)
+	assert.NotNil(t, forged.Verify(suite, publics))
+	reduced := aggregatePublic(suite, publics, sig.Bitmap)
+	sigEx, exCommit := forge(full, reduced)
+	forged = BFTSignature{Sig: sigEx, Msg: all.Msg, Policy: all.Policy,
+		Exceptions: []Exception{{Index: 1, Commitment: exCommit}}}
+	assert.NotNil(t, forged.Verify(suite, publics))
+	forged.Exceptions = append(forged.Exceptions, forged.Exceptions[0])
+	assert.NotNil(t, forged.Verify(suite, publics))
+	_, err = forged.Compact(len(publics))
+	assert.NotNil(t, err)
+}
+
+// runSignature runs the protocol name on tree with a policy of 3 signers
+// and returns the root and its signature.
+func runSignature(t *testing.T, local *onet.LocalTest, name string,
+	tree *onet.Tree) (*ProtocolBFTCoSi, *BFTSignature) {
+	node, err := local.CreateProtocol(name, tree)
+	log.ErrFatal(err)
+	root := node.(*ProtocolBFTCoSi)
+	root.Msg = []byte("Hello BFTCoSi")
+	root.Policy = &Policy{Type: PolicyCount, Threshold: 3}
+	done := make(chan *BFTSignature, 1)
+	root.RegisterOnSignatureDone(func(sig *BFTSignature) {
+		done <- sig
+	})
+	go node.Start()
+
+	select {
+	case sig := <-done:
+		return root, sig
+	case <-time.After(10 * time.Second):
+		t.Fatal("Protocol didn't finish")
+	}
+	return nil, nil
+}
+
+func TestBLSCoSi(t *testing.T) {
+	const TestProtocolName = "DummyBLSCoSi"
+
+	// The node at index 1 refuses to sign
+	onet.GlobalProtocolRegister(TestProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		key := blsKey(n.ServerIdentity())
+		if n.TreeNode().RosterIndex == 1 {
+			return NewBLSCoSiProtocol(n, func(m, d []byte) bool { return false }, key)
+		}
+		return NewBLSCoSiProtocol(n, verifyTrue, key)
+	})
+
+	for _, p := range []struct {
+		policy *Policy
+		ok     bool
+	}{
+		{nil, true},
+		{&Policy{Type: PolicyCount, Threshold: 6}, true},
+		{&Policy{Type: PolicyFraction, Numerator: 1, Denominator: 1}, false},
+	} {
+		local := onet.NewLocalTest()
+		_, roster, tree := local.GenBigTree(7, 7, 2, true, true)
+		var publics [][]byte
+		for _, si := range roster.List {
+			publics = append(publics, blsKey(si).PublicBytes())
+		}
+		node, err := local.CreateProtocol(TestProtocolName, tree)
+		log.ErrFatal(err)
+		root := node.(*ProtocolBLSCoSi)
+		root.Msg = []byte("Hello BLSCoSi")
+		root.Policy = p.policy
+		root.Publics = publics
+		done := make(chan *BFTSignature, 1)
+		root.RegisterOnSignatureDone(func(sig *BFTSignature) {
+			done <- sig
+		})
+		go node.Start()
+
+		select {
+		case sig := <-done:
+			if !p.ok {
+				assert.Nil(t, sig.Sig)
+				local.CloseAll()
+				continue
+			}
+			assert.Nil(t, sig.VerifyBLS(publics), "policy %+v", p.policy)
+			assert.Equal(t, []byte{0x7d}, sig.Bitmap)
+			assert.NotNil(t, sig.Verify(root.Suite(), roster.Publics()))
+			// the bitmap and the policy can't be changed
+			sig.Bitmap = []byte{0x7f}
+			assert.NotNil(t, sig.VerifyBLS(publics))
+			sig.Bitmap = []byte{0x7d}
+			sig.Policy = &Policy{Type: PolicyCount, Threshold: 2}
+			assert.NotNil(t, sig.VerifyBLS(publics))
+		case <-time.After(10 * time.Second):
+			t.Fatal("Protocol didn't finish")
+		}
+		local.CloseAll()
+	}
+}
+
+func TestBLSCoSiShortPublics(t *testing.T) {
+	const TestProtocolName = "DummyBLSCoSiShortPublics"
+	onet.GlobalProtocolRegister(TestProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		return NewBLSCoSiProtocol(n, verifyTrue, blsKey(n.ServerIdentity()))
+	})
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, roster, tree := local.GenBigTree(7, 7, 2, true, true)
+	node, err := local.CreateProtocol(TestProtocolName, tree)
+	log.ErrFatal(err)
+	root := node.(*ProtocolBLSCoSi)
+
+	// A leader sending too few keys is refused by the followers, instead
+	// of making the ones with children panic on the signatures of their
+	// subtree.
+	short := [][]byte{blsKey(roster.List[0]).PublicBytes()}
+	log.ErrFatal(root.SendToChildrenInParallel(&BLSPrepare{Msg: []byte("Hello"),
+		Publics: short}))
+	time.Sleep(500 * time.Millisecond)
+
+	// Stopping the leader ends its Dispatch, and Done can be called again
+	// when Dispatch returns.
+	root.Done()
+	root.Done()
+}
+
+// blsKey returns the BLS key pair of si in the tests.
+func blsKey(si *network.ServerIdentity) *bls.KeyPair {
+	return bls.NewKeyPairFromSeed([]byte(si.Public.String()))
+}
+
 func TestCheckRefuse(t *testing.T) {
 	const TestProtocolName = "DummyBFTCoSiRefuse"
 
@@ -176,6 +458,269 @@ func TestCheckRefuseParallel(t *testing.T) {
 	wg.Wait()
 }
 
+func TestViewChange(t *testing.T) {
+	const TestProtocolName = "DummyBFTCoSiViewChange"
+
+	// Every node reports the new round it leads after a view change and
+	// its signature
+	newRound := make(chan *ProtocolBFTCoSi, 1)
+	signature := make(chan *BFTSignature, 1)
+	onet.GlobalProtocolRegister(TestProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		bft, err := NewBFTCoSiProtocol(n, verify)
+		if err != nil {
+			return nil, err
+		}
+		bft.RegisterOnViewChange(func(next *ProtocolBFTCoSi) {
+			next.RegisterOnSignatureDone(func(sig *BFTSignature) {
+				signature <- sig
+			})
+			newRound <- next
+		})
+		return bft, nil
+	})
+
+	for _, nbrHosts := range []int{4, 7} {
+		log.Lvl2("Killing root of", nbrHosts, "hosts")
+		runViewChange(t, TestProtocolName, nbrHosts, newRound, signature)
+	}
+}
+
+// runViewChange kills the root after all followers verified the message and
+// checks that the next node of the roster gets a signature with the root as
+// exception.
+func runViewChange(t *testing.T, name string, nbrHosts int,
+	newRound chan *ProtocolBFTCoSi, signature chan *BFTSignature) {
+	// release has to be closed after CloseAll, so the verification of the
+	// root doesn't continue a running protocol
+	release := make(chan bool)
+	defer close(release)
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, roster, tree := local.GenBigTree(nbrHosts, nbrHosts, 2, true, true)
+
+	node, err := local.CreateProtocol(name, tree)
+	log.ErrFatal(err)
+	root := node.(*ProtocolBFTCoSi)
+	root.Msg = []byte("Hello BFTCoSi")
+	root.ViewChangeTimeout = 500 * time.Millisecond
+	cMux.Lock()
+	counter := &Counter{}
+	counters.add(counter)
+	root.Data = []byte(strconv.Itoa(counters.size() - 1))
+	cMux.Unlock()
+
+	// The root stops in the middle of the prepare round, once all
+	// followers verified the message.
+	root.VerificationFunction = func(m, d []byte) bool {
+		for {
+			counter.Lock()
+			verified := counter.veriCount
+			counter.Unlock()
+			if verified == nbrHosts-1 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		root.Done()
+		<-release
+		return true
+	}
+	go node.Start()
+
+	var next *ProtocolBFTCoSi
+	select {
+	case next = <-newRound:
+	case <-time.After(10 * time.Second):
+		t.Fatal("No view change after the root died")
+	}
+	assert.Equal(t, roster.List[1].ID, next.ServerIdentity().ID,
+		"New leader is not the next node of the roster")
+	assert.Equal(t, root.Msg, next.Msg)
+
+	select {
+	case sig := <-signature:
+		assert.Nil(t, sig.Verify(next.Suite(), roster.Publics()))
+		if missing := sig.Missing(nbrHosts); assert.Equal(t, 1, len(missing)) {
+			assert.Equal(t, 0, missing[0].Index)
+		}
+		counter.Lock()
+		assert.Equal(t, 2*(nbrHosts-1), counter.veriCount)
+		counter.Unlock()
+	case <-time.After(10 * time.Second):
+		t.Fatal("New leader didn't get a signature")
+	}
+}
+
+// silentNode is a protocol that never answers, like a crashed node.
+type silentNode struct {
+	*onet.TreeNodeInstance
+}
+
+func (s *silentNode) Start() error    { return nil }
+func (s *silentNode) Dispatch() error { return nil }
+
+func TestPhaseTimeout(t *testing.T) {
+	const silentProtocol = "DummyBFTCoSiSilent"
+	const stuckProtocol = "DummyBFTCoSiStuck"
+	release := make(chan bool)
+	defer close(release)
+
+	// The node at index 1 doesn't answer at all, so its subtree doesn't
+	// commit.
+	onet.GlobalProtocolRegister(silentProtocol, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		if n.TreeNode().RosterIndex == 1 {
+			return &silentNode{n}, nil
+		}
+		return NewBFTCoSiProtocol(n, verifyTrue)
+	})
+	runPhaseTimeout(t, silentProtocol, 1)
+
+	// The node at index 2 commits, but its verification never finishes,
+	// so its subtree doesn't respond.
+	onet.GlobalProtocolRegister(stuckProtocol, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		if n.TreeNode().RosterIndex == 2 {
+			return NewBFTCoSiProtocol(n, func(m, d []byte) bool {
+				<-release
+				return true
+			})
+		}
+		return NewBFTCoSiProtocol(n, verifyTrue)
+	})
+	runPhaseTimeout(t, stuckProtocol, 2)
+}
+
+// runPhaseTimeout runs the protocol on a binary tree of 7 nodes and checks
+// that the signature is valid with exceptions for the subtree of the node
+// with the given index in the roster.
+func runPhaseTimeout(t *testing.T, name string, missing int) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, roster, tree := local.GenBigTree(7, 7, 2, true, true)
+	var exceptions []int
+	for _, tn := range tree.List() {
+		if tn.RosterIndex == missing {
+			for _, sub := range subtree(tn) {
+				exceptions = append(exceptions, sub.RosterIndex)
+			}
+		}
+	}
+	sort.Ints(exceptions)
+	if len(exceptions) < 2 {
+		t.Fatal("Node", missing, "should have a subtree")
+	}
+
+	node, err := local.CreateProtocol(name, tree)
+	log.ErrFatal(err)
+	root := node.(*ProtocolBFTCoSi)
+	root.Msg = []byte("Hello BFTCoSi")
+	root.PhaseTimeout = 200 * time.Millisecond
+	root.ViewChangeTimeout = 0
+	done := make(chan *BFTSignature, 1)
+	root.RegisterOnSignatureDone(func(sig *BFTSignature) {
+		done <- sig
+	})
+	go node.Start()
+
+	select {
+	case sig := <-done:
+		assert.Nil(t, sig.Verify(root.Suite(), roster.Publics()))
+		var indexes []int
+		for _, ex := range sig.Missing(len(roster.List)) {
+			indexes = append(indexes, ex.Index)
+		}
+		sort.Ints(indexes)
+		assert.Equal(t, exceptions, indexes)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Missing subtree blocked the protocol")
+	}
+}
+
+// dropResponse is a BFTCoSi node that commits, but stops before it sends
+// its response in the round drop.
+type dropResponse struct {
+	*ProtocolBFTCoSi
+	drop RoundType
+}
+
+func (d *dropResponse) Dispatch() error {
+	if err := d.handleAnnouncement(<-d.announceChan); err != nil {
+		return err
+	}
+	var commits []commitChan
+	if !d.IsLeaf() {
+		commits = d.collectCommitments()
+	}
+	if err := d.handleCommitment(commits); err != nil {
+		return err
+	}
+	if d.drop == RoundPrepare {
+		return nil
+	}
+	if err := d.handleChallengePrepare(<-d.challengePrepareChan); err != nil {
+		return err
+	}
+	var responses []responseChan
+	if !d.IsLeaf() {
+		responses = d.collectResponses(RoundPrepare)
+	}
+	return d.handleResponse(RoundPrepare, responses)
+}
+
+func TestRestart(t *testing.T) {
+	for name, round := range map[string]RoundType{
+		"DummyBFTCoSiDropPrepare": RoundPrepare,
+		"DummyBFTCoSiDropCommit":  RoundCommit,
+	} {
+		round := round
+		// The node at index 1 commits, but doesn't respond
+		onet.GlobalProtocolRegister(name, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+			bft, err := NewBFTCoSiProtocol(n, verifyTrue)
+			if err != nil {
+				return nil, err
+			}
+			if n.TreeNode().RosterIndex == 1 {
+				return &dropResponse{bft, round}, nil
+			}
+			return bft, nil
+		})
+		log.Lvl2("Dropping response in round", round)
+		runRestart(t, name)
+	}
+}
+
+// runRestart runs the protocol on a binary tree of 7 nodes and checks that
+// the leader restarts the round without the node at index 1, so that the
+// signature is valid and only misses this node.
+func runRestart(t *testing.T, name string) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, roster, tree := local.GenBigTree(7, 7, 2, true, true)
+
+	node, err := local.CreateProtocol(name, tree)
+	log.ErrFatal(err)
+	root := node.(*ProtocolBFTCoSi)
+	root.Msg = []byte("Hello BFTCoSi")
+	root.Policy = &Policy{Type: PolicyCount, Threshold: 6}
+	root.PhaseTimeout = 200 * time.Millisecond
+	root.ViewChangeTimeout = 0
+	done := make(chan bool, 1)
+	root.RegisterOnDone(func() {
+		done <- true
+	})
+	go node.Start()
+
+	select {
+	case <-done:
+		sig := root.Signature()
+		assert.Nil(t, sig.Verify(root.Suite(), roster.Publics()))
+		if missing := sig.Missing(len(roster.List)); assert.Equal(t, 1, len(missing)) {
+			assert.Equal(t, 1, missing[0].Index)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Round wasn't restarted without the missing response")
+	}
+}
+
 func runProtocol(t *testing.T, name string, refuseCount int) {
 	for _, nbrHosts := range []int{3, 4, 13} {
 		runProtocolOnce(t, nbrHosts, name, refuseCount, true)
@@ -247,6 +792,11 @@ func runProtocolOnceGo(nbrHosts int, name string, refuseCount int,
 	return nil
 }
 
+// Verify function that always returns true.
+func verifyTrue(m []byte, d []byte) bool {
+	return true
+}
+
 // Verify function that returns true if the length of the data is 1.
 func verify(m []byte, d []byte) bool {
 	c, err := strconv.Atoi(string(d))
@@ -0,0 +1,123 @@
+package bftcosi
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// bitmapLen returns the size of the bitmap of a roster of size n.
+func bitmapLen(n int) int {
+	return (n + 7) / 8
+}
+
+// bitmapSet marks the member at index i in bitmap.
+func bitmapSet(bitmap []byte, i int) {
+	bitmap[i/8] |= 1 << uint(i%8)
+}
+
+// bitmapIsSet returns whether the member at index i is marked in bitmap.
+func bitmapIsSet(bitmap []byte, i int) bool {
+	return i >= 0 && i/8 < len(bitmap) && bitmap[i/8]&(1<<uint(i%8)) != 0
+}
+
+// fullBitmap returns the bitmap of a roster of size n where all members
+// signed.
+func fullBitmap(n int) []byte {
+	bitmap := make([]byte, bitmapLen(n))
+	for i := 0; i < n; i++ {
+		bitmapSet(bitmap, i)
+	}
+	return bitmap
+}
+
+// aggregatePublic returns the sum of the public keys of the members marked
+// in bitmap.
+func aggregatePublic(s abstract.Suite, publics []abstract.Point, bitmap []byte) abstract.Point {
+	agg := s.Point().Null()
+	for i, p := range publics {
+		if bitmapIsSet(bitmap, i) {
+			agg.Add(agg, p)
+		}
+	}
+	return agg
+}
+
+// checkBitmap returns an error if bitmap is not the bitmap of a roster of
+// size n.
+func checkBitmap(bitmap []byte, n int) error {
+	if len(bitmap) != bitmapLen(n) {
+		return errors.New("Wrong size of bitmap")
+	}
+	for i := n; i < 8*len(bitmap); i++ {
+		if bitmapIsSet(bitmap, i) {
+			return errors.New("Invalid signer in bitmap")
+		}
+	}
+	return nil
+}
+
+// BitmapExceptions returns an exception for every member of a roster of
+// size n that is not marked in bitmap, so that the policy can be checked.
+func BitmapExceptions(bitmap []byte, n int) []Exception {
+	var exs []Exception
+	for i := 0; i < n; i++ {
+		if !bitmapIsSet(bitmap, i) {
+			exs = append(exs, Exception{Index: i})
+		}
+	}
+	return exs
+}
+
+// Compact returns the signature in the old format with the list of
+// exceptions replaced by the bitmap of the signers, for a roster of size n.
+// Signatures that already have a bitmap are returned as they are. Old
+// signatures with exceptions can't be verified and are refused.
+func (bs *BFTSignature) Compact(n int) (*BFTSignature, error) {
+	if bs.Scheme != SchemeCoSi || bs.Bitmap != nil {
+		return bs, nil
+	}
+	if len(bs.Exceptions) > 0 {
+		return nil, errors.New("Exceptions are not covered by the signature")
+	}
+	compact := *bs
+	compact.Bitmap = fullBitmap(n)
+	return &compact, nil
+}
+
+// Missing returns an exception for every member of a roster of size n that
+// did not sign.
+func (bs *BFTSignature) Missing(n int) []Exception {
+	if bs.Bitmap == nil && bs.Scheme == SchemeCoSi {
+		return bs.Exceptions
+	}
+	return BitmapExceptions(bs.Bitmap, n)
+}
+
+// Signers returns the members of roster that signed, in the order of the
+// roster. It doesn't verify the signature.
+func (bs *BFTSignature) Signers(roster *onet.Roster) ([]*network.ServerIdentity, error) {
+	n := len(roster.List)
+	if bs.Bitmap != nil || bs.Scheme != SchemeCoSi {
+		if err := checkBitmap(bs.Bitmap, n); err != nil {
+			return nil, err
+		}
+	}
+	missing := make([]bool, n)
+	for _, ex := range bs.Missing(n) {
+		if ex.Index < 0 || ex.Index >= n {
+			return nil, fmt.Errorf("Invalid exception for index %d", ex.Index)
+		}
+		missing[ex.Index] = true
+	}
+	var signers []*network.ServerIdentity
+	for i, si := range roster.List {
+		if !missing[i] {
+			signers = append(signers, si)
+		}
+	}
+	return signers, nil
+}
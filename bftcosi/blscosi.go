@@ -0,0 +1,450 @@
+package bftcosi
+
+/*
+BLSCoSi is an alternative to BFTCoSi using BLS signatures instead of Schnorr
+CoSi. As BLS signatures aggregate without commitments, both rounds only need
+one message down and one message up the tree: the leader sends the message
+down, every node verifies it, signs it and sends the aggregate of its
+signature and of the signatures of its subtree to its parent, together with
+a bitmap of the signers. If the signers of the prepare round satisfy the
+policy, the leader sends their signature down in the commit round and the
+nodes sign the message itself. The result is a signature of constant size,
+which verifies against the BLS keys of the signers with one pairing check.
+
+The BLS keys of the roster are given by the leader and have to be trusted:
+the caller must check their proofs of possession, see bls.VerifyPossession.
+There is no view change - if the leader fails, the round fails. A leader
+that stops the round with Abort also stops the followers waiting in it.
+*/
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dedis/paper_chainiac/bls"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+// Scheme is the signature scheme of a BFTSignature.
+type Scheme int32
+
+const (
+	// SchemeCoSi signatures are Schnorr collective signatures with a
+	// bitmap of the signers, created by ProtocolBFTCoSi.
+	SchemeCoSi Scheme = iota
+	// SchemeBLS signatures are aggregate BLS signatures with a bitmap of
+	// the signers, created by ProtocolBLSCoSi.
+	SchemeBLS
+)
+
+// ProtocolBLSCoSi signs a message with aggregate BLS signatures in a prepare
+// and a commit round.
+type ProtocolBLSCoSi struct {
+	*onet.TreeNodeInstance
+
+	// Msg is the message that will be signed
+	Msg []byte
+	// Data going along the msg to the verification
+	Data []byte
+	// Policy is how many nodes have to sign, like in ProtocolBFTCoSi
+	Policy *Policy
+	// Publics holds the BLS public key of every member of the roster, in
+	// the order of the roster. The leader sends them to the followers.
+	Publics [][]byte
+	// PhaseTimeout is how long a node waits for the signatures of its
+	// children for every level of its subtree. The leader sends its value
+	// to the followers, 0 waits forever.
+	PhaseTimeout time.Duration
+	// VerificationFunction is called in the prepare round
+	VerificationFunction VerificationFunction
+
+	// Key is our BLS key pair
+	Key *bls.KeyPair
+	// our index in the Roster list
+	index int
+	// prepareRefusal is set if we didn't sign in the prepare round
+	prepareRefusal bool
+	// verified is set once we verified the message, signed once we
+	// signed the commit round
+	verified bool
+	signed   bool
+
+	prepareChan chan blsPrepareChan
+	commitChan  chan blsCommitChan
+	shareChan   chan blsShareChan
+	// closing is closed by Shutdown to stop Dispatch
+	closing      chan struct{}
+	shutdownOnce sync.Once
+	doneOnce     sync.Once
+
+	// onSignatureDone is called on the leader with the final signature
+	onSignatureDone func(*BFTSignature)
+	// onRoundEnd is called on a follower that verified the message, once
+	// its part of the round ended
+	onRoundEnd func(msg []byte, signed bool)
+}
+
+// NewBLSCoSiProtocol returns a new BLSCoSi instance signing with key.
+func NewBLSCoSiProtocol(n *onet.TreeNodeInstance, verify VerificationFunction,
+	key *bls.KeyPair) (*ProtocolBLSCoSi, error) {
+	p := &ProtocolBLSCoSi{
+		TreeNodeInstance:     n,
+		VerificationFunction: verify,
+		PhaseTimeout:         DefaultPhaseTimeout,
+		Key:                  key,
+		Msg:                  make([]byte, 0),
+		Data:                 make([]byte, 0),
+		closing:              make(chan struct{}),
+	}
+	p.index, _ = n.Roster().Search(n.ServerIdentity().ID)
+	if err := p.RegisterChannels(&p.prepareChan, &p.commitChan,
+		&p.shareChan); err != nil {
+		return nil, err
+	}
+	if err := p.RegisterHandler(p.handleAbort); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Start sends the message of the prepare round down the tree.
+func (p *ProtocolBLSCoSi) Start() error {
+	if len(p.Publics) != len(p.Roster().List) {
+		return errors.New("Need a BLS key for every member of the roster")
+	}
+	p.prepareChan <- blsPrepareChan{BLSPrepare: BLSPrepare{
+		Msg:          p.Msg,
+		Data:         p.Data,
+		Policy:       p.Policy,
+		Publics:      p.Publics,
+		PhaseTimeout: uint64(p.PhaseTimeout / time.Millisecond),
+	}}
+	return nil
+}
+
+// Dispatch runs the prepare and then the commit round, until the protocol
+// is shut down.
+func (p *ProtocolBLSCoSi) Dispatch() error {
+	defer p.Done()
+	defer p.endRound()
+	var prep blsPrepareChan
+	var ok bool
+	select {
+	case prep, ok = <-p.prepareChan:
+		if !ok {
+			return nil
+		}
+	case <-p.closing:
+		return nil
+	}
+	if err := p.handlePrepare(prep.BLSPrepare); err != nil {
+		return err
+	}
+	var commit blsCommitChan
+	select {
+	case commit, ok = <-p.commitChan:
+		if !ok {
+			return nil
+		}
+	case <-p.closing:
+		return nil
+	}
+	return p.handleCommit(commit.BLSCommit)
+}
+
+// Shutdown stops Dispatch, also while it waits for the signatures of the
+// children.
+func (p *ProtocolBLSCoSi) Shutdown() error {
+	p.shutdownOnce.Do(func() {
+		close(p.closing)
+	})
+	return nil
+}
+
+// Done stops the protocol. It runs only once, as Abort and Dispatch both
+// call it.
+func (p *ProtocolBLSCoSi) Done() {
+	p.doneOnce.Do(func() {
+		p.Shutdown()
+		p.TreeNodeInstance.Done()
+	})
+}
+
+// Abort stops the round on the leader and sends Abort to the followers,
+// which stop waiting for the next round. The leader calls it instead of Done
+// if it stops waiting for the signature.
+func (p *ProtocolBLSCoSi) Abort() {
+	if p.IsRoot() {
+		abortRound(p.TreeNodeInstance)
+	}
+	p.Done()
+}
+
+// handleAbort stops the round if the leader aborted it.
+func (p *ProtocolBLSCoSi) handleAbort(msg abortChan) error {
+	if msg.TreeNode.RosterIndex != p.Root().RosterIndex {
+		return errors.New("Only the leader can abort the round")
+	}
+	log.Lvl2(p.Name(), "Leader aborted the round")
+	p.Done()
+	return nil
+}
+
+// RegisterOnSignatureDone registers a callback that is called on the leader
+// with the signature of the commit round. If the signers didn't satisfy the
+// policy, the Sig of the signature is nil.
+func (p *ProtocolBLSCoSi) RegisterOnSignatureDone(fn func(*BFTSignature)) {
+	p.onSignatureDone = fn
+}
+
+// RegisterOnRoundEnd registers a callback that is called on a follower once
+// its part of the round ended, if it verified the message, like in
+// ProtocolBFTCoSi. It gets the message and whether the follower signed the
+// commit round.
+func (p *ProtocolBLSCoSi) RegisterOnRoundEnd(fn func(msg []byte, signed bool)) {
+	p.onRoundEnd = fn
+}
+
+// endRound is called when Dispatch returns, after the verification of the
+// prepare round finished.
+func (p *ProtocolBLSCoSi) endRound() {
+	if p.verified && !p.IsRoot() && p.onRoundEnd != nil {
+		p.onRoundEnd(p.Msg, p.signed)
+	}
+}
+
+// handlePrepare verifies and signs the message of the prepare round
+// together with our subtree. The leader then starts the commit round.
+func (p *ProtocolBLSCoSi) handlePrepare(msg BLSPrepare) error {
+	if len(msg.Publics) != len(p.Roster().List) {
+		return errors.New("Prepare message needs a BLS key for every member of the roster")
+	}
+	if !p.IsRoot() {
+		p.Msg = msg.Msg
+		p.Data = msg.Data
+		p.Policy = msg.Policy
+		p.Publics = msg.Publics
+		p.PhaseTimeout = time.Duration(msg.PhaseTimeout) * time.Millisecond
+	}
+	if !p.IsLeaf() {
+		if err := p.SendToChildrenInParallel(&msg); err != nil {
+			log.Lvl2(p.Name(), "Couldn't reach all children:", err)
+		}
+	}
+	verified := make(chan bool, 1)
+	go func() {
+		verified <- p.ownKeyValid() && p.VerificationFunction(p.Msg, p.Data)
+	}()
+	prepare := prepareMessage(p.Msg, p.Policy)
+	shares := p.collectShares(RoundPrepare, prepare)
+	p.prepareRefusal = !<-verified
+	p.verified = !p.prepareRefusal
+	if p.prepareRefusal {
+		log.Lvl2(p.Name(), "Refused to sign")
+	}
+	sig, bitmap, err := p.aggregate(shares, !p.prepareRefusal, prepare)
+	if err != nil {
+		return err
+	}
+	if !p.IsRoot() {
+		return p.SendToParent(&BLSShare{TYPE: RoundPrepare, Sig: sig, Bitmap: bitmap})
+	}
+	p.commitChan <- blsCommitChan{BLSCommit: BLSCommit{Signature: &BFTSignature{
+		Sig:    sig,
+		Msg:    p.Msg,
+		Policy: p.Policy,
+		Scheme: SchemeBLS,
+		Bitmap: bitmap,
+	}}}
+	return nil
+}
+
+// handleCommit checks the signature of the prepare round and signs the
+// message together with our subtree, if the signers of the prepare round
+// satisfy the policy. The leader then outputs the signature.
+func (p *ProtocolBLSCoSi) handleCommit(msg BLSCommit) error {
+	refuse := p.prepareRefusal
+	if err := p.verifyPrepare(msg.Signature); err != nil {
+		log.Lvl3(p.Name(), "Signature of prepare round not valid:", err)
+		refuse = true
+	}
+	if !p.IsLeaf() {
+		if err := p.SendToChildrenInParallel(&msg); err != nil {
+			log.Lvl2(p.Name(), "Couldn't reach all children:", err)
+		}
+	}
+	commit := signedMessage(p.Msg, p.Policy)
+	p.signed = !refuse
+	sig, bitmap, err := p.aggregate(p.collectShares(RoundCommit, commit),
+		!refuse, commit)
+	if err != nil {
+		return err
+	}
+	if !p.IsRoot() {
+		return p.SendToParent(&BLSShare{TYPE: RoundCommit, Sig: sig, Bitmap: bitmap})
+	}
+	bftSig := &BFTSignature{
+		Sig:    sig,
+		Msg:    p.Msg,
+		Policy: p.Policy,
+		Scheme: SchemeBLS,
+		Bitmap: bitmap,
+	}
+	if err := p.policy().Check(len(p.Roster().List), BitmapExceptions(bitmap,
+		len(p.Roster().List))); err != nil {
+		log.Lvl2(p.Name(), "Policy not satisfied:", err)
+		bftSig.Sig = nil
+	}
+	if p.onSignatureDone != nil {
+		p.onSignatureDone(bftSig)
+	}
+	return nil
+}
+
+// verifyPrepare checks that sig is the signature of the prepare round on
+// our message and that its signers satisfy the policy.
+func (p *ProtocolBLSCoSi) verifyPrepare(sig *BFTSignature) error {
+	if sig == nil || !bytes.Equal(sig.Msg, p.Msg) {
+		return errors.New("Signature of wrong message")
+	}
+	prepare := &BFTSignature{
+		Sig:    sig.Sig,
+		Msg:    prepareMessage(p.Msg, p.Policy),
+		Scheme: SchemeBLS,
+		Bitmap: sig.Bitmap,
+	}
+	if err := prepare.VerifyBLS(p.Publics); err != nil {
+		return err
+	}
+	return p.policy().Check(len(p.Roster().List),
+		BitmapExceptions(sig.Bitmap, len(p.Roster().List)))
+}
+
+// collectShares returns the valid signatures of our children in round t on
+// msg. Children that didn't send a valid signature before the phase timeout
+// are left out, together with their subtree.
+func (p *ProtocolBLSCoSi) collectShares(t RoundType, msg []byte) []BLSShare {
+	var shares []BLSShare
+	children := make(map[int]*onet.TreeNode)
+	for _, c := range p.Children() {
+		children[c.RosterIndex] = c
+	}
+	var timeout <-chan time.Time
+	if p.PhaseTimeout > 0 {
+		timeout = time.After(time.Duration(height(p.TreeNode())) * p.PhaseTimeout)
+	}
+	for len(children) > 0 {
+		select {
+		case share, ok := <-p.shareChan:
+			if !ok {
+				return shares
+			}
+			c := children[share.TreeNode.RosterIndex]
+			if share.TYPE != t || c == nil {
+				log.Lvl3(p.Name(), "Ignoring signature of", share.TreeNode)
+				continue
+			}
+			delete(children, c.RosterIndex)
+			if err := p.verifyShare(c, share.BLSShare, msg); err != nil {
+				log.Lvl2(p.Name(), "Invalid signature of", c.ServerIdentity, err)
+				continue
+			}
+			shares = append(shares, share.BLSShare)
+		case <-timeout:
+			log.Lvl2(p.Name(), "Timeout while waiting for signatures in round", t)
+			return shares
+		case <-p.closing:
+			return shares
+		}
+	}
+	return shares
+}
+
+// verifyShare checks that the signature of child c on msg is only signed by
+// nodes of its subtree.
+func (p *ProtocolBLSCoSi) verifyShare(c *onet.TreeNode, share BLSShare, msg []byte) error {
+	n := len(p.Roster().List)
+	if len(share.Bitmap) != bitmapLen(n) {
+		return errors.New("Wrong size of bitmap")
+	}
+	inSubtree := make(map[int]bool)
+	for _, tn := range subtree(c) {
+		inSubtree[tn.RosterIndex] = true
+	}
+	var publics [][]byte
+	for i := 0; i < 8*len(share.Bitmap); i++ {
+		if !bitmapIsSet(share.Bitmap, i) {
+			continue
+		}
+		if !inSubtree[i] {
+			return errors.New("Signer is not part of the subtree")
+		}
+		publics = append(publics, p.Publics[i])
+	}
+	if len(publics) == 0 {
+		if len(share.Sig) != 0 {
+			return errors.New("Signature without signers")
+		}
+		return nil
+	}
+	return bls.VerifyAggregate(publics, msg, share.Sig)
+}
+
+// aggregate returns the aggregate signature on msg and the bitmap of the
+// signers of shares, together with our own signature if sign is true. The
+// signature is nil if there are no signers.
+func (p *ProtocolBLSCoSi) aggregate(shares []BLSShare, sign bool, msg []byte) ([]byte, []byte, error) {
+	bitmap := make([]byte, bitmapLen(len(p.Roster().List)))
+	var sigs [][]byte
+	if sign {
+		sigs = append(sigs, p.Key.Sign(msg))
+		bitmapSet(bitmap, p.index)
+	}
+	for _, share := range shares {
+		if len(share.Sig) == 0 {
+			continue
+		}
+		sigs = append(sigs, share.Sig)
+		for i := range bitmap {
+			bitmap[i] |= share.Bitmap[i]
+		}
+	}
+	if len(sigs) == 0 {
+		return nil, bitmap, nil
+	}
+	sig, err := bls.AggregateSignatures(sigs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sig, bitmap, nil
+}
+
+// ownKeyValid returns whether the leader has our BLS key. Else our
+// signature would not verify.
+func (p *ProtocolBLSCoSi) ownKeyValid() bool {
+	if p.Key == nil || len(p.Publics) != len(p.Roster().List) ||
+		!bytes.Equal(p.Publics[p.index], p.Key.PublicBytes()) {
+		log.Lvl2(p.Name(), "Leader doesn't have our BLS key")
+		return false
+	}
+	return true
+}
+
+// policy returns the policy of the protocol.
+func (p *ProtocolBLSCoSi) policy() *Policy {
+	if p.Policy != nil {
+		return p.Policy
+	}
+	return DefaultPolicy(len(p.Roster().List))
+}
+
+// prepareMessage is what the nodes sign in the prepare round, so that the
+// signatures of both rounds are not the same.
+func prepareMessage(msg []byte, policy *Policy) []byte {
+	data := sha512.Sum512(signedMessage(msg, policy))
+	return data[:]
+}
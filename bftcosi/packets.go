@@ -4,6 +4,7 @@ import (
 	"crypto/sha512"
 	"errors"
 
+	"github.com/dedis/paper_chainiac/bls"
 	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/network"
@@ -16,6 +17,12 @@ func init() {
 		ChallengeCommit{},
 		Response{},
 		Exception{},
+		ViewChange{},
+		Abort{},
+		Policy{},
+		BLSPrepare{},
+		BLSCommit{},
+		BLSShare{},
 	} {
 		network.RegisterMessage(i)
 	}
@@ -33,38 +40,78 @@ const (
 )
 
 // BFTSignature is what a bftcosi protocol outputs. It contains the signature,
-// the message and some possible exceptions.
+// the message and the signers.
 type BFTSignature struct {
 	// cosi signature
 	Sig []byte
 	Msg []byte
-	// List of peers that did not want to sign.
+	// List of peers that did not want to sign. Only used by signatures in
+	// the old format, new signatures have a Bitmap instead. As the
+	// commitments of the exceptions are not covered by the challenge, only
+	// old signatures without exceptions verify.
 	Exceptions []Exception
+	// Policy the signers agreed on, signed together with Msg. Signatures
+	// without policy only sign Msg.
+	Policy *Policy
+	// Scheme is the signature scheme of Sig
+	Scheme Scheme
+	// Bitmap marks the members of the roster that signed: bit i%8 of byte
+	// i/8 for the member at index i.
+	Bitmap []byte
+	// ExceptionCommit was the aggregate of the commitments of the members
+	// missing in the Bitmap. It is not covered by the challenge, so
+	// signatures holding one are refused.
+	ExceptionCommit abstract.Point
 }
 
 // Verify returns whether the verification of the signature succeeds or not.
-// Specifically, it adjusts the signature according to the exception in the
-// signature, so it can be verified by dedis/crypto/cosi.
+// The challenge covers the aggregate commitment and the aggregate key of the
+// signers marked in the Bitmap, so members that didn't sign only reduce the
+// aggregate key.
 // publics is a slice of all public signatures, and the msg is the msg
-// being signed.
+// being signed. If the signature has a policy, the signers have to satisfy
+// it. Signatures in the old format without Bitmap are only accepted if all
+// members signed.
 func (bs *BFTSignature) Verify(s abstract.Suite, publics []abstract.Point) error {
 	if bs == nil || bs.Sig == nil || bs.Msg == nil {
 		return errors.New("Invalid signature")
 	}
-	// compute the aggregate key of all the signers
-	aggPublic := s.Point().Null()
-	for i := range publics {
-		aggPublic.Add(aggPublic, publics[i])
+	if bs.Scheme != SchemeCoSi {
+		return errors.New("Not a CoSi signature")
 	}
-	// compute the reduced public aggregate key (all - exception)
-	aggReducedPublic := s.Point().Null().Add(s.Point().Null(), aggPublic)
-
-	// compute the aggregate commit of exception
-	aggExCommit := s.Point().Null()
-	for _, ex := range bs.Exceptions {
-		aggExCommit = aggExCommit.Add(aggExCommit, ex.Commitment)
-		aggReducedPublic.Sub(aggReducedPublic, publics[ex.Index])
+	if len(bs.Sig) < 64 {
+		return errors.New("Signature too short")
+	}
+	if bs.ExceptionCommit != nil && !bs.ExceptionCommit.Equal(s.Point().Null()) {
+		return errors.New("Signature with commitments of exceptions")
+	}
+	n := len(publics)
+	bitmap := bs.Bitmap
+	if bitmap == nil {
+		if len(bs.Exceptions) > 0 {
+			return errors.New("Exceptions are not covered by the signature")
+		}
+		bitmap = fullBitmap(n)
+	} else {
+		if len(bs.Exceptions) > 0 {
+			return errors.New("Signature has both bitmap and exceptions")
+		}
+		if err := checkBitmap(bitmap, n); err != nil {
+			return err
+		}
+	}
+	missing := BitmapExceptions(bitmap, n)
+	if len(missing) == n {
+		return errors.New("No signers in bitmap")
 	}
+	if bs.Policy != nil {
+		if err := bs.Policy.Check(n, missing); err != nil {
+			return err
+		}
+	}
+	// compute the aggregate key of the signers
+	aggPublic := aggregatePublic(s, publics, bitmap)
+
 	// get back the commit to recreate  the challenge
 	origCommit := s.Point()
 	if err := origCommit.UnmarshalBinary(bs.Sig[0:32]); err != nil {
@@ -72,39 +119,82 @@ func (bs *BFTSignature) Verify(s abstract.Suite, publics []abstract.Point) error
 	}
 
 	// re create challenge
-	h := sha512.New()
-	if _, err := origCommit.MarshalTo(h); err != nil {
-		return err
-	}
-	if _, err := aggPublic.MarshalTo(h); err != nil {
-		return err
-	}
-	if _, err := h.Write(bs.Msg); err != nil {
+	k, err := challenge(s, origCommit, aggPublic, signedMessage(bs.Msg, bs.Policy))
+	if err != nil {
 		return err
 	}
 
 	// redo like in cosi -k*A + r*B == C
-	// only with C being the reduced version
-	k := s.Scalar().SetBytes(h.Sum(nil))
-	minusPublic := s.Point().Neg(aggReducedPublic)
+	minusPublic := s.Point().Neg(aggPublic)
 	ka := s.Point().Mul(minusPublic, k)
 	r := s.Scalar().SetBytes(bs.Sig[32:64])
 	rb := s.Point().Mul(nil, r)
 	left := s.Point().Add(rb, ka)
 
-	right := s.Point().Sub(origCommit, aggExCommit)
-
-	if !left.Equal(right) {
+	if !left.Equal(origCommit) {
 		return errors.New("Commit recreated is not equal to one given")
 	}
 	return nil
 }
 
-// Announce is the struct used during the announcement phase (of both
-// rounds)
+// challenge returns the CoSi challenge H(commit || public || msg) for the
+// aggregate commitment commit and the aggregate key public of the signers.
+func challenge(s abstract.Suite, commit, public abstract.Point,
+	msg []byte) (abstract.Scalar, error) {
+	h := sha512.New()
+	if _, err := commit.MarshalTo(h); err != nil {
+		return nil, err
+	}
+	if _, err := public.MarshalTo(h); err != nil {
+		return nil, err
+	}
+	if _, err := h.Write(msg); err != nil {
+		return nil, err
+	}
+	return s.Scalar().SetBytes(h.Sum(nil)), nil
+}
+
+// VerifyBLS checks a SchemeBLS signature against the BLS public keys of the
+// roster, with one pairing check. If the signature has a policy, the
+// signers marked in the bitmap have to satisfy it.
+func (bs *BFTSignature) VerifyBLS(publics [][]byte) error {
+	if bs == nil || bs.Sig == nil || bs.Msg == nil {
+		return errors.New("Invalid signature")
+	}
+	if bs.Scheme != SchemeBLS {
+		return errors.New("Not a BLS signature")
+	}
+	n := len(publics)
+	if err := checkBitmap(bs.Bitmap, n); err != nil {
+		return err
+	}
+	var signers [][]byte
+	for i := 0; i < n; i++ {
+		if bitmapIsSet(bs.Bitmap, i) {
+			signers = append(signers, publics[i])
+		}
+	}
+	if len(signers) == 0 {
+		return errors.New("No signers in bitmap")
+	}
+	if bs.Policy != nil {
+		if err := bs.Policy.Check(n, BitmapExceptions(bs.Bitmap, n)); err != nil {
+			return err
+		}
+	}
+	return bls.VerifyAggregate(signers, signedMessage(bs.Msg, bs.Policy), bs.Sig)
+}
+
+// Announce is the struct used during the announcement phase. It holds the
+// message, which is verified before the nodes commit. Timeout is the
+// ViewChangeTimeout and PhaseTimeout the PhaseTimeout of the leader, both in
+// milliseconds.
 type Announce struct {
-	TYPE    RoundType
-	Timeout uint64
+	Msg          []byte
+	Data         []byte
+	Policy       *Policy
+	Timeout      uint64
+	PhaseTimeout uint64
 }
 
 // announceChan is the type of the channel that will be used to catch
@@ -114,10 +204,13 @@ type announceChan struct {
 	Announce
 }
 
-// Commitment is the commitment packets that is sent for both rounds
+// Commitment is sent by every node to its parent with the aggregate
+// commitments of the signers of its subtree for both rounds. Bitmap marks
+// the signers.
 type Commitment struct {
-	TYPE       RoundType
-	Commitment abstract.Point
+	Prepare abstract.Point
+	Commit  abstract.Point
+	Bitmap  []byte
 }
 
 // commitChan is the type of the channel that will be used to catch commitment
@@ -128,25 +221,25 @@ type commitChan struct {
 }
 
 // ChallengePrepare is the challenge used by ByzCoin during the "prepare" phase.
-// It contains the basic challenge plus the message from which the challenge has
-// been generated.
+// It contains the aggregate commitment and the bitmap of the signers, so
+// that every node can check that the challenge is for the message of the
+// announcement.
 type ChallengePrepare struct {
-	Msg       []byte
-	Data      []byte
-	Challenge abstract.Scalar
+	Challenge  abstract.Scalar
+	Commitment abstract.Point
+	Bitmap     []byte
 }
 
 // ChallengeCommit  is the challenge used by BftCoSi during the "commit"
 // phase. It contains the basic challenge (out of the block we want to sign) +
-// the signature of the "prepare" round. It also contains the exception list
-// coming from the "prepare" phase. This exception list has been collected by
-// the root during the response of the "prepare" phase and broadcast it through
-// the challenge of the "commit". These are needed in order to verify the
-// signature and to see how many peers did not sign. It's not spoofable because
-// otherwise the signature verification will be wrong.
+// the signature of the "prepare" round. The bitmap of the signature shows
+// how many peers signed. It's not spoofable because otherwise the signature
+// verification will be wrong.
 type ChallengeCommit struct {
 	// Challenge for the current round
 	Challenge abstract.Scalar
+	// Commitment is the aggregate commitment of the current round
+	Commitment abstract.Point
 	// Signature is the signature response generated at the previous round (prepare)
 	Signature *BFTSignature
 }
@@ -165,11 +258,13 @@ type challengeCommitChan struct {
 }
 
 // Response is the struct used by ByzCoin during the response. It
-// contains the response + the basic exception list.
+// contains the aggregate response of the signers of a subtree. Failed marks
+// the nodes of the subtree that committed but didn't respond: nodes that
+// refused the challenge and children whose response is missing.
 type Response struct {
-	Response   abstract.Scalar
-	Exceptions []Exception
-	TYPE       RoundType
+	Response abstract.Scalar
+	TYPE     RoundType
+	Failed   []byte
 }
 
 // responseChan is the type of the channel used to catch the response messages.
@@ -178,13 +273,79 @@ type responseChan struct {
 	Response
 }
 
-// Exception represents the exception mechanism used in BFTCosi to indicate a
-// signer did not want to sign.
+// Exception represents a member of the roster that did not sign.
 // The index is the index of the public key of the cosigner that do not want to
 // sign.
-// The commit is needed in order to be able to
-// correctly verify the signature
+// The commit was used by signatures in the old format.
 type Exception struct {
 	Index      int
 	Commitment abstract.Point
 }
+
+// ViewChange is sent by a follower to the other followers if the leader
+// didn't finish the round in time. Msg is the message of the round, which
+// will be signed again with the next leader.
+type ViewChange struct {
+	Msg []byte
+}
+
+// viewChangeChan is the type of the handler for view change messages.
+type viewChangeChan struct {
+	*onet.TreeNode
+	ViewChange
+}
+
+// Abort is sent by the leader to all nodes of the tree if it stops the round
+// before the signature is done. The followers drop the round and don't ask
+// for a view change.
+type Abort struct{}
+
+// abortChan is the type of the handler for abort messages.
+type abortChan struct {
+	*onet.TreeNode
+	Abort
+}
+
+// BLSPrepare is sent down the tree by the leader of ProtocolBLSCoSi to
+// start the prepare round. PhaseTimeout is in milliseconds.
+type BLSPrepare struct {
+	Msg          []byte
+	Data         []byte
+	Policy       *Policy
+	Publics      [][]byte
+	PhaseTimeout uint64
+}
+
+// blsPrepareChan is the type of the channel for BLSPrepare messages.
+type blsPrepareChan struct {
+	*onet.TreeNode
+	BLSPrepare
+}
+
+// BLSCommit is sent down the tree by the leader of ProtocolBLSCoSi to start
+// the commit round. It holds the signature of the prepare round, so that
+// every node can check that enough nodes agreed.
+type BLSCommit struct {
+	Signature *BFTSignature
+}
+
+// blsCommitChan is the type of the channel for BLSCommit messages.
+type blsCommitChan struct {
+	*onet.TreeNode
+	BLSCommit
+}
+
+// BLSShare is the aggregate signature of a subtree in a round of
+// ProtocolBLSCoSi, sent to the parent. Sig is empty if nobody of the
+// subtree signed.
+type BLSShare struct {
+	TYPE   RoundType
+	Sig    []byte
+	Bitmap []byte
+}
+
+// blsShareChan is the type of the channel for BLSShare messages.
+type blsShareChan struct {
+	*onet.TreeNode
+	BLSShare
+}
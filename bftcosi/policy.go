@@ -0,0 +1,119 @@
+package bftcosi
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// PolicyType defines how a Policy counts the signers.
+type PolicyType int32
+
+const (
+	// PolicyCount needs at least Threshold signers.
+	PolicyCount PolicyType = iota
+	// PolicyFraction needs at least Numerator/Denominator of the roster
+	// to sign.
+	PolicyFraction
+	// PolicyWeighted gives every member of the roster a weight and needs
+	// the weights of the signers to sum up to at least Threshold.
+	PolicyWeighted
+)
+
+// Policy defines how many members of the roster have to sign a message. It
+// is part of the signed message, so that verifiers know which policy the
+// roster agreed on.
+type Policy struct {
+	Type PolicyType
+	// Threshold is the number of signers for PolicyCount and the sum of
+	// their weights for PolicyWeighted
+	Threshold int
+	// Numerator and Denominator are the fraction of the roster that has to
+	// sign for PolicyFraction
+	Numerator   int
+	Denominator int
+	// Weights holds the weight of every member of the roster for
+	// PolicyWeighted, in the order of the roster
+	Weights []int
+}
+
+// DefaultPolicy returns the policy of a protocol without Policy for a roster
+// of size n: less than (n+1)*2/3 members may refuse to sign.
+func DefaultPolicy(n int) *Policy {
+	return &Policy{Type: PolicyCount, Threshold: n - (n+1)*2/3 + 1}
+}
+
+// Check returns an error if the members of a roster of size n that are not
+// in exceptions don't satisfy the policy.
+func (p *Policy) Check(n int, exceptions []Exception) error {
+	signers := make([]bool, n)
+	for i := range signers {
+		signers[i] = true
+	}
+	for _, ex := range exceptions {
+		if ex.Index < 0 || ex.Index >= n {
+			return errors.New("Invalid exception in signature")
+		}
+		signers[ex.Index] = false
+	}
+	count := 0
+	for _, s := range signers {
+		if s {
+			count++
+		}
+	}
+
+	switch p.Type {
+	case PolicyCount:
+		if count < p.Threshold {
+			return fmt.Errorf("Only %d signers, but policy needs %d",
+				count, p.Threshold)
+		}
+	case PolicyFraction:
+		if p.Numerator < 0 || p.Denominator <= 0 {
+			return errors.New("Invalid fraction in policy")
+		}
+		if count*p.Denominator < p.Numerator*n {
+			return fmt.Errorf("Only %d out of %d signers, but policy needs %d/%d",
+				count, n, p.Numerator, p.Denominator)
+		}
+	case PolicyWeighted:
+		if len(p.Weights) != n {
+			return errors.New("Policy doesn't have a weight for every member")
+		}
+		weight := 0
+		for i, s := range signers {
+			if s {
+				weight += p.Weights[i]
+			}
+		}
+		if weight < p.Threshold {
+			return fmt.Errorf("Signers only have a weight of %d, but policy needs %d",
+				weight, p.Threshold)
+		}
+	default:
+		return fmt.Errorf("Unknown policy type %d", p.Type)
+	}
+	return nil
+}
+
+// signedMessage returns what the roster signs for msg: msg itself if there
+// is no policy, else the hash of the policy and msg, so that the policy
+// can't be changed without invalidating the signature.
+func signedMessage(msg []byte, p *Policy) []byte {
+	if p == nil {
+		return msg
+	}
+	h := sha512.New()
+	h.Write([]byte("BFTCoSiPolicy"))
+	for _, i := range []int{int(p.Type), p.Threshold, p.Numerator,
+		p.Denominator, len(p.Weights)} {
+		binary.Write(h, binary.BigEndian, int64(i))
+	}
+	for _, w := range p.Weights {
+		binary.Write(h, binary.BigEndian, int64(w))
+	}
+	h.Write(msg)
+	return h.Sum(nil)
+}
@@ -0,0 +1,221 @@
+package bftcosi
+
+/*
+View change: if the leader crashes during a round, the followers wait for it
+until the ViewChangeTimeout sent in the announcement runs out. Then they ask
+each other for a view change on the message of the round. Once more than
+two thirds of the followers agree, they stop the round and the next follower
+in the order of the roster starts a new round on the same message, with a
+tree of all followers. The replaced leader is missing in the bitmap of the
+signature.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+// DefaultViewChangeTimeout is the ViewChangeTimeout of new protocol
+// instances.
+var DefaultViewChangeTimeout = time.Minute
+
+// viewChange is the state of a follower watching the leader.
+type viewChange struct {
+	sync.Mutex
+	// timer fires if the leader doesn't send the challenge of the commit
+	// round in time
+	timer   *time.Timer
+	timeout time.Duration
+	// msg, data and policy of the round, known once the announcement
+	// arrived
+	msg    []byte
+	data   []byte
+	policy *Policy
+	// votes holds the message of every follower asking for a view change,
+	// indexed by its position in the roster
+	votes map[int][]byte
+	// voted is true once we asked for a view change ourselves
+	voted bool
+	// done is true once the leader finished its part or the view change
+	// took place
+	done bool
+}
+
+// RegisterOnViewChange registers a callback that is called on the new leader
+// with the protocol instance of the new round, before it is started. It can
+// be used to register the callbacks of the new round.
+func (bft *ProtocolBFTCoSi) RegisterOnViewChange(fn func(*ProtocolBFTCoSi)) {
+	bft.onViewChange = fn
+}
+
+// startViewChangeTimer is called by a follower when the announcement of
+// the leader arrives.
+func (bft *ProtocolBFTCoSi) startViewChangeTimer(timeout time.Duration) {
+	vc := &bft.viewChange
+	vc.Lock()
+	defer vc.Unlock()
+	if timeout <= 0 || vc.timer != nil || vc.done {
+		return
+	}
+	vc.timeout = timeout
+	vc.timer = time.AfterFunc(timeout, bft.leaderTimeout)
+}
+
+// setViewChangeMsg remembers the message of the round, so that it can be
+// signed again after a view change.
+func (bft *ProtocolBFTCoSi) setViewChangeMsg(msg, data []byte, policy *Policy) {
+	bft.viewChange.Lock()
+	bft.viewChange.msg = msg
+	bft.viewChange.data = data
+	bft.viewChange.policy = policy
+	bft.viewChange.Unlock()
+}
+
+// stopViewChangeTimer is called once the leader sent the challenge of the
+// commit round or the protocol shuts down.
+func (bft *ProtocolBFTCoSi) stopViewChangeTimer() {
+	vc := &bft.viewChange
+	vc.Lock()
+	defer vc.Unlock()
+	if vc.timer != nil {
+		vc.timer.Stop()
+	}
+	vc.done = true
+}
+
+// leaderTimeout is called if the leader didn't send the challenge of the
+// commit round in time. We ask the other followers for a view change.
+func (bft *ProtocolBFTCoSi) leaderTimeout() {
+	vc := &bft.viewChange
+	vc.Lock()
+	if vc.done {
+		vc.Unlock()
+		return
+	}
+	if vc.msg == nil {
+		vc.Unlock()
+		log.Lvl2(bft.Name(), "Leader went silent before sending the message - stopping")
+		bft.Done()
+		return
+	}
+	vc.voted = true
+	if vc.votes == nil {
+		vc.votes = make(map[int][]byte)
+	}
+	vc.votes[bft.TreeNode().RosterIndex] = vc.msg
+	msg := vc.msg
+	vc.Unlock()
+
+	log.Lvl2(bft.Name(), "Leader", bft.Root().ServerIdentity, "is silent - asking for a view change")
+	if err := bft.Multicast(&ViewChange{Msg: msg}, bft.followers()...); err != nil {
+		log.Lvl2(bft.Name(), "Couldn't reach all followers:", err)
+	}
+	bft.checkViewChange()
+}
+
+// handleViewChange stores the vote of another follower.
+func (bft *ProtocolBFTCoSi) handleViewChange(msg viewChangeChan) error {
+	vc := &bft.viewChange
+	vc.Lock()
+	if vc.votes == nil {
+		vc.votes = make(map[int][]byte)
+	}
+	vc.votes[msg.TreeNode.RosterIndex] = msg.Msg
+	vc.Unlock()
+	bft.checkViewChange()
+	return nil
+}
+
+// checkViewChange stops the round once we and more than two thirds of the
+// followers asked for a view change on the same message. The next leader
+// starts a new round.
+func (bft *ProtocolBFTCoSi) checkViewChange() {
+	vc := &bft.viewChange
+	vc.Lock()
+	if vc.done || !vc.voted {
+		vc.Unlock()
+		return
+	}
+	votes := 0
+	for _, m := range vc.votes {
+		if bytes.Equal(m, vc.msg) {
+			votes++
+		}
+	}
+	if 3*votes <= 2*len(bft.followers())+2 {
+		vc.Unlock()
+		return
+	}
+	vc.done = true
+	msg, data, policy, timeout := vc.msg, vc.data, vc.policy, vc.timeout
+	vc.Unlock()
+
+	if bft.nextLeader().RosterIndex == bft.TreeNode().RosterIndex {
+		if err := bft.startNewView(msg, data, policy, timeout); err != nil {
+			log.Error(bft.Name(), "Couldn't start new round:", err)
+		}
+	}
+	bft.Done()
+}
+
+// startNewView starts a new round on msg with us as the leader.
+func (bft *ProtocolBFTCoSi) startNewView(msg, data []byte, policy *Policy,
+	timeout time.Duration) error {
+	log.Lvl2(bft.Name(), "Starting new round as leader")
+	pi, err := bft.CreateProtocol(bft.ProtocolName(), bft.nextTree())
+	if err != nil {
+		return err
+	}
+	next, ok := pi.(*ProtocolBFTCoSi)
+	if !ok {
+		return errors.New("New protocol is not a BFTCoSi")
+	}
+	next.Msg = msg
+	next.Data = data
+	next.Policy = policy
+	next.ViewChangeTimeout = timeout
+	if bft.onViewChange != nil {
+		bft.onViewChange(next)
+	}
+	return next.Start()
+}
+
+// followers returns all nodes of the tree except the leader and us.
+func (bft *ProtocolBFTCoSi) followers() []*onet.TreeNode {
+	var tns []*onet.TreeNode
+	for _, tn := range bft.Tree().List() {
+		if tn.RosterIndex != bft.Root().RosterIndex &&
+			tn.RosterIndex != bft.TreeNode().RosterIndex {
+			tns = append(tns, tn)
+		}
+	}
+	return tns
+}
+
+// nextLeader returns the node of the tree that follows the leader in the
+// order of the roster.
+func (bft *ProtocolBFTCoSi) nextLeader() *onet.TreeNode {
+	n := len(bft.Roster().List)
+	var next *onet.TreeNode
+	for _, tn := range bft.Tree().List() {
+		dist := (tn.RosterIndex - bft.Root().RosterIndex + n) % n
+		if dist > 0 && (next == nil ||
+			dist < (next.RosterIndex-bft.Root().RosterIndex+n)%n) {
+			next = tn
+		}
+	}
+	return next
+}
+
+// nextTree returns a binary tree of all nodes except the leader, with the
+// next leader as root.
+func (bft *ProtocolBFTCoSi) nextTree() *onet.Tree {
+	return bft.binaryTree(bft.nextLeader(), func(tn *onet.TreeNode) bool {
+		return tn.RosterIndex == bft.Root().RosterIndex
+	})
+}
@@ -0,0 +1,201 @@
+/*
+Package bls implements BLS signatures on the pairing-friendly curve BN256,
+using the pure-Go implementation of golang.org/x/crypto/bn256.
+
+Signatures are points on G1 and public keys points on G2. Signatures of
+many signers on the same message aggregate into a single signature of 64
+bytes, which is verified against the sum of their public keys with one
+pairing check. Because the public keys are simply added, an attacker could
+choose its key depending on the keys of the others and forge an aggregate
+signature. Every public key that is aggregated therefore has to come with a
+proof of possession of its private key, see ProvePossession.
+*/
+package bls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/bn256"
+)
+
+// SignatureSize is the size of a marshalled signature.
+const SignatureSize = 64
+
+// PublicSize is the size of a marshalled public key.
+const PublicSize = 128
+
+// Domains of the hash onto G1, so that a signature on a message can't be
+// taken for a proof of possession and vice versa.
+var (
+	domainSignature  = []byte("BLSSignature")
+	domainPossession = []byte("BLSPossession")
+)
+
+// p is the prime of the base field of BN256.
+var p, _ = new(big.Int).SetString("65000549695646603732796438742359905742825358107623003571877145026864184071783", 10)
+
+// KeyPair holds the private and the public key of a signer.
+type KeyPair struct {
+	Private *big.Int
+	Public  *bn256.G2
+}
+
+// NewKeyPair returns a new random key pair.
+func NewKeyPair(random io.Reader) (*KeyPair, error) {
+	x, pub, err := bn256.RandomG2(random)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Private: x, Public: pub}, nil
+}
+
+// NewKeyPairFromSeed derives a key pair from seed. The same seed always
+// returns the same key pair, so a node can derive its BLS keys from a
+// secret it already has, like its private key.
+func NewKeyPairFromSeed(seed []byte) *KeyPair {
+	h := sha512.New()
+	h.Write([]byte("BLSKeyPair"))
+	h.Write(seed)
+	// reduce into [1, Order-1], so that the private key is never 0
+	x := new(big.Int).SetBytes(h.Sum(nil))
+	x.Mod(x, new(big.Int).Sub(bn256.Order, big.NewInt(1)))
+	x.Add(x, big.NewInt(1))
+	return &KeyPair{Private: x, Public: new(bn256.G2).ScalarBaseMult(x)}
+}
+
+// PublicBytes returns the marshalled public key.
+func (kp *KeyPair) PublicBytes() []byte {
+	return kp.Public.Marshal()
+}
+
+// Sign returns the signature on msg.
+func (kp *KeyPair) Sign(msg []byte) []byte {
+	return kp.sign(domainSignature, msg)
+}
+
+// ProvePossession returns a proof that we know the private key of our
+// public key. Verifiers of aggregate signatures must only use public keys
+// whose proof has been checked with VerifyPossession.
+func (kp *KeyPair) ProvePossession() []byte {
+	return kp.sign(domainPossession, kp.PublicBytes())
+}
+
+func (kp *KeyPair) sign(domain, msg []byte) []byte {
+	return new(bn256.G1).ScalarMult(hashToG1(domain, msg), kp.Private).Marshal()
+}
+
+// Verify checks the signature of public on msg. For aggregate signatures
+// public is the aggregate of the public keys of the signers, see
+// AggregatePublics.
+func Verify(public, msg, sig []byte) error {
+	return verify(domainSignature, public, msg, sig)
+}
+
+// VerifyPossession checks the proof of possession of public.
+func VerifyPossession(public, proof []byte) error {
+	return verify(domainPossession, public, public, proof)
+}
+
+// verify checks e(sig, g2) == e(H(msg), public).
+func verify(domain, public, msg, sig []byte) error {
+	pub, ok := new(bn256.G2).Unmarshal(public)
+	if !ok {
+		return errors.New("Invalid public key")
+	}
+	s, ok := new(bn256.G1).Unmarshal(sig)
+	if !ok {
+		return errors.New("Invalid signature")
+	}
+	g2 := new(bn256.G2).ScalarBaseMult(big.NewInt(1))
+	left := bn256.Pair(s, g2).Marshal()
+	right := bn256.Pair(hashToG1(domain, msg), pub).Marshal()
+	if !bytes.Equal(left, right) {
+		return errors.New("Signature doesn't verify")
+	}
+	return nil
+}
+
+// AggregateSignatures returns the aggregate of sigs, which verifies against
+// the aggregate of the public keys of the signers.
+func AggregateSignatures(sigs ...[]byte) ([]byte, error) {
+	if len(sigs) == 0 {
+		return nil, errors.New("No signatures to aggregate")
+	}
+	var agg *bn256.G1
+	for _, sig := range sigs {
+		s, ok := new(bn256.G1).Unmarshal(sig)
+		if !ok {
+			return nil, errors.New("Invalid signature")
+		}
+		if agg == nil {
+			agg = s
+		} else {
+			agg = new(bn256.G1).Add(agg, s)
+		}
+	}
+	return agg.Marshal(), nil
+}
+
+// AggregatePublics returns the aggregate of publics.
+func AggregatePublics(publics ...[]byte) ([]byte, error) {
+	if len(publics) == 0 {
+		return nil, errors.New("No public keys to aggregate")
+	}
+	var agg *bn256.G2
+	for _, public := range publics {
+		pub, ok := new(bn256.G2).Unmarshal(public)
+		if !ok {
+			return nil, errors.New("Invalid public key")
+		}
+		if agg == nil {
+			agg = pub
+		} else {
+			agg = new(bn256.G2).Add(agg, pub)
+		}
+	}
+	return agg.Marshal(), nil
+}
+
+// VerifyAggregate checks the aggregate signature of the signers with the
+// public keys publics on msg.
+func VerifyAggregate(publics [][]byte, msg, sig []byte) error {
+	agg, err := AggregatePublics(publics...)
+	if err != nil {
+		return err
+	}
+	return Verify(agg, msg, sig)
+}
+
+// hashToG1 maps msg onto a point of G1 whose discrete logarithm is unknown,
+// by trying x = H(domain, counter, msg) until x^3 + 3 is a square. As G1 has
+// a cofactor of 1, every point of the curve is part of it.
+func hashToG1(domain, msg []byte) *bn256.G1 {
+	three := big.NewInt(3)
+	for counter := uint32(0); ; counter++ {
+		h := sha256.New()
+		h.Write(domain)
+		binary.Write(h, binary.BigEndian, counter)
+		h.Write(msg)
+		x := new(big.Int).SetBytes(h.Sum(nil))
+		x.Mod(x, p)
+		rhs := new(big.Int).Exp(x, three, p)
+		rhs.Add(rhs, three).Mod(rhs, p)
+		y := new(big.Int).ModSqrt(rhs, p)
+		if y == nil {
+			continue
+		}
+		buf := make([]byte, 64)
+		xb, yb := x.Bytes(), y.Bytes()
+		copy(buf[32-len(xb):32], xb)
+		copy(buf[64-len(yb):], yb)
+		if pt, ok := new(bn256.G1).Unmarshal(buf); ok {
+			return pt
+		}
+	}
+}
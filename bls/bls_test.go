@@ -0,0 +1,72 @@
+package bls
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignVerify(t *testing.T) {
+	kp, err := NewKeyPair(rand.Reader)
+	require.Nil(t, err)
+	msg := []byte("Hello BLS")
+	sig := kp.Sign(msg)
+	assert.Equal(t, SignatureSize, len(sig))
+	assert.Equal(t, PublicSize, len(kp.PublicBytes()))
+	assert.Nil(t, Verify(kp.PublicBytes(), msg, sig))
+	assert.NotNil(t, Verify(kp.PublicBytes(), []byte("Hello CoSi"), sig))
+
+	other, err := NewKeyPair(rand.Reader)
+	require.Nil(t, err)
+	assert.NotNil(t, Verify(other.PublicBytes(), msg, sig))
+	assert.NotNil(t, Verify(kp.PublicBytes(), msg, sig[1:]))
+}
+
+func TestAggregate(t *testing.T) {
+	msg := []byte("Hello BLS")
+	var publics, sigs [][]byte
+	for i := 0; i < 5; i++ {
+		kp, err := NewKeyPair(rand.Reader)
+		require.Nil(t, err)
+		publics = append(publics, kp.PublicBytes())
+		sigs = append(sigs, kp.Sign(msg))
+	}
+	agg, err := AggregateSignatures(sigs...)
+	require.Nil(t, err)
+	assert.Equal(t, SignatureSize, len(agg))
+	assert.Nil(t, VerifyAggregate(publics, msg, agg))
+	assert.NotNil(t, VerifyAggregate(publics[1:], msg, agg))
+
+	// aggregates can be aggregated again, like in a tree
+	left, err := AggregateSignatures(sigs[:2]...)
+	require.Nil(t, err)
+	right, err := AggregateSignatures(sigs[2:]...)
+	require.Nil(t, err)
+	agg2, err := AggregateSignatures(left, right)
+	require.Nil(t, err)
+	assert.Equal(t, agg, agg2)
+
+	_, err = AggregateSignatures()
+	assert.NotNil(t, err)
+}
+
+func TestPossession(t *testing.T) {
+	kp, err := NewKeyPair(rand.Reader)
+	require.Nil(t, err)
+	proof := kp.ProvePossession()
+	assert.Nil(t, VerifyPossession(kp.PublicBytes(), proof))
+	// a proof is not a signature on the public key
+	assert.NotNil(t, Verify(kp.PublicBytes(), kp.PublicBytes(), proof))
+	assert.NotNil(t, VerifyPossession(kp.PublicBytes(), kp.Sign(kp.PublicBytes())))
+}
+
+func TestNewKeyPairFromSeed(t *testing.T) {
+	kp1 := NewKeyPairFromSeed([]byte("seed"))
+	kp2 := NewKeyPairFromSeed([]byte("seed"))
+	kp3 := NewKeyPairFromSeed([]byte("other seed"))
+	assert.Equal(t, kp1.PublicBytes(), kp2.PublicBytes())
+	assert.NotEqual(t, kp1.PublicBytes(), kp3.PublicBytes())
+	assert.Nil(t, Verify(kp1.PublicBytes(), []byte("msg"), kp2.Sign([]byte("msg"))))
+}
@@ -65,6 +65,9 @@ func NewDebianUpdate(context *onet.Context) onet.Service {
 		},
 		ReasonableTime: time.Hour,
 	}
+	// A release holds the whole repository, so only its hash goes into
+	// the SkipBlocks.
+	service.skipchain.PayloadThreshold = 1
 
 	err := service.RegisterHandlers(service.CreateRepository,
 		service.UpdateRepository, service.LatestBlocks,
@@ -3,7 +3,10 @@ package skipchain
 import (
 	"bytes"
 	"errors"
+	"io"
+	"time"
 
+	"github.com/dedis/paper_chainiac/bftcosi"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
 	"gopkg.in/dedis/onet.v1/network"
@@ -16,6 +19,34 @@ import (
 // service from the outside
 type Client struct {
 	*onet.Client
+	// MaxExceptions is the acceptance policy used for new SkipChains. The
+	// default of 0 needs all members of the roster to sign.
+	MaxExceptions int
+	// ProposeRetries is how many times a proposal is repeated on the
+	// newest block if another block has been added to the SkipChain in
+	// the meantime. The default of 0 returns ErrorStaleLatest instead.
+	ProposeRetries int
+	// PayloadThreshold is the size in bytes above which the data of a new
+	// SkipBlock is stored in the blob store of the conodes and only its
+	// hash is put in the SkipBlock. The default of 0 always stores the
+	// data in the SkipBlock.
+	PayloadThreshold int
+	// HashAlgorithm is the hash function used for new SkipChains.
+	HashAlgorithm HashAlgorithm
+	// SignTimeout is how long the conodes wait for the signature of a
+	// roster of new SkipChains. The default of 0 uses DefaultSignTimeout.
+	SignTimeout time.Duration
+	// ProposeTimeout is how long a proposal may wait for the signature of
+	// the roster. The default of 0 uses the timeout of the SkipChain.
+	ProposeTimeout time.Duration
+	// CancelSecret allows to cancel the proposals of this client with
+	// CancelProposal. Only who knows it can cancel them. The default of
+	// nil makes the proposals impossible to cancel.
+	CancelSecret []byte
+	// SignatureScheme is how the rosters of new SkipChains sign. With
+	// bftcosi.SchemeBLS the BLS keys of the members are fetched and put in
+	// the blocks that change the roster.
+	SignatureScheme bftcosi.Scheme
 }
 
 // NewClient instantiates a new client with name 'n'
@@ -56,6 +87,12 @@ func (c *Client) CreateRoster(el *onet.Roster, baseH, maxH int, ver VerifierID,
 	genesis.MaximumHeight = maxH
 	genesis.BaseHeight = baseH
 	genesis.ParentBlockID = parent
+	genesis.MaxExceptions = c.MaxExceptions
+	genesis.HashAlgorithm = c.HashAlgorithm
+	genesis.SignTimeout = int64(c.SignTimeout / time.Millisecond)
+	if err := c.setScheme(genesis.SkipBlockFix, c.SignatureScheme); err != nil {
+		return nil, err
+	}
 	sb, err := c.proposeSkipBlock(genesis, nil, nil)
 	if err != nil {
 		return nil, err
@@ -78,6 +115,12 @@ func (c *Client) CreateData(parent *SkipBlock, baseH, maxH int, ver VerifierID,
 	data.VerifierID = ver
 	data.ParentBlockID = parent.Hash
 	data.Roster = parent.Roster
+	data.MaxExceptions = c.MaxExceptions
+	data.HashAlgorithm = c.HashAlgorithm
+	data.SignTimeout = int64(c.SignTimeout / time.Millisecond)
+	if err := c.setScheme(data.SkipBlockFix, c.SignatureScheme); err != nil {
+		return nil, nil, err
+	}
 	dataMsg, err := c.proposeSkipBlock(data, nil, d)
 	if err != nil {
 		return nil, nil, err
@@ -87,9 +130,9 @@ func (c *Client) CreateData(parent *SkipBlock, baseH, maxH int, ver VerifierID,
 	return c.LinkParentChildBlock(parent, data)
 }
 
-// LinkParentChildBlock sends a request to create a link from the parent to the
-// child block and inversely. The child-block is supposed to already have
-// the parentBlockID set and be accepted.
+// LinkParentChildBlock asks the roster of the parent to sign a link to the
+// child block. The child-block has to be a genesis-block created with the
+// parentBlockID set to the parent.
 func (c *Client) LinkParentChildBlock(parent, child *SkipBlock) (*SkipBlock, *SkipBlock, error) {
 	if err := child.VerifySignatures(); err != nil {
 		return nil, nil, err
@@ -97,11 +140,19 @@ func (c *Client) LinkParentChildBlock(parent, child *SkipBlock) (*SkipBlock, *Sk
 	if !bytes.Equal(parent.Hash, child.ParentBlockID) {
 		return nil, nil, errors.New("Child doesn't point to that parent")
 	}
-	host := parent.Roster.RandomServerIdentity()
+	// Like proposals, links are signed by the first member of the roster
+	// that is up
 	reply := &SetChildrenSkipBlockReply{}
-	cerr := c.SendProtobuf(host, &SetChildrenSkipBlock{parent.Hash, child.Hash}, reply)
-	if cerr != nil {
-		return nil, nil, cerr
+	err := c.sendToLeader(parent.Roster, &SetChildrenSkipBlock{parent.Hash, child.Hash},
+		reply, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !reply.Parent.Hash.Equal(parent.Hash) || !reply.Child.Hash.Equal(child.Hash) {
+		return nil, nil, errors.New("Got wrong blocks")
+	}
+	if err := VerifyChildLink(reply.Parent, reply.Child); err != nil {
+		return nil, nil, err
 	}
 	return reply.Parent, reply.Child, nil
 }
@@ -115,6 +166,403 @@ func (c *Client) GetUpdateChain(parent *SkipBlock, latest SkipBlockID) (reply *G
 	return
 }
 
+// ListVerifiers returns the verifiers registered on the conode si.
+func (c *Client) ListVerifiers(si *network.ServerIdentity) ([]*VerifierInfo, error) {
+	reply := &ListVerifiersReply{}
+	cerr := c.SendProtobuf(si, &ListVerifiers{}, reply)
+	if cerr != nil {
+		return nil, cerr
+	}
+	return reply.Verifiers, nil
+}
+
+// ListChains returns all SkipChains held by the conode si.
+func (c *Client) ListChains(si *network.ServerIdentity) ([]*ChainInfo, error) {
+	reply := &ListChainsReply{}
+	cerr := c.SendProtobuf(si, &ListChains{}, reply)
+	if cerr != nil {
+		return nil, cerr
+	}
+	return reply.Chains, nil
+}
+
+// GetBlockByIndex returns the block with the given index of the SkipChain
+// starting at genesis. The path from genesis to the block is verified.
+func (c *Client) GetBlockByIndex(genesis *SkipBlock, index int) (*SkipBlock, error) {
+	reply := &GetBlockByIndexReply{}
+	cerr := c.SendProtobuf(genesis.Roster.RandomServerIdentity(),
+		&GetBlockByIndex{genesis.Hash, index}, reply)
+	if cerr != nil {
+		return nil, cerr
+	}
+	sb, err := verifyProof(genesis, reply.Proof)
+	if err != nil {
+		return nil, err
+	}
+	if sb.Index != index {
+		return nil, errors.New("Got block with wrong index")
+	}
+	return sb, nil
+}
+
+// GetBlockAtTime returns the latest block of the SkipChain starting at
+// genesis that has been proposed at or before t. The path from genesis to
+// the block and the following block, if any, are verified.
+func (c *Client) GetBlockAtTime(genesis *SkipBlock, t time.Time) (*SkipBlock, error) {
+	reply := &GetBlockAtTimeReply{}
+	cerr := c.SendProtobuf(genesis.Roster.RandomServerIdentity(),
+		&GetBlockAtTime{genesis.Hash, t.UnixNano()}, reply)
+	if cerr != nil {
+		return nil, cerr
+	}
+	if len(reply.Proof) == 0 {
+		return nil, errors.New("Got empty proof")
+	}
+	sb := reply.Proof[len(reply.Proof)-1]
+	chain := reply.Proof
+	if reply.Next != nil {
+		if reply.Next.Index != sb.Index+1 ||
+			reply.Next.Timestamp <= t.UnixNano() {
+			return nil, errors.New("Next block doesn't prove that the block is the latest")
+		}
+		chain = append(chain, reply.Next)
+	}
+	if err := VerifyChain(genesis, chain); err != nil {
+		return nil, err
+	}
+	if sb.Timestamp > t.UnixNano() {
+		return nil, errors.New("Got block newer than requested time")
+	}
+	return sb, nil
+}
+
+// GetProof returns the verified shortest chain of SkipBlocks from the
+// trusted block from to the newer block to.
+func (c *Client) GetProof(from *SkipBlock, to SkipBlockID) ([]*SkipBlock, error) {
+	reply := &GetProofReply{}
+	cerr := c.SendProtobuf(from.Roster.RandomServerIdentity(),
+		&GetProof{from.Hash, to}, reply)
+	if cerr != nil {
+		return nil, cerr
+	}
+	sb, err := verifyProof(from, reply.Proof)
+	if err != nil {
+		return nil, err
+	}
+	if !sb.Hash.Equal(to) {
+		return nil, errors.New("Proof doesn't end in the requested block")
+	}
+	return reply.Proof, nil
+}
+
+// GetChildren returns the genesis-blocks of all SkipChains that have parent
+// as parent.
+func (c *Client) GetChildren(parent *SkipBlock) ([]*SkipBlock, error) {
+	reply := &GetChildrenSkipListReply{}
+	cerr := c.SendProtobuf(parent.Roster.RandomServerIdentity(),
+		&GetChildrenSkipList{parent.Hash}, reply)
+	if cerr != nil {
+		return nil, cerr
+	}
+	return reply.Children, nil
+}
+
+// GetForkProofs returns the proofs of the forks the conode si detected in
+// the SkipChain starting at genesis, or in all SkipChains if genesis is nil.
+// Proofs that don't verify are dropped.
+func (c *Client) GetForkProofs(si *network.ServerIdentity, genesis SkipBlockID) ([]*ForkProof, error) {
+	reply := &GetForkProofsReply{}
+	cerr := c.SendProtobuf(si, &GetForkProofs{genesis}, reply)
+	if cerr != nil {
+		return nil, cerr
+	}
+	var proofs []*ForkProof
+	for _, fp := range reply.Proofs {
+		if err := fp.Verify(); err != nil {
+			log.Warn("Got invalid fork proof:", err)
+			continue
+		}
+		proofs = append(proofs, fp)
+	}
+	return proofs, nil
+}
+
+// ExportChain fetches all blocks of the SkipChain starting at genesis and
+// their payloads from the conode si, verifies them and writes them as an
+// archive to w.
+func (c *Client) ExportChain(si *network.ServerIdentity, genesis SkipBlockID, w io.Writer) error {
+	var blocks []*SkipBlock
+	start := genesis
+	for {
+		reply := &GetBlocksReply{}
+		cerr := c.SendProtobuf(si, &GetBlocks{Start: start}, reply)
+		if cerr != nil {
+			return cerr
+		}
+		if len(blocks) > 0 && len(reply.Blocks) > 0 {
+			// The start block is returned again
+			reply.Blocks = reply.Blocks[1:]
+		}
+		if len(reply.Blocks) == 0 {
+			break
+		}
+		blocks = append(blocks, reply.Blocks...)
+		last := blocks[len(blocks)-1]
+		if len(last.ForwardLink) == 0 {
+			break
+		}
+		start = last.Hash
+	}
+	if len(blocks) == 0 {
+		return errors.New("Didn't get any blocks")
+	}
+	payloads, err := archivePayloads(blocks, func(sb *SkipBlock) ([]byte, error) {
+		return c.GetBlob(si, sb.PayloadHash)
+	})
+	if err != nil {
+		return err
+	}
+	if err := VerifyArchive(newArchiveManifest(blocks, payloads), blocks, payloads); err != nil {
+		return err
+	}
+	return WriteArchive(w, blocks, payloads)
+}
+
+// Subscribe sends every new block of the SkipChains of the latest blocks to
+// the channel blocks, in order, until stop is closed. All blocks are
+// verified starting from latest. After an error, Subscribe can be called
+// again with the last block received of every SkipChain, so that no block
+// is missed. It can take up to SubscribeWait to return once stop is closed.
+func (c *Client) Subscribe(si *network.ServerIdentity, latest []*SkipBlock,
+	blocks chan<- *SkipBlock, stop <-chan struct{}) error {
+	latest = append([]*SkipBlock{}, latest...)
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		req := &Subscribe{}
+		for _, sb := range latest {
+			req.Latest = append(req.Latest, sb.Hash)
+		}
+		reply := &SubscribeReply{}
+		if cerr := c.SendProtobuf(si, req, reply); cerr != nil {
+			return cerr
+		}
+		for _, u := range reply.Updates {
+			i := 0
+			for i < len(latest) && (len(u.Blocks) == 0 ||
+				!latest[i].Hash.Equal(u.Blocks[0].Hash)) {
+				i++
+			}
+			if i == len(latest) {
+				return errors.New("Got update for unknown SkipChain")
+			}
+			if err := VerifyChain(latest[i], u.Blocks); err != nil {
+				return err
+			}
+			for _, sb := range u.Blocks[1:] {
+				select {
+				case blocks <- sb:
+				case <-stop:
+					return nil
+				}
+				latest[i] = sb
+			}
+		}
+	}
+}
+
+// GetCheckpoint returns the latest checkpoint of the SkipChain starting at
+// genesis from the conode si. trusted is a block of the SkipChain the
+// caller already trusts: the genesis block or the first block returned by
+// Bootstrap for a trusted checkpoint. The checkpoint is only returned if
+// the chain from trusted to the block of the checkpoint verifies and the
+// checkpoint matches that block.
+func (c *Client) GetCheckpoint(si *network.ServerIdentity, genesis SkipBlockID,
+	trusted *SkipBlock) (*Checkpoint, error) {
+	if trusted.Index == 0 && !trusted.Hash.Equal(genesis) {
+		return nil, errors.New("Trusted block is not the genesis block")
+	}
+	reply := &GetCheckpointReply{}
+	cerr := c.SendProtobuf(si, &GetCheckpoint{genesis}, reply)
+	if cerr != nil {
+		return nil, cerr
+	}
+	cp := reply.Checkpoint
+	if cp == nil || !cp.Genesis.Equal(genesis) {
+		return nil, errors.New("Got checkpoint of wrong SkipChain")
+	}
+	if cp.Index < trusted.Index {
+		return nil, errors.New("Checkpoint is older than the trusted block")
+	}
+	sb := trusted
+	if !cp.Block.Equal(trusted.Hash) {
+		proof, err := c.GetProof(trusted, cp.Block)
+		if err != nil {
+			return nil, err
+		}
+		sb = proof[len(proof)-1]
+	}
+	if err := cp.matches(sb); err != nil {
+		return nil, err
+	}
+	if err := cp.Verify(); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// Bootstrap follows the SkipChain starting at the trusted checkpoint, like
+// one shipped with a device, instead of the genesis block. It returns the
+// verified blocks from the block of the checkpoint up to the latest block.
+func (c *Client) Bootstrap(trusted *Checkpoint) ([]*SkipBlock, error) {
+	if trusted.Roster == nil {
+		return nil, errors.New("Checkpoint has no roster")
+	}
+	reply := &GetUpdateChainReply{}
+	cerr := c.SendProtobuf(trusted.Roster.RandomServerIdentity(),
+		&GetUpdateChain{trusted.Block}, reply)
+	if cerr != nil {
+		return nil, cerr
+	}
+	if len(reply.Update) == 0 {
+		return nil, errors.New("Got empty update-chain")
+	}
+	// The hash of the first block commits to everything we need to
+	// follow the SkipChain, so it replaces the genesis block.
+	first := reply.Update[0]
+	if !first.Hash.Equal(trusted.Block) || first.Index != trusted.Index {
+		return nil, errors.New("Update doesn't start at the checkpoint")
+	}
+	if err := VerifyChain(first, reply.Update); err != nil {
+		return nil, err
+	}
+	return reply.Update, nil
+}
+
+// CancelProposal stops the proposal of a block after latest that this
+// client made with its CancelSecret. All members of the roster are asked
+// to cancel it and their results are returned in the order of the roster,
+// nil for the ones that cancelled it. The error is set if none of them
+// cancelled it.
+func (c *Client) CancelProposal(latest *SkipBlock) ([]error, error) {
+	if latest.Roster == nil {
+		return nil, errors.New("Latest block has no roster")
+	}
+	if c.CancelSecret == nil {
+		return nil, errors.New("Client has no secret to cancel proposals")
+	}
+	errs := make([]error, len(latest.Roster.List))
+	cancelled := false
+	for i, si := range latest.Roster.List {
+		cerr := c.SendProtobuf(si, &CancelProposal{latest.Hash, c.CancelSecret},
+			&CancelProposalReply{})
+		if cerr != nil {
+			errs[i] = cerr
+			continue
+		}
+		cancelled = true
+	}
+	if !cancelled {
+		return errs, errors.New("No proposal has been cancelled")
+	}
+	return errs, nil
+}
+
+// GetStoreStats returns the number of SkipBlocks stored on the conode si
+// and the metrics of its cache.
+func (c *Client) GetStoreStats(si *network.ServerIdentity) (*GetStoreStatsReply, error) {
+	reply := &GetStoreStatsReply{}
+	cerr := c.SendProtobuf(si, &GetStoreStats{}, reply)
+	if cerr != nil {
+		return nil, cerr
+	}
+	return reply, nil
+}
+
+// PutBlob stores the payload in the blob store of the conode si and returns
+// its hash.
+func (c *Client) PutBlob(si *network.ServerIdentity, payload []byte) ([]byte, error) {
+	reply := &PutBlobReply{}
+	cerr := c.SendProtobuf(si, &PutBlob{payload}, reply)
+	if cerr != nil {
+		return nil, cerr
+	}
+	if !SkipBlockID(reply.Hash).Equal(HashPayload(payload)) {
+		return nil, errors.New("Got wrong hash of payload")
+	}
+	return reply.Hash, nil
+}
+
+// GetBlob fetches the payload with the given hash from the conode si and
+// checks that it matches the hash.
+func (c *Client) GetBlob(si *network.ServerIdentity, hash []byte) ([]byte, error) {
+	reply := &GetBlobReply{}
+	cerr := c.SendProtobuf(si, &GetBlob{hash}, reply)
+	if cerr != nil {
+		return nil, cerr
+	}
+	if !SkipBlockID(HashPayload(reply.Blob)).Equal(hash) {
+		return nil, errors.New("Got wrong payload")
+	}
+	return reply.Blob, nil
+}
+
+// GetPayload returns the data of the SkipBlock. If the block only holds
+// the hash of its payload, the payload is fetched from the members of the
+// roster of the block. The block itself has to be verified by the caller.
+func (c *Client) GetPayload(sb *SkipBlock) ([]byte, error) {
+	if len(sb.PayloadHash) == 0 {
+		return sb.Data, nil
+	}
+	if sb.Roster == nil {
+		return nil, errors.New("Block has no roster")
+	}
+	for _, si := range sb.Roster.List {
+		blob, err := c.GetBlob(si, sb.PayloadHash)
+		if err == nil {
+			return blob, nil
+		}
+		log.Lvl2("Couldn't get payload from", si, ":", err)
+	}
+	return nil, errors.New("No member of the roster has the payload")
+}
+
+// GetBLSKeys asks every member of the roster for its BLS key and checks its
+// proof of possession. The keys are returned in the order of the roster.
+func (c *Client) GetBLSKeys(roster *onet.Roster) ([]*BLSKey, error) {
+	keys := make([]*BLSKey, len(roster.List))
+	for i, si := range roster.List {
+		reply := &GetBLSKeyReply{}
+		cerr := c.SendProtobuf(si, &GetBLSKey{}, reply)
+		if cerr != nil {
+			return nil, cerr
+		}
+		if reply.Key == nil || reply.Key.Verify() != nil {
+			return nil, errors.New("Invalid BLS key of " + si.String())
+		}
+		keys[i] = reply.Key
+	}
+	return keys, nil
+}
+
+// setScheme sets the signature scheme of the block and, for
+// bftcosi.SchemeBLS, the BLS keys of its roster.
+func (c *Client) setScheme(sbf *SkipBlockFix, scheme bftcosi.Scheme) error {
+	sbf.SignatureScheme = scheme
+	if scheme != bftcosi.SchemeBLS {
+		return nil
+	}
+	keys, err := c.GetBLSKeys(sbf.Roster)
+	if err != nil {
+		return err
+	}
+	sbf.BLSKeys = keys
+	return nil
+}
+
 // proposeSkipBlock sends a proposeSkipBlock to the service. If latest has
 // a Nil-Hash, it will be used as a
 // - rosterSkipBlock if data is nil, the Roster will be taken from 'el'
@@ -131,12 +579,16 @@ func (c *Client) proposeSkipBlock(latest *SkipBlock, el *onet.Roster, d network.
 		if d == nil {
 			// This is a RosterSkipBlock
 			propose.Roster = el
+			if err = c.setScheme(propose.SkipBlockFix, latest.SignatureScheme); err != nil {
+				return
+			}
 		} else {
 			// DataSkipBlock will be set later, just make sure that
 			// there will be a receiver
 			activeRoster = el
 		}
 	}
+	var payload []byte
 	if d != nil {
 		// Set either a new or a proposed SkipBlock
 		var b []byte
@@ -144,10 +596,90 @@ func (c *Client) proposeSkipBlock(latest *SkipBlock, el *onet.Roster, d network.
 		if err != nil {
 			return
 		}
+		if c.PayloadThreshold > 0 && len(b) > c.PayloadThreshold {
+			payload = b
+			propose.PayloadHash = HashPayload(b)
+			b = []byte{}
+		}
 		propose.Data = b
 	}
-	host := activeRoster.RandomServerIdentity()
-	reply = &ProposedSkipBlockReply{}
-	err = c.SendProtobuf(host, &ProposeSkipBlock{hash, propose}, reply)
-	return
+	for retry := 0; ; retry++ {
+		psb := &ProposeSkipBlock{LatestID: hash, Proposed: propose,
+			Timeout: int64(c.ProposeTimeout / time.Millisecond)}
+		if c.CancelSecret != nil {
+			psb.CancelHash = CancelHash(c.CancelSecret)
+		}
+		// All proposals go to the same leader, which serialises them,
+		// so that concurrent proposals don't fork the SkipChain.
+		reply = &ProposedSkipBlockReply{}
+		err = c.sendToLeader(activeRoster, psb, reply, payload)
+		if err == nil {
+			return reply, nil
+		}
+		cerr, ok := err.(onet.ClientError)
+		if !ok || cerr.ErrorCode() != ErrorStaleLatest || retry >= c.ProposeRetries {
+			return nil, err
+		}
+		log.Lvl2("Latest block is stale - proposing again on the newest block")
+		latest, err = c.newestBlock(latest)
+		if err != nil {
+			return nil, err
+		}
+		hash = latest.Hash
+		if d == nil {
+			activeRoster = latest.Roster
+		}
+	}
+}
+
+// sendToLeader sends msg to the first member of roster that can be reached,
+// in the order of the roster. So all clients use the same leader as long as
+// it is up, and as the conodes sign only one block following the latest
+// block, two leaders can't both get a block signed. If payload is not nil,
+// it is stored on the leader first, as the other conodes fetch it from
+// there.
+func (c *Client) sendToLeader(roster *onet.Roster, msg, reply interface{},
+	payload []byte) error {
+	err := errors.New("Roster is empty")
+	for _, host := range roster.List {
+		err = nil
+		if payload != nil {
+			_, err = c.PutBlob(host, payload)
+		}
+		if err == nil {
+			if cerr := c.SendProtobuf(host, msg, reply); cerr != nil {
+				err = cerr
+			}
+		}
+		if !unreachable(err) {
+			return err
+		}
+		log.Lvl2("Couldn't reach", host, "- trying the next member:", err)
+	}
+	return err
+}
+
+// unreachable returns whether err means that the conode couldn't be
+// reached. The skipchain service only returns error codes from 4200 on.
+func unreachable(err error) bool {
+	cerr, ok := err.(onet.ClientError)
+	return ok && (cerr.ErrorCode() < 4200 || cerr.ErrorCode() >= 4300)
+}
+
+// newestBlock returns the verified latest block of the SkipChain known
+// belongs to.
+func (c *Client) newestBlock(known *SkipBlock) (*SkipBlock, error) {
+	reply := &GetUpdateChainReply{}
+	cerr := c.SendProtobuf(known.Roster.RandomServerIdentity(),
+		&GetUpdateChain{known.Hash}, reply)
+	if cerr != nil {
+		return nil, cerr
+	}
+	if len(reply.Update) == 0 {
+		return nil, errors.New("Got empty update-chain")
+	}
+	if err := VerifyChain(known, reply.Update); err != nil {
+		return nil, err
+	}
+	return reply.Update[len(reply.Update)-1], nil
 }
@@ -162,6 +162,74 @@ func TestClient_ProposeRoster(t *testing.T) {
 	}
 }
 
+func TestClient_ProposeRetries(t *testing.T) {
+	l := onet.NewLocalTest()
+	_, el, _ := l.GenTree(3, true, true, true)
+	defer l.CloseAll()
+
+	c := NewClient()
+	root, err := c.CreateRoster(el, 2, 3, VerifyNone, nil)
+	log.ErrFatal(err)
+	_, err = c.ProposeRoster(root, el)
+	log.ErrFatal(err)
+	_, err = c.ProposeRoster(root, el)
+	if err == nil {
+		t.Fatal("Proposing on a stale block should fail")
+	}
+	if cerr, ok := err.(onet.ClientError); !ok ||
+		cerr.ErrorCode() != ErrorStaleLatest {
+		t.Fatal("Wrong error for stale block:", err)
+	}
+
+	c.ProposeRetries = 2
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.ProposeRoster(root, el)
+			log.ErrFatal(err)
+		}()
+	}
+	wg.Wait()
+	updates, err := c.GetUpdateChain(root, root.Hash)
+	log.ErrFatal(err)
+	if last := updates.Update[len(updates.Update)-1]; last.Index != 3 {
+		t.Fatal("All proposals should have been added, got index", last.Index)
+	}
+}
+
+func TestClient_SendToLeader(t *testing.T) {
+	l := onet.NewLocalTest()
+	_, el, _ := l.GenTree(3, true, true, true)
+	defer l.CloseAll()
+
+	// The first member of the roster is down, so the second one gets
+	// the request and the payload.
+	down := network.NewServerIdentity(network.Suite.Point().Null(),
+		network.NewTCPAddress("127.0.0.1:2"))
+	roster := onet.NewRoster(append([]*network.ServerIdentity{down}, el.List...))
+	c := NewClient()
+	payload := []byte("payload")
+	reply := &ListVerifiersReply{}
+	log.ErrFatal(c.sendToLeader(roster, &ListVerifiers{}, reply, payload))
+	if len(reply.Verifiers) == 0 {
+		t.Fatal("Didn't get the verifiers")
+	}
+	blob, err := c.GetBlob(el.List[0], HashPayload(payload))
+	log.ErrFatal(err)
+	if !bytes.Equal(payload, blob) {
+		t.Fatal("Payload not stored on the leader")
+	}
+
+	// Errors of the service are returned without trying the next member
+	err = c.sendToLeader(roster, &GetUpdateChain{SkipBlockID("unknown")},
+		&GetUpdateChainReply{}, nil)
+	if err == nil || unreachable(err) {
+		t.Fatal("Wrong error of the service:", err)
+	}
+}
+
 type testData struct {
 	A int
 	B string
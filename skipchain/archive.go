@@ -0,0 +1,305 @@
+package skipchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// ArchiveVersion is the version of the archive format written by
+// WriteArchive. An archive holds a whole SkipChain, so that it can be moved
+// to another deployment or given to an auditor. It starts with archiveMagic
+// and the version as uint32, followed by records of
+//
+//	length uint32 | network.Marshal(message)
+//
+// The first record is the ArchiveManifest, followed by all SkipBlocks in
+// the order of their index, starting with the genesis-block, and the
+// payloads of the blocks that don't hold their data directly. Archives of
+// version 1 don't have payloads.
+const ArchiveVersion = 2
+
+var archiveMagic = []byte("SKIPARCH")
+
+// maxArchiveRecord is the maximum size of a record in an archive, which
+// has to hold the biggest payload.
+const maxArchiveRecord = 512 * 1024 * 1024
+
+// ArchiveManifest describes the SkipChain stored in an archive.
+type ArchiveManifest struct {
+	Version  int
+	Genesis  SkipBlockID
+	Latest   SkipBlockID
+	Blocks   int
+	Payloads int
+}
+
+// ArchivePayload is the payload of a SkipBlock in an archive.
+type ArchivePayload struct {
+	Blob []byte
+}
+
+// WriteArchive writes the blocks of a SkipChain and their payloads to w.
+// The blocks must start with the genesis-block and follow each other.
+func WriteArchive(w io.Writer, blocks []*SkipBlock, payloads [][]byte) error {
+	if len(blocks) == 0 || blocks[0].Index != 0 {
+		return errors.New("Archive has to start with the genesis block")
+	}
+	for i, sb := range blocks {
+		if sb.Index != i {
+			return fmt.Errorf("Block %d has index %d", i, sb.Index)
+		}
+	}
+	if _, err := w.Write(archiveMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(ArchiveVersion)); err != nil {
+		return err
+	}
+	if err := writeArchiveRecord(w, newArchiveManifest(blocks, payloads)); err != nil {
+		return err
+	}
+	for _, sb := range blocks {
+		if err := writeArchiveRecord(w, sb); err != nil {
+			return err
+		}
+	}
+	for _, p := range payloads {
+		if err := writeArchiveRecord(w, &ArchivePayload{p}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newArchiveManifest returns the manifest of the SkipChain made of blocks.
+func newArchiveManifest(blocks []*SkipBlock, payloads [][]byte) *ArchiveManifest {
+	return &ArchiveManifest{
+		Version:  ArchiveVersion,
+		Genesis:  blocks[0].Hash,
+		Latest:   blocks[len(blocks)-1].Hash,
+		Blocks:   len(blocks),
+		Payloads: len(payloads),
+	}
+}
+
+// ReadArchive reads the manifest, the blocks and the payloads from an
+// archive. It only checks the format - use VerifyArchive to check the
+// blocks.
+func ReadArchive(r io.Reader) (*ArchiveManifest, []*SkipBlock, [][]byte, error) {
+	magic := make([]byte, len(archiveMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, nil, nil, err
+	}
+	if string(magic) != string(archiveMagic) {
+		return nil, nil, nil, errors.New("Not a SkipChain archive")
+	}
+	var version uint32
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, nil, nil, err
+	}
+	if version != 1 && version != ArchiveVersion {
+		return nil, nil, nil, fmt.Errorf("Unsupported archive version %d", version)
+	}
+	msg, err := readArchiveRecord(r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	m, ok := msg.(*ArchiveManifest)
+	if !ok {
+		return nil, nil, nil, errors.New("Archive doesn't start with a manifest")
+	}
+	if m.Version != int(version) || m.Blocks <= 0 || m.Payloads < 0 {
+		return nil, nil, nil, errors.New("Invalid manifest")
+	}
+	var blocks []*SkipBlock
+	for len(blocks) < m.Blocks {
+		msg, err := readArchiveRecord(r)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		sb, ok := msg.(*SkipBlock)
+		if !ok {
+			return nil, nil, nil, errors.New("Archive holds something else than a SkipBlock")
+		}
+		blocks = append(blocks, sb)
+	}
+	var payloads [][]byte
+	for len(payloads) < m.Payloads {
+		msg, err := readArchiveRecord(r)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		p, ok := msg.(*ArchivePayload)
+		if !ok {
+			return nil, nil, nil, errors.New("Archive holds something else than a payload")
+		}
+		payloads = append(payloads, p.Blob)
+	}
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		return nil, nil, nil, errors.New("Archive has more data than announced")
+	}
+	return m, blocks, payloads, nil
+}
+
+// VerifyArchive checks that the blocks form the SkipChain described by the
+// manifest: the genesis-block is signed by its roster, every block is
+// signed by the roster responsible for it and all forward-links verify.
+// Every payload a block refers to has to be in the archive, and only those.
+func VerifyArchive(m *ArchiveManifest, blocks []*SkipBlock, payloads [][]byte) error {
+	if len(blocks) != m.Blocks || len(blocks) == 0 {
+		return errors.New("Wrong number of blocks")
+	}
+	if len(payloads) != m.Payloads {
+		return errors.New("Wrong number of payloads")
+	}
+	genesis := blocks[0]
+	if genesis.Index != 0 || !genesis.Hash.Equal(m.Genesis) ||
+		!genesis.calculateHash().Equal(genesis.Hash) {
+		return errors.New("Wrong genesis block")
+	}
+	if !blocks[len(blocks)-1].Hash.Equal(m.Latest) {
+		return errors.New("Wrong latest block")
+	}
+	if genesis.Roster == nil {
+		return errors.New("Genesis block without roster")
+	}
+	if err := verifyBlockSig(genesis, genesis.Roster); err != nil {
+		return &ChainError{Position: 0, Block: genesis.Hash, Reason: err.Error()}
+	}
+	for i, sb := range blocks {
+		if sb.Index != i {
+			return fmt.Errorf("Block %d has index %d", i, sb.Index)
+		}
+	}
+	if err := VerifyChain(genesis, blocks); err != nil {
+		return err
+	}
+	for i, sb := range blocks {
+		if err := sb.VerifySignatures(); err != nil {
+			return &ChainError{Position: i, Block: sb.Hash, Index: sb.Index,
+				Reason: err.Error()}
+		}
+	}
+	return verifyArchivePayloads(blocks, payloads)
+}
+
+// verifyArchivePayloads checks that the payloads are exactly the ones the
+// blocks refer to.
+func verifyArchivePayloads(blocks []*SkipBlock, payloads [][]byte) error {
+	have := map[string]bool{}
+	for _, p := range payloads {
+		h := string(HashPayload(p))
+		if have[h] {
+			return errors.New("Archive holds a payload twice")
+		}
+		have[h] = true
+	}
+	for i, sb := range blocks {
+		if len(sb.PayloadHash) == 0 {
+			continue
+		}
+		if !have[string(sb.PayloadHash)] {
+			return &ChainError{Position: i, Block: sb.Hash, Index: sb.Index,
+				Reason: "missing payload"}
+		}
+		delete(have, string(sb.PayloadHash))
+	}
+	if len(have) > 0 {
+		return errors.New("Archive holds payloads of no block")
+	}
+	return nil
+}
+
+// archivePayloads returns the payloads the blocks refer to, fetched with
+// get, in the order of the blocks.
+func archivePayloads(blocks []*SkipBlock, get func(sb *SkipBlock) ([]byte, error)) ([][]byte, error) {
+	var payloads [][]byte
+	seen := map[string]bool{}
+	for _, sb := range blocks {
+		if len(sb.PayloadHash) == 0 || seen[string(sb.PayloadHash)] {
+			continue
+		}
+		seen[string(sb.PayloadHash)] = true
+		p, err := get(sb)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, p)
+	}
+	return payloads, nil
+}
+
+// ImportArchive reads and verifies an archive and stores its blocks in bs
+// and its payloads in the directory payloadDir. Blocks already in bs are
+// only replaced if the archive holds more forward-links for them.
+func ImportArchive(r io.Reader, bs BlockStore, payloadDir string) (*ArchiveManifest, error) {
+	m, blocks, payloads, err := ReadArchive(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyArchive(m, blocks, payloads); err != nil {
+		return nil, err
+	}
+	blobs, err := newBlobStore(payloadDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range payloads {
+		if _, err := blobs.put(p, true); err != nil {
+			return nil, err
+		}
+	}
+	for _, sb := range blocks {
+		if local, ok := bs.GetByID(sb.Hash); ok {
+			if len(local.ForwardLink) >= len(sb.ForwardLink) {
+				continue
+			}
+			for i, fl := range local.ForwardLink {
+				if !fl.Hash.Equal(sb.ForwardLink[i].Hash) {
+					return nil, errors.New("Archive conflicts with stored block")
+				}
+			}
+		}
+		if err := bs.Store(sb); err != nil {
+			return nil, err
+		}
+	}
+	log.Lvlf2("Imported %d blocks of SkipChain %x", m.Blocks, m.Genesis)
+	return m, nil
+}
+
+// writeArchiveRecord writes the length of the marshalled message and the
+// message.
+func writeArchiveRecord(w io.Writer, msg network.Message) error {
+	buf, err := network.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(buf))); err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// readArchiveRecord reads a message written by writeArchiveRecord.
+func readArchiveRecord(r io.Reader) (network.Message, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length > maxArchiveRecord {
+		return nil, errors.New("Record too big")
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	_, msg, err := network.Unmarshal(buf)
+	return msg, err
+}
@@ -0,0 +1,133 @@
+// Command archive exports SkipChains from a running conode to an archive,
+// verifies archives offline and imports them into the block store of a
+// conode that is not running.
+//
+//	archive export group.toml genesis-id file
+//	archive verify file
+//	archive import file skipchain-dir
+//
+// skipchain-dir is the directory of the block store of the conode, which
+// is called <public key in hex>-skipchain in the data-directory of the
+// conode. The import fails while the conode is using the block store.
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/dedis/paper_chainiac/skipchain"
+	"gopkg.in/dedis/onet.v1/app"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func main() {
+	if len(os.Args) < 3 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "export":
+		if len(os.Args) != 5 {
+			usage()
+		}
+		err = export(os.Args[2], os.Args[3], os.Args[4])
+	case "verify":
+		err = verify(os.Args[2])
+	case "import":
+		if len(os.Args) != 4 {
+			usage()
+		}
+		err = importArchive(os.Args[2], os.Args[3])
+	default:
+		usage()
+	}
+	log.ErrFatal(err)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage:\n"+
+		"\tarchive export group.toml genesis-id file\n"+
+		"\tarchive verify file\n"+
+		"\tarchive import file skipchain-dir")
+	os.Exit(1)
+}
+
+// export fetches the SkipChain from the first conode of the group that
+// answers and writes it to the file.
+func export(group, genesis, file string) error {
+	id, err := hex.DecodeString(genesis)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(group)
+	if err != nil {
+		return err
+	}
+	g, err := app.ReadGroupDescToml(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	c := skipchain.NewClient()
+	for _, si := range g.Roster.List {
+		out, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		err = c.ExportChain(si, skipchain.SkipBlockID(id), out)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			log.Info("Exported SkipChain from", si)
+			return nil
+		}
+		log.Warn("Couldn't export from", si, ":", err)
+	}
+	os.Remove(file)
+	return fmt.Errorf("No conode could export the SkipChain %s", genesis)
+}
+
+// verify reads the archive and verifies all blocks and signatures.
+func verify(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	m, blocks, payloads, err := skipchain.ReadArchive(f)
+	if err != nil {
+		return err
+	}
+	if err := skipchain.VerifyArchive(m, blocks, payloads); err != nil {
+		return err
+	}
+	log.Infof("Archive of SkipChain %x with %d blocks and %d payloads is valid",
+		m.Genesis, m.Blocks, m.Payloads)
+	return nil
+}
+
+// importArchive verifies the archive and stores its blocks in the block
+// store in dir and its payloads in the payload directory below it.
+func importArchive(file, dir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fs, err := skipchain.NewFileStore(dir)
+	if err != nil {
+		return err
+	}
+	m, err := skipchain.ImportArchive(f, fs, path.Join(dir, skipchain.PayloadDir))
+	if cerr := fs.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("Imported SkipChain %x with %d blocks", m.Genesis, m.Blocks)
+	return nil
+}
@@ -0,0 +1,107 @@
+package skipchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestArchive(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	hosts, el, service := makeHELS(local, 3)
+
+	dir, err := ioutil.TempDir("", "skipchain_archive")
+	log.ErrFatal(err)
+	defer os.RemoveAll(dir)
+
+	genesis := makeGenesisRosterArgs(service, el, nil, VerifyNone, 2, 3)
+	latest := genesis
+	payload := []byte("payload")
+	_, cerr := service.PutBlob(&PutBlob{payload})
+	log.ErrFatal(cerr)
+	for i := 0; i < 6; i++ {
+		sb := NewSkipBlock()
+		sb.Roster = el
+		if i == 2 {
+			sb.PayloadHash = HashPayload(payload)
+		}
+		psbr, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: latest.Hash, Proposed: sb})
+		log.ErrFatal(cerr)
+		latest = psbr.(*ProposedSkipBlockReply).Latest
+	}
+
+	buf := &bytes.Buffer{}
+	log.ErrFatal(NewClient().ExportChain(hosts[1].ServerIdentity, genesis.Hash, buf))
+	archive := buf.Bytes()
+
+	m, blocks, payloads, err := ReadArchive(bytes.NewReader(archive))
+	log.ErrFatal(err)
+	assert.Equal(t, ArchiveVersion, m.Version)
+	assert.Equal(t, 7, m.Blocks)
+	assert.Equal(t, 1, m.Payloads)
+	assert.Equal(t, [][]byte{payload}, payloads)
+	assert.True(t, m.Genesis.Equal(genesis.Hash))
+	assert.True(t, m.Latest.Equal(latest.Hash))
+	log.ErrFatal(VerifyArchive(m, blocks, payloads))
+
+	bs := &SkipBlockMap{SkipBlocks: make(map[string]*SkipBlock)}
+	_, err = ImportArchive(bytes.NewReader(archive), bs, dir)
+	log.ErrFatal(err)
+	assert.Equal(t, 7, bs.Len())
+	sb, ok := bs.GetByID(genesis.Hash)
+	require.True(t, ok)
+	assert.Equal(t, genesis.Height, len(sb.ForwardLink))
+	blobs, err := newBlobStore(dir)
+	log.ErrFatal(err)
+	p, ok := blobs.get(HashPayload(payload))
+	require.True(t, ok, "Payload not imported")
+	assert.Equal(t, payload, p)
+	// Importing twice doesn't change anything
+	_, err = ImportArchive(bytes.NewReader(archive), bs, dir)
+	log.ErrFatal(err)
+	assert.Equal(t, 7, bs.Len())
+
+	// Broken archives
+	_, _, _, err = ReadArchive(bytes.NewReader(archive[:len(archive)-1]))
+	assert.NotNil(t, err, "Truncated archive")
+	_, _, _, err = ReadArchive(bytes.NewReader(append(archive, 0)))
+	assert.NotNil(t, err, "Trailing data")
+	wrong := append([]byte{}, archive...)
+	binary.BigEndian.PutUint32(wrong[len(archiveMagic):], ArchiveVersion+1)
+	_, _, _, err = ReadArchive(bytes.NewReader(wrong))
+	assert.NotNil(t, err, "Unknown version")
+
+	// Archives with missing or additional payloads are refused
+	assert.NotNil(t, VerifyArchive(m, blocks, nil), "Missing payload")
+	m.Payloads = 2
+	assert.NotNil(t, VerifyArchive(m, blocks, [][]byte{payload, []byte("other")}),
+		"Unreferenced payload")
+	assert.NotNil(t, VerifyArchive(m, blocks, [][]byte{payload, payload}),
+		"Payload twice")
+	m.Payloads = 1
+
+	// Archives with wrong blocks are refused
+	blocks[3].Data = []byte("changed")
+	blocks[3].updateHash()
+	buf.Reset()
+	log.ErrFatal(WriteArchive(buf, blocks, payloads))
+	m, blocks, payloads, err = ReadArchive(bytes.NewReader(buf.Bytes()))
+	log.ErrFatal(err)
+	require.NotNil(t, VerifyArchive(m, blocks, payloads))
+	bs = &SkipBlockMap{SkipBlocks: make(map[string]*SkipBlock)}
+	_, err = ImportArchive(bytes.NewReader(buf.Bytes()), bs, dir)
+	require.NotNil(t, err)
+	assert.Equal(t, 0, bs.Len())
+
+	m.Blocks = 6
+	assert.NotNil(t, VerifyArchive(m, blocks[:6], payloads), "Wrong latest block")
+	assert.NotNil(t, WriteArchive(buf, blocks[1:], payloads), "Missing genesis block")
+}
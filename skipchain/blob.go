@@ -0,0 +1,291 @@
+package skipchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// MaxPayloadSize is the biggest payload a conode accepts in its blob store.
+var MaxPayloadSize = 1 << 28
+
+// MaxPendingPayloads is how many bytes of payloads a conode keeps that no
+// stored SkipBlock refers to, e.g. because their proposal is still running.
+// Anybody can send payloads, so this bounds the space they can fill.
+var MaxPendingPayloads = 1 << 30
+
+// PendingPayloadExpiry is how long a conode keeps a payload no stored
+// SkipBlock refers to.
+var PendingPayloadExpiry = time.Hour
+
+// PayloadDir is the directory in the data-directory of the service that
+// holds the payloads.
+const PayloadDir = "blobs"
+
+// HashPayload returns the content hash under which a payload is stored and
+// that a SkipBlock holds in its PayloadHash.
+func HashPayload(payload []byte) []byte {
+	h, err := crypto.HashBytes(network.Suite.Hash(), payload)
+	if err != nil {
+		log.Panic("Couldn't hash payload:", err)
+	}
+	return h
+}
+
+// blobStore keeps payloads under their content hash. If dir is empty, the
+// payloads are only kept in memory, else every payload is a file in dir.
+// Payloads that are not referenced by a stored SkipBlock are pending and
+// removed after PendingPayloadExpiry.
+type blobStore struct {
+	sync.Mutex
+	dir   string
+	blobs map[string][]byte
+	// pending holds the size and the time of arrival of the payloads
+	// not referenced yet
+	pending     map[string]*pendingBlob
+	pendingSize int
+}
+
+// pendingBlob is a payload that is not referenced by a stored SkipBlock.
+type pendingBlob struct {
+	size  int
+	added time.Time
+}
+
+// newBlobStore returns a blobStore using the directory dir, which is
+// created if it doesn't exist yet. An empty dir keeps the blobs in memory.
+func newBlobStore(dir string) (*blobStore, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &blobStore{dir: dir, blobs: map[string][]byte{},
+		pending: map[string]*pendingBlob{}}, nil
+}
+
+// put stores the blob and returns its hash. A blob that is not referenced
+// by a stored SkipBlock is only accepted if the pending blobs don't exceed
+// MaxPendingPayloads.
+func (bs *blobStore) put(blob []byte, referenced bool) ([]byte, error) {
+	h := HashPayload(blob)
+	bs.Lock()
+	defer bs.Unlock()
+	if bs.has(h) {
+		if referenced {
+			bs.reference(h)
+		}
+		return h, nil
+	}
+	if !referenced {
+		bs.expire(time.Now())
+		if bs.pendingSize+len(blob) > MaxPendingPayloads {
+			return nil, errors.New("Too many pending payloads")
+		}
+	}
+	if bs.dir == "" {
+		bs.blobs[string(h)] = blob
+	} else {
+		// Write to a temporary file first, so that a crash never
+		// leaves a truncated blob behind.
+		name := path.Join(bs.dir, hex.EncodeToString(h))
+		tmp := name + ".tmp"
+		if err := ioutil.WriteFile(tmp, blob, 0600); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(tmp, name); err != nil {
+			return nil, err
+		}
+	}
+	if !referenced {
+		bs.pending[string(h)] = &pendingBlob{len(blob), time.Now()}
+		bs.pendingSize += len(blob)
+	}
+	return h, nil
+}
+
+// has returns whether the blob is stored.
+func (bs *blobStore) has(h []byte) bool {
+	if bs.dir == "" {
+		_, ok := bs.blobs[string(h)]
+		return ok
+	}
+	_, err := os.Stat(path.Join(bs.dir, hex.EncodeToString(h)))
+	return err == nil
+}
+
+// reference marks the blob as being referenced by a stored SkipBlock, so
+// it is kept.
+func (bs *blobStore) reference(h []byte) {
+	if p, ok := bs.pending[string(h)]; ok {
+		delete(bs.pending, string(h))
+		bs.pendingSize -= p.size
+	}
+}
+
+// referenced locks the store and marks the blob as referenced.
+func (bs *blobStore) referenced(h []byte) {
+	bs.Lock()
+	defer bs.Unlock()
+	bs.reference(h)
+}
+
+// expire removes the pending blobs older than PendingPayloadExpiry.
+func (bs *blobStore) expire(now time.Time) {
+	for h, p := range bs.pending {
+		if now.Sub(p.added) < PendingPayloadExpiry {
+			continue
+		}
+		if bs.dir == "" {
+			delete(bs.blobs, h)
+		} else {
+			name := path.Join(bs.dir, hex.EncodeToString([]byte(h)))
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				log.Error("Couldn't remove payload:", err)
+				continue
+			}
+		}
+		delete(bs.pending, h)
+		bs.pendingSize -= p.size
+	}
+}
+
+// loadPending marks all blobs in dir that are not referenced as pending,
+// starting at the time they were written.
+func (bs *blobStore) loadPending(referenced map[string]bool) error {
+	if bs.dir == "" {
+		return nil
+	}
+	bs.Lock()
+	defer bs.Unlock()
+	files, err := ioutil.ReadDir(bs.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		h, err := hex.DecodeString(f.Name())
+		if err != nil {
+			// Left behind by a crash while writing
+			os.Remove(path.Join(bs.dir, f.Name()))
+			continue
+		}
+		if referenced[string(h)] {
+			continue
+		}
+		bs.pending[string(h)] = &pendingBlob{int(f.Size()), f.ModTime()}
+		bs.pendingSize += int(f.Size())
+	}
+	return nil
+}
+
+// get returns the blob with the given hash or false if it is not stored.
+func (bs *blobStore) get(h []byte) ([]byte, bool) {
+	bs.Lock()
+	defer bs.Unlock()
+	if bs.dir == "" {
+		blob, ok := bs.blobs[string(h)]
+		return blob, ok
+	}
+	blob, err := ioutil.ReadFile(path.Join(bs.dir, hex.EncodeToString(h)))
+	if err != nil {
+		return nil, false
+	}
+	if !SkipBlockID(HashPayload(blob)).Equal(h) {
+		log.Errorf("Blob %x is corrupted", h)
+		return nil, false
+	}
+	return blob, true
+}
+
+// PutBlob stores a payload in the blob store, so that a SkipBlock can be
+// proposed with its hash as PayloadHash. The payload is removed again if
+// no such block is stored within PendingPayloadExpiry.
+func (s *Service) PutBlob(pb *PutBlob) (network.Message, onet.ClientError) {
+	if len(pb.Blob) > MaxPayloadSize {
+		return nil, onet.NewClientErrorCode(4200,
+			fmt.Sprintf("Payload bigger than %d bytes", MaxPayloadSize))
+	}
+	h, err := s.blobs.put(pb.Blob, false)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(4200, err.Error())
+	}
+	return &PutBlobReply{h}, nil
+}
+
+// GetBlob returns the payload with the given hash if it is stored on this
+// conode.
+func (s *Service) GetBlob(gb *GetBlob) (network.Message, onet.ClientError) {
+	blob, ok := s.blobs.get(gb.Hash)
+	if !ok {
+		return nil, onet.NewClientErrorCode(4200, "Unknown payload")
+	}
+	return &GetBlobReply{blob}, nil
+}
+
+// Payload returns the data of the SkipBlock: Data if the block holds it
+// directly, else the payload with the hash PayloadHash. A payload that is
+// not stored yet is fetched from the roster of the block.
+func (s *Service) Payload(sb *SkipBlock) ([]byte, error) {
+	if len(sb.PayloadHash) == 0 {
+		return sb.Data, nil
+	}
+	if blob, ok := s.blobs.get(sb.PayloadHash); ok {
+		return blob, nil
+	}
+	if sb.Roster == nil {
+		return nil, errors.New("Missing payload and no roster to fetch it from")
+	}
+	c := NewClient()
+	for _, si := range sb.Roster.List {
+		if si.ID.Equal(s.ServerIdentity().ID) {
+			continue
+		}
+		blob, err := c.GetBlob(si, sb.PayloadHash)
+		if err != nil {
+			log.Lvl3(s.ServerIdentity(), "couldn't get payload from", si, ":", err)
+			continue
+		}
+		_, stored := s.getSkipBlockByID(sb.Hash)
+		if _, err := s.blobs.put(blob, stored); err != nil {
+			return nil, err
+		}
+		return blob, nil
+	}
+	return nil, errors.New("Couldn't fetch payload from roster")
+}
+
+// loadPayloads marks the payloads that no stored SkipBlock refers to as
+// pending, so they are removed once they expired.
+func (s *Service) loadPayloads() error {
+	referenced := map[string]bool{}
+	s.db.Range(func(sb *SkipBlock) bool {
+		if len(sb.PayloadHash) > 0 {
+			referenced[string(sb.PayloadHash)] = true
+		}
+		return true
+	})
+	return s.blobs.loadPending(referenced)
+}
+
+// verifyPayload checks that a block holds either data or a payload and
+// that the payload is available.
+func (s *Service) verifyPayload(sb *SkipBlock) error {
+	if len(sb.PayloadHash) == 0 {
+		return nil
+	}
+	if len(sb.Data) > 0 {
+		return errors.New("Block has data and a payload")
+	}
+	_, err := s.Payload(sb)
+	return err
+}
@@ -0,0 +1,118 @@
+package skipchain
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func TestService_Payload(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	hosts, el, service := makeHELS(local, 3)
+
+	payload := bytes.Repeat([]byte("payload"), 1000)
+	hash := HashPayload(payload)
+	genesis := NewSkipBlock()
+	genesis.Roster = el
+	genesis.MaximumHeight = 1
+	genesis.BaseHeight = 1
+	genesis.PayloadHash = hash
+	_, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: nil, Proposed: genesis})
+	require.NotNil(t, cerr, "Payload is not stored yet")
+
+	m, cerr := service.PutBlob(&PutBlob{payload})
+	log.ErrFatal(cerr)
+	assert.Equal(t, hash, m.(*PutBlobReply).Hash)
+	m, cerr = service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: nil, Proposed: genesis})
+	log.ErrFatal(cerr)
+	sb := m.(*ProposedSkipBlockReply).Latest
+	assert.Equal(t, 0, len(sb.Data))
+
+	// All signers fetched the payload
+	for _, h := range hosts {
+		s := local.Services[h.ServerIdentity.ID][skipchainSID].(*Service)
+		p, err := s.Payload(sb)
+		log.ErrFatal(err)
+		assert.Equal(t, payload, p)
+	}
+	p, err := NewClient().GetPayload(sb)
+	log.ErrFatal(err)
+	assert.Equal(t, payload, p)
+
+	// The payload can't be changed without changing the block
+	wrong := sb.Copy()
+	wrong.PayloadHash = HashPayload([]byte("wrong"))
+	assert.False(t, wrong.calculateHash().Equal(sb.Hash))
+	_, err = NewClient().GetPayload(wrong)
+	assert.NotNil(t, err)
+
+	_, cerr = service.GetBlob(&GetBlob{HashPayload([]byte("unknown"))})
+	assert.NotNil(t, cerr)
+}
+
+func TestClient_PayloadThreshold(t *testing.T) {
+	l := onet.NewLocalTest()
+	_, el, _ := l.GenTree(3, true, true, true)
+	defer l.CloseAll()
+
+	c := NewClient()
+	c.PayloadThreshold = 1
+	_, control, err := c.CreateRootControl(el, el, 1, 1, 1, VerifyNone)
+	log.ErrFatal(err)
+	_, data, err := c.CreateData(control, 1, 1, VerifyNone, &testData{1, "data"})
+	log.ErrFatal(err)
+	require.NotEqual(t, 0, len(data.PayloadHash))
+	assert.Equal(t, 0, len(data.Data))
+	p, err := c.GetPayload(data)
+	log.ErrFatal(err)
+	_, msg, err := network.Unmarshal(p)
+	log.ErrFatal(err)
+	assert.Equal(t, "data", msg.(*testData).B)
+}
+
+func TestBlobStore_Pending(t *testing.T) {
+	defer func(max int, expiry time.Duration) {
+		MaxPendingPayloads, PendingPayloadExpiry = max, expiry
+	}(MaxPendingPayloads, PendingPayloadExpiry)
+	MaxPendingPayloads = 10
+	dir, err := ioutil.TempDir("", "skipchain_blobs")
+	log.ErrFatal(err)
+	defer os.RemoveAll(dir)
+
+	bs, err := newBlobStore(dir)
+	log.ErrFatal(err)
+	h1, err := bs.put([]byte("12345678"), false)
+	log.ErrFatal(err)
+	_, err = bs.put([]byte("abcdefgh"), false)
+	require.NotNil(t, err, "Too many pending payloads")
+
+	// Referenced payloads don't count
+	bs.referenced(h1)
+	h2, err := bs.put([]byte("abcdefgh"), false)
+	log.ErrFatal(err)
+
+	// Expired payloads are removed, referenced ones are kept
+	PendingPayloadExpiry = 0
+	_, err = bs.put([]byte("x"), false)
+	log.ErrFatal(err)
+	_, ok := bs.get(h2)
+	assert.False(t, ok)
+	_, ok = bs.get(h1)
+	assert.True(t, ok)
+
+	// After a restart the payloads not referenced are pending again
+	bs, err = newBlobStore(dir)
+	log.ErrFatal(err)
+	log.ErrFatal(bs.loadPending(map[string]bool{string(h1): true}))
+	assert.Equal(t, 1, len(bs.pending))
+	assert.Equal(t, 1, bs.pendingSize)
+}
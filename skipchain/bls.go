@@ -0,0 +1,153 @@
+package skipchain
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/paper_chainiac/bftcosi"
+	"github.com/dedis/paper_chainiac/bls"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+const blsKeyID = "blskey"
+
+// BLSKey is the BLS public key of a member of a roster, together with the
+// proof that the member knows the private key. SkipChains signing with
+// bftcosi.SchemeBLS hold the keys of their roster in every block.
+type BLSKey struct {
+	Public     []byte
+	Possession []byte
+}
+
+// Verify checks the proof of possession of the key.
+func (k *BLSKey) Verify() error {
+	return bls.VerifyPossession(k.Public, k.Possession)
+}
+
+// blsKeyStorage is used to save the seed of the BLS key of the conode.
+type blsKeyStorage struct {
+	Seed []byte
+}
+
+// verifyBLSKeys checks that a block of a SkipChain signing with
+// bftcosi.SchemeBLS has a valid BLS key for every member of its roster.
+func (sbf *SkipBlockFix) verifyBLSKeys() error {
+	switch sbf.SignatureScheme {
+	case bftcosi.SchemeCoSi:
+		if len(sbf.BLSKeys) > 0 {
+			return errors.New("Only SkipChains signing with BLS have BLS keys")
+		}
+		return nil
+	case bftcosi.SchemeBLS:
+		if sbf.Roster == nil || len(sbf.BLSKeys) != len(sbf.Roster.List) {
+			return errors.New("Need a BLS key for every member of the roster")
+		}
+		for i, k := range sbf.BLSKeys {
+			if k == nil || k.Verify() != nil {
+				return fmt.Errorf("Invalid BLS key of member %d", i)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown signature scheme %d", sbf.SignatureScheme)
+}
+
+// blsPublics returns the BLS public keys of roster if the SkipChain signs
+// with bftcosi.SchemeBLS, else nil. roster has to be the roster of the
+// block.
+func (sbf *SkipBlockFix) blsPublics(roster *onet.Roster) ([][]byte, error) {
+	if sbf.SignatureScheme != bftcosi.SchemeBLS {
+		return nil, nil
+	}
+	if !sameMembers(roster, sbf.Roster) || len(sbf.BLSKeys) != len(roster.List) {
+		return nil, errors.New("No BLS keys for the roster")
+	}
+	publics := make([][]byte, len(sbf.BLSKeys))
+	for i, k := range sbf.BLSKeys {
+		publics[i] = k.Public
+	}
+	return publics, nil
+}
+
+// verifySig checks that sig has been created by roster with the signature
+// scheme of the SkipChain and that the members that didn't sign follow its
+// acceptance policy. Members may only be missing in the bitmap of a
+// signature: the commitments of a list of exceptions are not covered by the
+// signature.
+func (sbf *SkipBlockFix) verifySig(sig *bftcosi.BFTSignature, roster *onet.Roster) error {
+	if sig == nil {
+		return errors.New("Missing signature")
+	}
+	if len(sig.Exceptions) > 0 {
+		return errors.New("Exceptions are not covered by the signature")
+	}
+	n := len(roster.List)
+	if err := verifyExceptions(sig.Missing(n), n, sbf.allowedExceptions(n)); err != nil {
+		return err
+	}
+	switch sbf.SignatureScheme {
+	case bftcosi.SchemeCoSi:
+		return sig.Verify(network.Suite, roster.Publics())
+	case bftcosi.SchemeBLS:
+		publics, err := sbf.blsPublics(roster)
+		if err != nil {
+			return err
+		}
+		return sig.VerifyBLS(publics)
+	}
+	return fmt.Errorf("Unknown signature scheme %d", sbf.SignatureScheme)
+}
+
+// sameMembers returns whether both rosters have the same members in the
+// same order.
+func sameMembers(a, b *onet.Roster) bool {
+	if a == nil || b == nil || len(a.List) != len(b.List) {
+		return false
+	}
+	for i := range a.List {
+		if !a.List[i].ID.Equal(b.List[i].ID) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetBLSKey returns the BLS key of the conode.
+func (s *Service) GetBLSKey(gbk *GetBLSKey) (network.Message, onet.ClientError) {
+	if s.blsKey == nil {
+		return nil, onet.NewClientErrorCode(4200, "Conode has no BLS key")
+	}
+	return &GetBLSKeyReply{&BLSKey{
+		Public:     s.blsKey.PublicBytes(),
+		Possession: s.blsKey.ProvePossession(),
+	}}, nil
+}
+
+// loadBLSKey restores the BLS key of the conode or creates a new one.
+func (s *Service) loadBLSKey() error {
+	seed := make([]byte, 32)
+	if s.path != "" && s.DataAvailable(blsKeyID) {
+		msg, err := s.Load(blsKeyID)
+		if err != nil {
+			return err
+		}
+		ks, ok := msg.(*blsKeyStorage)
+		if !ok {
+			return errors.New("Data of wrong type")
+		}
+		seed = ks.Seed
+	} else {
+		if _, err := rand.Read(seed); err != nil {
+			return err
+		}
+		if s.path != "" {
+			if err := s.Save(blsKeyID, &blsKeyStorage{seed}); err != nil {
+				return err
+			}
+		}
+	}
+	s.blsKey = bls.NewKeyPairFromSeed(seed)
+	return nil
+}
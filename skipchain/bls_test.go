@@ -0,0 +1,66 @@
+package skipchain
+
+import (
+	"testing"
+
+	"github.com/dedis/paper_chainiac/bftcosi"
+	"github.com/dedis/paper_chainiac/bls"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestClient_BLS(t *testing.T) {
+	l := onet.NewLocalTest()
+	_, el, _ := l.GenTree(5, true, true, true)
+	defer l.CloseAll()
+
+	c := NewClient()
+	c.SignatureScheme = bftcosi.SchemeBLS
+	c.MaxExceptions = ExceptionsBFT
+	root, control, err := c.CreateRootControl(el, el, 1, 2, 2, VerifyNone)
+	log.ErrFatal(err)
+	for _, sb := range []*SkipBlock{root, control} {
+		require.Equal(t, bftcosi.SchemeBLS, sb.SignatureScheme)
+		require.Equal(t, len(el.List), len(sb.BLSKeys))
+		assert.Equal(t, bftcosi.SchemeBLS, sb.BlockSig.Scheme)
+		assert.Equal(t, []byte{0x1f}, sb.BlockSig.Bitmap)
+		assert.Equal(t, bls.SignatureSize, len(sb.BlockSig.Sig))
+		log.ErrFatal(sb.VerifySignatures())
+	}
+	require.NotNil(t, root.ChildSL)
+	assert.Equal(t, bftcosi.SchemeBLS, root.ChildSL.Scheme)
+	log.ErrFatal(VerifyHierarchy(root, control))
+
+	// New blocks keep the scheme and the keys of the roster
+	reply, err := c.ProposeRoster(control, el)
+	log.ErrFatal(err)
+	assert.Equal(t, bftcosi.SchemeBLS, reply.Latest.SignatureScheme)
+	assert.Equal(t, control.BLSKeys, reply.Latest.BLSKeys)
+	log.ErrFatal(reply.Previous.VerifySignatures())
+	log.ErrFatal(VerifyChain(control, []*SkipBlock{reply.Previous, reply.Latest}))
+	// BLS links can only be verified with the keys of their block
+	fl := reply.Previous.ForwardLink[0]
+	log.ErrFatal(reply.Previous.VerifyForward(reply.Latest))
+	assert.NotNil(t, fl.VerifySignature(el.Publics()))
+
+	// A CoSi signature is not accepted for a SkipChain signing with BLS
+	cosi := reply.Latest.Copy()
+	cosi.BlockSig.Scheme = bftcosi.SchemeCoSi
+	assert.NotNil(t, cosi.VerifySignatures())
+	// Too many missing signers are refused
+	few := reply.Latest.Copy()
+	few.BlockSig.Bitmap = []byte{0x07}
+	assert.NotNil(t, few.VerifySignatures())
+
+	// Keys need a valid proof of possession
+	sbf := *reply.Latest.SkipBlockFix
+	log.ErrFatal(sbf.verifyBLSKeys())
+	sbf.BLSKeys = append([]*BLSKey{}, sbf.BLSKeys...)
+	sbf.BLSKeys[0] = &BLSKey{Public: sbf.BLSKeys[1].Public,
+		Possession: sbf.BLSKeys[0].Possession}
+	assert.NotNil(t, sbf.verifyBLSKeys())
+	sbf.BLSKeys = sbf.BLSKeys[1:]
+	assert.NotNil(t, sbf.verifyBLSKeys())
+}
@@ -0,0 +1,195 @@
+package skipchain
+
+import (
+	"container/list"
+	"sync"
+
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// BlockCacheBytes is the estimated memory the service uses at most to keep
+// SkipBlocks of the store on disk in memory.
+var BlockCacheBytes = 64 << 20
+
+// CacheStats are the metrics of a CachedStore.
+type CacheStats struct {
+	// Hits and Misses count the requests answered from memory and from
+	// the store behind the cache
+	Hits   int64
+	Misses int64
+	// Evictions counts the blocks removed to stay below Capacity
+	Evictions int64
+	// Blocks is the number of SkipBlocks in memory and Bytes their
+	// estimated size
+	Blocks int
+	Bytes  int
+	// Capacity is the maximum of Bytes
+	Capacity int
+}
+
+// CachedStore keeps the most recently used SkipBlocks of another BlockStore
+// in memory. Blocks are loaded on demand and the least recently used
+// blocks are evicted as soon as their estimated size is bigger than the
+// capacity. Store writes through to the store behind the cache.
+type CachedStore struct {
+	mutex    sync.Mutex
+	store    BlockStore
+	capacity int
+	// lru holds the cached blocks, the most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+	stats   CacheStats
+}
+
+// cacheEntry is an element of the lru-list.
+type cacheEntry struct {
+	sb   *SkipBlock
+	size int
+}
+
+// NewCachedStore returns a cache of at most capacity bytes in front of
+// store.
+func NewCachedStore(store BlockStore, capacity int) *CachedStore {
+	return &CachedStore{
+		store:    store,
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// GetByID returns the SkipBlock from memory or loads it from the store.
+func (cs *CachedStore) GetByID(id SkipBlockID) (*SkipBlock, bool) {
+	cs.mutex.Lock()
+	if e, ok := cs.entries[string(id)]; ok {
+		cs.lru.MoveToFront(e)
+		cs.stats.Hits++
+		cs.mutex.Unlock()
+		return e.Value.(*cacheEntry).sb, true
+	}
+	cs.stats.Misses++
+	cs.mutex.Unlock()
+	sb, ok := cs.store.GetByID(id)
+	if !ok {
+		return nil, false
+	}
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if e, ok := cs.entries[string(id)]; ok {
+		// Another call loaded or stored it in the meantime
+		return e.Value.(*cacheEntry).sb, true
+	}
+	cs.add(sb)
+	return sb, true
+}
+
+// Store writes the SkipBlock to the store and keeps it in memory.
+func (cs *CachedStore) Store(sb *SkipBlock) error {
+	if err := cs.store.Store(sb); err != nil {
+		return err
+	}
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.remove(sb.Hash)
+	cs.add(sb)
+	return nil
+}
+
+// Len returns the number of SkipBlocks in the store.
+func (cs *CachedStore) Len() int {
+	return cs.store.Len()
+}
+
+// Range calls f for all SkipBlocks of the store without caching them.
+func (cs *CachedStore) Range(f func(sb *SkipBlock) bool) {
+	cs.store.Range(f)
+}
+
+// Close closes the store behind the cache.
+func (cs *CachedStore) Close() error {
+	cs.purge()
+	return cs.store.Close()
+}
+
+// Stats returns the current metrics of the cache.
+func (cs *CachedStore) Stats() CacheStats {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	st := cs.stats
+	st.Blocks = cs.lru.Len()
+	st.Capacity = cs.capacity
+	return st
+}
+
+// purge removes all blocks from memory.
+func (cs *CachedStore) purge() {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.lru.Init()
+	cs.entries = map[string]*list.Element{}
+	cs.stats.Bytes = 0
+}
+
+// add puts sb in front of the lru-list and evicts the oldest blocks if
+// needed. cs has to be locked.
+func (cs *CachedStore) add(sb *SkipBlock) {
+	size := blockSize(sb)
+	if size > cs.capacity {
+		return
+	}
+	cs.entries[string(sb.Hash)] = cs.lru.PushFront(&cacheEntry{sb, size})
+	cs.stats.Bytes += size
+	for cs.stats.Bytes > cs.capacity {
+		oldest := cs.lru.Back().Value.(*cacheEntry)
+		cs.remove(oldest.sb.Hash)
+		cs.stats.Evictions++
+	}
+}
+
+// remove drops the block from memory. cs has to be locked.
+func (cs *CachedStore) remove(id SkipBlockID) {
+	e, ok := cs.entries[string(id)]
+	if !ok {
+		return
+	}
+	cs.lru.Remove(e)
+	delete(cs.entries, string(id))
+	cs.stats.Bytes -= e.Value.(*cacheEntry).size
+}
+
+// blockSize estimates the memory used by a SkipBlock, counting the
+// variable parts and a fixed amount for the rest.
+func blockSize(sb *SkipBlock) int {
+	size := 512 + len(sb.Hash) + len(sb.Data) + len(sb.PayloadHash) +
+		len(sb.ParentBlockID)
+	for _, bl := range sb.BackLinkIds {
+		size += 24 + len(bl)
+	}
+	for _, fl := range sb.ForwardLink {
+		size += 64 + len(fl.Hash) + len(fl.Signature) + 8*len(fl.Exceptions) +
+			len(fl.Bitmap)
+	}
+	if sb.ChildSL != nil {
+		size += 64 + len(sb.ChildSL.Hash) + len(sb.ChildSL.Signature)
+	}
+	if sb.BlockSig != nil {
+		size += len(sb.BlockSig.Sig) + len(sb.BlockSig.Msg) +
+			8*len(sb.BlockSig.Exceptions) + len(sb.BlockSig.Bitmap)
+	}
+	if sb.Roster != nil {
+		size += 128 * len(sb.Roster.List)
+	}
+	return size
+}
+
+// GetStoreStats returns the number of stored SkipBlocks and, if the
+// blocks are stored on disk, the metrics of the cache in front of it.
+func (s *Service) GetStoreStats(gss *GetStoreStats) (network.Message, onet.ClientError) {
+	reply := &GetStoreStatsReply{Blocks: s.lenSkipBlocks()}
+	if cs, ok := s.db.(*CachedStore); ok {
+		st := cs.Stats()
+		reply.Cache = &st
+	}
+	return reply, nil
+}
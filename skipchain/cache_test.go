@@ -0,0 +1,121 @@
+package skipchain
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestCachedStore(t *testing.T) {
+	sbs := make([]*SkipBlock, 10)
+	for i := range sbs {
+		sbs[i] = NewSkipBlock()
+		sbs[i].Index = i
+		sbs[i].Data = []byte(strconv.Itoa(i))
+		sbs[i].updateHash()
+	}
+	store := &SkipBlockMap{SkipBlocks: make(map[string]*SkipBlock)}
+	cs := NewCachedStore(store, 3*blockSize(sbs[0]))
+	for _, sb := range sbs {
+		log.ErrFatal(cs.Store(sb))
+	}
+	st := cs.Stats()
+	assert.Equal(t, 3, st.Blocks)
+	assert.Equal(t, int64(7), st.Evictions)
+	assert.True(t, st.Bytes <= st.Capacity)
+	assert.Equal(t, 10, cs.Len())
+
+	// The newest blocks are in memory, the others are loaded
+	_, ok := cs.GetByID(sbs[9].Hash)
+	require.True(t, ok)
+	sb, ok := cs.GetByID(sbs[0].Hash)
+	require.True(t, ok)
+	assert.True(t, sb.Equal(sbs[0]))
+	st = cs.Stats()
+	assert.Equal(t, int64(1), st.Hits)
+	assert.Equal(t, int64(1), st.Misses)
+	assert.Equal(t, 3, st.Blocks)
+	_, ok = cs.GetByID(SkipBlockID("unknown"))
+	assert.False(t, ok)
+
+	// The least recently used block is evicted: sbs[8]
+	_, ok = cs.GetByID(sbs[1].Hash)
+	require.True(t, ok)
+	cs.mutex.Lock()
+	_, cached8 := cs.entries[string(sbs[8].Hash)]
+	_, cached9 := cs.entries[string(sbs[9].Hash)]
+	cs.mutex.Unlock()
+	assert.False(t, cached8)
+	assert.True(t, cached9)
+	log.ErrFatal(cs.Close())
+	assert.Equal(t, 0, cs.Stats().Bytes)
+}
+
+// makeBenchChain returns a SkipChain of n blocks with deterministic heights
+// and forward-links, but without signatures.
+func makeBenchChain(n, base, maxHeight int) []*SkipBlock {
+	sbs := make([]*SkipBlock, n)
+	last := make([]*SkipBlock, maxHeight)
+	for i := range sbs {
+		sb := NewSkipBlock()
+		sb.Index = i
+		sb.BaseHeight = base
+		sb.MaximumHeight = maxHeight
+		sb.Height = deterministicHeight(i, base, maxHeight)
+		sb.Data = []byte(strconv.Itoa(i))
+		sb.updateHash()
+		for h := 0; h < sb.Height; h++ {
+			if last[h] != nil {
+				last[h].ForwardLink = append(last[h].ForwardLink,
+					&BlockLink{Hash: sb.Hash, Signature: make([]byte, 64)})
+			}
+			last[h] = sb
+		}
+		sbs[i] = sb
+	}
+	return sbs
+}
+
+func BenchmarkService_GetUpdateChain(b *testing.B) {
+	const blocks = 100000
+	sbs := makeBenchChain(blocks, 4, 8)
+	dir, err := ioutil.TempDir("", "skipchain_bench")
+	log.ErrFatal(err)
+	defer os.RemoveAll(dir)
+	fs, err := NewFileStore(dir)
+	log.ErrFatal(err)
+	log.ErrFatal(fs.StoreBatch(sbs))
+	mem := &SkipBlockMap{SkipBlocks: make(map[string]*SkipBlock)}
+	for _, sb := range sbs {
+		mem.Store(sb)
+	}
+	cached := NewCachedStore(fs, BlockCacheBytes)
+	defer cached.Close()
+
+	// Every iteration asks for the update-chain from another block
+	run := func(b *testing.B, db BlockStore, cold bool) {
+		s := &Service{db: db}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if cold {
+				b.StopTimer()
+				cached.purge()
+				b.StartTimer()
+			}
+			start := sbs[(i*7919)%blocks]
+			_, cerr := s.GetUpdateChain(&GetUpdateChain{start.Hash})
+			if cerr != nil {
+				b.Fatal(cerr)
+			}
+		}
+	}
+	b.Run("Memory", func(b *testing.B) { run(b, mem, false) })
+	b.Run("Disk", func(b *testing.B) { run(b, fs, false) })
+	b.Run("CachedCold", func(b *testing.B) { run(b, cached, true) })
+	b.Run("CachedWarm", func(b *testing.B) { run(b, cached, false) })
+}
@@ -0,0 +1,357 @@
+package skipchain
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/dedis/paper_chainiac/bftcosi"
+	"github.com/dedis/paper_chainiac/manage"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// CheckpointInterval is every how many blocks the leader asks the roster to
+// sign a checkpoint of the SkipChain. A value of 0 disables checkpoints.
+var CheckpointInterval = 1000
+
+const checkpointsID = "checkpoints"
+
+// Checkpoint summarises the state of a SkipChain at one of its blocks and
+// is signed by the roster of that block. A client that trusts a checkpoint
+// can start following the SkipChain from there instead of the genesis
+// block.
+type Checkpoint struct {
+	// Genesis is the first block of the SkipChain
+	Genesis SkipBlockID
+	// Block is the block summarised by the checkpoint
+	Block SkipBlockID
+	// Index of Block
+	Index int
+	// Roster of Block, which signs the checkpoint
+	Roster *onet.Roster
+	// MaxExceptions is the acceptance policy of the SkipChain
+	MaxExceptions int
+	// SignatureScheme of the SkipChain and the BLS keys of Roster if it
+	// is bftcosi.SchemeBLS
+	SignatureScheme bftcosi.Scheme
+	BLSKeys         []*BLSKey
+	// DataHash is the hash of the data of Block, or its PayloadHash
+	DataHash []byte
+	// History is the cumulative hash of all blocks from Genesis up to
+	// Block, see HistoryHash
+	History []byte
+	// Signature of the roster on the hash of the checkpoint
+	Signature *bftcosi.BFTSignature
+}
+
+// checkpointStorage is used to save the checkpoints.
+type checkpointStorage struct {
+	Checkpoints []*Checkpoint
+}
+
+// HistoryHash extends the cumulative hash prev of a SkipChain with the next
+// block. The history of the genesis block is HistoryHash(nil, genesis).
+func HistoryHash(prev []byte, block SkipBlockID) []byte {
+	h := network.Suite.Hash()
+	h.Write(prev)
+	h.Write(block)
+	return h.Sum(nil)
+}
+
+// Hash returns what the roster signs: all fields except the signature. It
+// is different from the hash of a block, so that the signature can't be
+// taken for a forward-link.
+func (cp *Checkpoint) Hash() []byte {
+	c := *cp
+	c.Signature = nil
+	b, err := network.Marshal(&c)
+	if err != nil {
+		log.Panic("Couldn't marshal checkpoint:", err)
+	}
+	h := network.Suite.Hash()
+	h.Write([]byte("Checkpoint"))
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// Verify checks the signature of the roster on the checkpoint.
+func (cp *Checkpoint) Verify() error {
+	if cp.Roster == nil || len(cp.Roster.List) == 0 {
+		return errors.New("Checkpoint has no roster")
+	}
+	if cp.Signature == nil || len(cp.Signature.Sig) < 64 {
+		return errors.New("Missing signature on checkpoint")
+	}
+	sbf := &SkipBlockFix{
+		Roster:          cp.Roster,
+		MaxExceptions:   cp.MaxExceptions,
+		SignatureScheme: cp.SignatureScheme,
+		BLSKeys:         cp.BLSKeys,
+	}
+	if err := sbf.verifyBLSKeys(); err != nil {
+		return err
+	}
+	sig := &bftcosi.BFTSignature{
+		Sig:             cp.Signature.Sig,
+		Msg:             cp.Hash(),
+		Exceptions:      cp.Signature.Exceptions,
+		Policy:          cp.Signature.Policy,
+		Scheme:          cp.Signature.Scheme,
+		Bitmap:          cp.Signature.Bitmap,
+		ExceptionCommit: cp.Signature.ExceptionCommit,
+	}
+	return sbf.verifySig(sig, cp.Roster)
+}
+
+// VerifyHistory checks that blocks are all the blocks from the genesis
+// block up to the block of the checkpoint, in order.
+func (cp *Checkpoint) VerifyHistory(blocks []*SkipBlock) error {
+	if len(blocks) != cp.Index+1 {
+		return errors.New("Wrong number of blocks")
+	}
+	var history []byte
+	for i, sb := range blocks {
+		if sb.Index != i || !sb.calculateHash().Equal(sb.Hash) {
+			return &ChainError{Position: i, Block: sb.Hash,
+				Reason: "wrong block in history"}
+		}
+		history = HistoryHash(history, sb.Hash)
+	}
+	if !blocks[0].Hash.Equal(cp.Genesis) || !blocks[cp.Index].Hash.Equal(cp.Block) {
+		return errors.New("History doesn't start at genesis or end at checkpoint")
+	}
+	if !SkipBlockID(history).Equal(cp.History) {
+		return errors.New("History doesn't match checkpoint")
+	}
+	return nil
+}
+
+// matches returns an error if the checkpoint doesn't describe sb: the
+// block, its index, its roster and the policy of the SkipChain have to be
+// the same.
+func (cp *Checkpoint) matches(sb *SkipBlock) error {
+	if !sb.Hash.Equal(cp.Block) || sb.Index != cp.Index {
+		return errors.New("Checkpoint is not for this block")
+	}
+	if !sameMembers(cp.Roster, sb.Roster) {
+		return errors.New("Checkpoint has a different roster than its block")
+	}
+	for i, si := range cp.Roster.List {
+		if !si.Public.Equal(sb.Roster.List[i].Public) {
+			return errors.New("Checkpoint has a different roster than its block")
+		}
+	}
+	if cp.MaxExceptions != sb.MaxExceptions ||
+		cp.SignatureScheme != sb.SignatureScheme ||
+		len(cp.BLSKeys) != len(sb.BLSKeys) {
+		return errors.New("Checkpoint has a different policy than its block")
+	}
+	for i, k := range cp.BLSKeys {
+		if !bytes.Equal(k.Public, sb.BLSKeys[i].Public) {
+			return errors.New("Checkpoint has different BLS keys than its block")
+		}
+	}
+	dataHash := sb.PayloadHash
+	if len(dataHash) == 0 {
+		dataHash = HashPayload(sb.Data)
+	}
+	if !bytes.Equal(cp.DataHash, dataHash) {
+		return errors.New("Checkpoint has a different data hash than its block")
+	}
+	return nil
+}
+
+// newCheckpoint returns the unsigned checkpoint of sb. The history is
+// calculated from the latest checkpoint before sb, or from the genesis
+// block.
+func (s *Service) newCheckpoint(sb *SkipBlock) (*Checkpoint, error) {
+	genesis, ok := s.genesisOf(sb)
+	if !ok {
+		return nil, errors.New("Didn't find genesis block")
+	}
+	if sb.Roster == nil {
+		return nil, errors.New("Block has no roster")
+	}
+	cur, ok := s.getSkipBlockByID(genesis)
+	if !ok {
+		return nil, errors.New("Didn't find genesis block")
+	}
+	history := HistoryHash(nil, cur.Hash)
+	if last := s.lastCheckpoint(genesis, sb.Index); last != nil {
+		if cur, ok = s.getSkipBlockByID(last.Block); !ok {
+			return nil, errors.New("Didn't find block of checkpoint")
+		}
+		history = last.History
+	}
+	for cur.Index < sb.Index {
+		if len(cur.ForwardLink) == 0 {
+			return nil, errors.New("Block is not part of the SkipChain")
+		}
+		if cur, ok = s.getSkipBlockByID(cur.ForwardLink[0].Hash); !ok {
+			return nil, errors.New("Missing block in SkipChain")
+		}
+		history = HistoryHash(history, cur.Hash)
+	}
+	if !cur.Hash.Equal(sb.Hash) {
+		return nil, errors.New("Block is not part of the SkipChain")
+	}
+	dataHash := sb.PayloadHash
+	if len(dataHash) == 0 {
+		dataHash = HashPayload(sb.Data)
+	}
+	return &Checkpoint{
+		Genesis:         genesis,
+		Block:           sb.Hash,
+		Index:           sb.Index,
+		Roster:          sb.Roster,
+		MaxExceptions:   sb.MaxExceptions,
+		SignatureScheme: sb.SignatureScheme,
+		BLSKeys:         sb.BLSKeys,
+		DataHash:        dataHash,
+		History:         history,
+	}, nil
+}
+
+// createCheckpoint lets the roster of sb sign its checkpoint and sends it
+// to all members of the roster.
+func (s *Service) createCheckpoint(sb *SkipBlock) error {
+	cp, err := s.newCheckpoint(sb)
+	if err != nil {
+		return err
+	}
+	publics, err := sb.blsPublics(sb.Roster)
+	if err != nil {
+		return err
+	}
+	cp.Signature, err = s.bftSignMsg(cp.Hash(), cp, sb.Roster,
+		sb.allowedExceptions(len(sb.Roster.List)), publics,
+		&signRequest{timeout: sb.signTimeout()})
+	if err != nil {
+		return err
+	}
+	replies, err := manage.PropagateStartAndWait(s.Context, sb.Roster,
+		cp, 120000, s.PropagateSkipBlock)
+	if err != nil {
+		return err
+	}
+	if replies != len(sb.Roster.List) {
+		log.Warn("Did only get", replies, "out of", len(sb.Roster.List))
+	}
+	return nil
+}
+
+// verifyCheckpoint is called by bftVerify when we're asked to sign a
+// checkpoint. It has to be the same as the one we calculate ourselves.
+func (s *Service) verifyCheckpoint(msg []byte, cp *Checkpoint) bool {
+	if !SkipBlockID(msg).Equal(cp.Hash()) {
+		log.Lvl2("Checkpoint message is not its hash")
+		return false
+	}
+	if err := s.checkCheckpoint(cp); err != nil {
+		log.Lvl2(s.ServerIdentity(), "refuses checkpoint:", err)
+		return false
+	}
+	return true
+}
+
+// checkCheckpoint returns an error if the checkpoint, apart from its
+// signature, is not the one we calculate ourselves for its block. So the
+// block has to be a known block of cp.Genesis, and the roster and the
+// policy have to be the ones of that block.
+func (s *Service) checkCheckpoint(cp *Checkpoint) error {
+	sb, ok := s.getSkipBlockByID(cp.Block)
+	if !ok {
+		return errors.New("Don't know block of checkpoint")
+	}
+	own, err := s.newCheckpoint(sb)
+	if err != nil {
+		return err
+	}
+	if !SkipBlockID(own.Hash()).Equal(cp.Hash()) {
+		return errors.New("Checkpoint doesn't match its block")
+	}
+	return nil
+}
+
+// GetCheckpoint returns the latest checkpoint of the SkipChain.
+func (s *Service) GetCheckpoint(gc *GetCheckpoint) (network.Message, onet.ClientError) {
+	cp := s.lastCheckpoint(gc.Genesis, -1)
+	if cp == nil {
+		return nil, onet.NewClientErrorCode(4200, "No checkpoint for this SkipChain")
+	}
+	if err := s.checkCheckpoint(cp); err != nil {
+		return nil, onet.NewClientErrorCode(4200, err.Error())
+	}
+	return &GetCheckpointReply{cp}, nil
+}
+
+// lastCheckpoint returns the latest checkpoint of the SkipChain starting
+// at genesis with an index of at most maxIndex, or any index if maxIndex
+// is negative. It returns nil if there is none.
+func (s *Service) lastCheckpoint(genesis SkipBlockID, maxIndex int) *Checkpoint {
+	s.checkpointsMutex.Lock()
+	defer s.checkpointsMutex.Unlock()
+	var last *Checkpoint
+	for _, cp := range s.checkpoints[string(genesis)] {
+		if (maxIndex < 0 || cp.Index <= maxIndex) &&
+			(last == nil || cp.Index > last.Index) {
+			last = cp
+		}
+	}
+	return last
+}
+
+// addCheckpoint verifies and stores a signed checkpoint. It has to match
+// a known block, so that only the roster of that block can sign it.
+func (s *Service) addCheckpoint(cp *Checkpoint) error {
+	if err := s.checkCheckpoint(cp); err != nil {
+		return err
+	}
+	if err := cp.Verify(); err != nil {
+		return err
+	}
+	s.checkpointsMutex.Lock()
+	defer s.checkpointsMutex.Unlock()
+	for _, c := range s.checkpoints[string(cp.Genesis)] {
+		if c.Index == cp.Index {
+			return nil
+		}
+	}
+	s.checkpoints[string(cp.Genesis)] = append(s.checkpoints[string(cp.Genesis)], cp)
+	s.saveCheckpoints()
+	return nil
+}
+
+// saveCheckpoints saves all checkpoints. checkpointsMutex has to be held.
+func (s *Service) saveCheckpoints() {
+	if s.path == "" {
+		return
+	}
+	cs := &checkpointStorage{}
+	for _, cps := range s.checkpoints {
+		cs.Checkpoints = append(cs.Checkpoints, cps...)
+	}
+	if err := s.Save(checkpointsID, cs); err != nil {
+		log.Error("Couldn't save checkpoints:", err)
+	}
+}
+
+// loadCheckpoints restores the checkpoints stored before.
+func (s *Service) loadCheckpoints() error {
+	if s.path == "" || !s.DataAvailable(checkpointsID) {
+		return nil
+	}
+	msg, err := s.Load(checkpointsID)
+	if err != nil {
+		return err
+	}
+	cs, ok := msg.(*checkpointStorage)
+	if !ok {
+		return errors.New("Data of wrong type")
+	}
+	for _, cp := range cs.Checkpoints {
+		s.checkpoints[string(cp.Genesis)] = append(s.checkpoints[string(cp.Genesis)], cp)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package skipchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestService_Checkpoint(t *testing.T) {
+	defer func(i int) { CheckpointInterval = i }(CheckpointInterval)
+	CheckpointInterval = 2
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	hosts, el, service := makeHELS(local, 3)
+
+	genesis := makeGenesisRosterArgs(service, el, nil, VerifyNone, 1, 3)
+	blocks := []*SkipBlock{genesis}
+	latest := genesis
+	for i := 0; i < 5; i++ {
+		sb := NewSkipBlock()
+		sb.Roster = el
+		psbr, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: latest.Hash, Proposed: sb})
+		log.ErrFatal(cerr)
+		latest = psbr.(*ProposedSkipBlockReply).Latest
+		blocks = append(blocks, latest)
+	}
+
+	c := NewClient()
+	for _, h := range hosts {
+		s := local.Services[h.ServerIdentity.ID][skipchainSID].(*Service)
+		require.NotNil(t, s.lastCheckpoint(genesis.Hash, 2))
+	}
+	cp, err := c.GetCheckpoint(hosts[1].ServerIdentity, genesis.Hash, genesis)
+	log.ErrFatal(err)
+	assert.Equal(t, 4, cp.Index)
+	assert.True(t, cp.Block.Equal(blocks[4].Hash))
+	log.ErrFatal(cp.VerifyHistory(blocks[:5]))
+	assert.NotNil(t, cp.VerifyHistory(blocks[:4]))
+
+	// A client only knowing the checkpoint gets the newest blocks
+	update, err := c.Bootstrap(cp)
+	log.ErrFatal(err)
+	require.Equal(t, 2, len(update))
+	assert.True(t, update[1].Equal(latest))
+
+	// The checkpoint can be updated from the trusted checkpoint
+	cp2, err := c.GetCheckpoint(hosts[1].ServerIdentity, genesis.Hash, update[0])
+	log.ErrFatal(err)
+	assert.Equal(t, cp.Hash(), cp2.Hash())
+
+	// Checkpoints that don't match their block are refused, even if
+	// their roster signed them
+	wrong := *cp
+	wrong.MaxExceptions++
+	assert.NotNil(t, service.addCheckpoint(&wrong))
+	wrong = *cp
+	wrong.Roster = onet.NewRoster(el.List[:2])
+	assert.NotNil(t, service.addCheckpoint(&wrong))
+	assert.NotNil(t, cp.matches(blocks[3]))
+	assert.NotNil(t, wrong.matches(blocks[4]))
+	log.ErrFatal(cp.matches(blocks[4]))
+	other := makeGenesisRosterArgs(service, el, nil, VerifyNone, 1, 3)
+	_, err = c.GetCheckpoint(hosts[1].ServerIdentity, genesis.Hash, other)
+	assert.NotNil(t, err, "Checkpoint not chaining back to trusted block")
+
+	cp.History = HistoryHash(cp.History, latest.Hash)
+	assert.NotNil(t, cp.Verify())
+	assert.NotNil(t, service.addCheckpoint(cp))
+	_, err = c.GetCheckpoint(hosts[1].ServerIdentity, SkipBlockID("unknown"), genesis)
+	assert.NotNil(t, err)
+}
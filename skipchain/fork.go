@@ -0,0 +1,218 @@
+package skipchain
+
+import (
+	"errors"
+
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// ErrorForked is the ClientError-code returned if a block is proposed for a
+// SkipChain where a fork has been detected.
+const ErrorForked = 4203
+
+const forksID = "forks"
+
+// ForkProof shows that the roster of Previous signed two different blocks
+// as its successor. It holds everything needed to verify it, so it can be
+// published and checked by anybody.
+type ForkProof struct {
+	// Previous is the block both conflicting blocks follow
+	Previous *SkipBlock
+	// First and Second have the same index and point back to Previous
+	First  *SkipBlock
+	Second *SkipBlock
+	// FirstLink and SecondLink are the signatures of the roster of
+	// Previous on First and Second
+	FirstLink  *BlockLink
+	SecondLink *BlockLink
+}
+
+// forkStorage is used to save the detected forks.
+type forkStorage struct {
+	Proofs []*ForkProof
+}
+
+// NewForkProof returns the proof that first and second are both signed as
+// the successor of the same block. The signatures are taken from the
+// forward-links of the given copies of that block, or from the blocks
+// themselves if the roster didn't change.
+func NewForkProof(first, second *SkipBlock, previous ...*SkipBlock) (*ForkProof, error) {
+	if len(previous) == 0 {
+		return nil, errors.New("Need the previous block")
+	}
+	fp := &ForkProof{
+		Previous:   previous[0],
+		First:      first,
+		Second:     second,
+		FirstLink:  findLink(first, previous),
+		SecondLink: findLink(second, previous),
+	}
+	if err := fp.Verify(); err != nil {
+		return nil, err
+	}
+	return fp, nil
+}
+
+// findLink returns the signature of the roster of the previous block on sb.
+func findLink(sb *SkipBlock, previous []*SkipBlock) *BlockLink {
+	for _, prev := range previous {
+		if len(prev.ForwardLink) > 0 && prev.ForwardLink[0].Hash.Equal(sb.Hash) {
+			return prev.ForwardLink[0]
+		}
+	}
+	if sb.BlockSig == nil {
+		return nil
+	}
+	return newLink(sb.Hash, sb.BlockSig)
+}
+
+// Verify checks that both blocks are different successors of Previous and
+// are signed by its roster.
+func (fp *ForkProof) Verify() error {
+	if fp.Previous == nil || fp.First == nil || fp.Second == nil {
+		return errors.New("Missing block in fork proof")
+	}
+	if fp.FirstLink == nil || fp.SecondLink == nil {
+		return errors.New("Missing signature in fork proof")
+	}
+	if fp.Previous.Roster == nil {
+		return errors.New("Previous block has no roster")
+	}
+	for _, sb := range []*SkipBlock{fp.Previous, fp.First, fp.Second} {
+		if !sb.calculateHash().Equal(sb.Hash) {
+			return errors.New("Wrong hash of block in fork proof")
+		}
+	}
+	if fp.First.Hash.Equal(fp.Second.Hash) {
+		return errors.New("Both blocks are the same")
+	}
+	for _, sb := range []*SkipBlock{fp.First, fp.Second} {
+		if sb.Index != fp.Previous.Index+1 || len(sb.BackLinkIds) == 0 ||
+			!sb.BackLinkIds[0].Equal(fp.Previous.Hash) {
+			return errors.New("Block doesn't follow the previous block")
+		}
+	}
+	if !fp.FirstLink.Hash.Equal(fp.First.Hash) ||
+		!fp.SecondLink.Hash.Equal(fp.Second.Hash) {
+		return errors.New("Signature is not on the block")
+	}
+	if err := fp.Previous.verifyLink(fp.FirstLink); err != nil {
+		return err
+	}
+	return fp.Previous.verifyLink(fp.SecondLink)
+}
+
+// GetForkProofs returns the proofs of all forks detected in the SkipChain
+// starting at Genesis, or in all SkipChains if Genesis is nil.
+func (s *Service) GetForkProofs(gfp *GetForkProofs) (network.Message, onet.ClientError) {
+	s.forksMutex.Lock()
+	defer s.forksMutex.Unlock()
+	reply := &GetForkProofsReply{}
+	for genesis, proofs := range s.forks {
+		if gfp.Genesis.IsNull() || genesis == string(gfp.Genesis) {
+			reply.Proofs = append(reply.Proofs, proofs...)
+		}
+	}
+	return reply, nil
+}
+
+// detectFork checks whether sb conflicts with the blocks we hold: either it
+// is another successor of a block that already has one, or it is a copy of
+// a block we know with a forward-link to another successor. copies are
+// other versions of the previous block of sb, e.g. received along with it.
+// It returns nil if there is no conflict or if it can't be proven.
+func (s *Service) detectFork(sb *SkipBlock, copies ...*SkipBlock) *ForkProof {
+	var first, second *SkipBlock
+	var previous []*SkipBlock
+	if sb.Index > 0 && len(sb.BackLinkIds) > 0 {
+		prev, ok := s.getSkipBlockByID(sb.BackLinkIds[0])
+		if ok && len(prev.ForwardLink) > 0 &&
+			!prev.ForwardLink[0].Hash.Equal(sb.Hash) {
+			first, _ = s.getSkipBlockByID(prev.ForwardLink[0].Hash)
+			second = sb
+			previous = append([]*SkipBlock{prev}, copies...)
+		}
+	}
+	if local, ok := s.getSkipBlockByID(sb.Hash); ok && first == nil &&
+		len(local.ForwardLink) > 0 && len(sb.ForwardLink) > 0 &&
+		!local.ForwardLink[0].Hash.Equal(sb.ForwardLink[0].Hash) {
+		first, _ = s.getSkipBlockByID(local.ForwardLink[0].Hash)
+		second, _ = s.getSkipBlockByID(sb.ForwardLink[0].Hash)
+		previous = []*SkipBlock{local, sb}
+	}
+	if first == nil || second == nil {
+		return nil
+	}
+	fp, err := NewForkProof(first, second, previous...)
+	if err != nil {
+		log.Lvl2(s.ServerIdentity(), "couldn't prove conflicting block:", err)
+		return nil
+	}
+	return fp
+}
+
+// addFork stores the proof of a fork, so that the SkipChain isn't extended
+// anymore.
+func (s *Service) addFork(fp *ForkProof) {
+	genesis, ok := s.genesisOf(fp.Previous)
+	if !ok {
+		log.Error("Don't know genesis block of fork")
+		return
+	}
+	log.Errorf("%s: detected fork after block %x with index %d",
+		s.ServerIdentity(), fp.Previous.Hash, fp.Previous.Index)
+	s.forksMutex.Lock()
+	defer s.forksMutex.Unlock()
+	for _, p := range s.forks[string(genesis)] {
+		if p.Previous.Hash.Equal(fp.Previous.Hash) {
+			return
+		}
+	}
+	s.forks[string(genesis)] = append(s.forks[string(genesis)], fp)
+	s.saveForks()
+}
+
+// isForked returns whether a fork has been detected in the SkipChain
+// starting at genesis.
+func (s *Service) isForked(genesis SkipBlockID) bool {
+	s.forksMutex.Lock()
+	defer s.forksMutex.Unlock()
+	return len(s.forks[string(genesis)]) > 0
+}
+
+// saveForks saves the proofs of all forks. forksMutex has to be held.
+func (s *Service) saveForks() {
+	if s.path == "" {
+		return
+	}
+	fs := &forkStorage{}
+	for _, proofs := range s.forks {
+		fs.Proofs = append(fs.Proofs, proofs...)
+	}
+	if err := s.Save(forksID, fs); err != nil {
+		log.Error("Couldn't save forks:", err)
+	}
+}
+
+// loadForks restores the proofs of the forks detected before.
+func (s *Service) loadForks() error {
+	if s.path == "" || !s.DataAvailable(forksID) {
+		return nil
+	}
+	msg, err := s.Load(forksID)
+	if err != nil {
+		return err
+	}
+	fs, ok := msg.(*forkStorage)
+	if !ok {
+		return errors.New("Data of wrong type")
+	}
+	for _, fp := range fs.Proofs {
+		if genesis, ok := s.genesisOf(fp.Previous); ok {
+			s.forks[string(genesis)] = append(s.forks[string(genesis)], fp)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package skipchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestService_Fork(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	hosts, el, s1 := makeHELS(local, 3)
+	var services []*Service
+	for _, h := range hosts {
+		services = append(services, local.Services[h.ServerIdentity.ID][skipchainSID].(*Service))
+	}
+
+	genesis := makeGenesisRosterArgs(s1, el, nil, VerifyNone, 2, 3)
+	sb := NewSkipBlock()
+	sb.Roster = el
+	sb.Data = []byte("first")
+	psbr, cerr := s1.ProposeSkipBlock(&ProposeSkipBlock{LatestID: genesis.Hash, Proposed: sb})
+	log.ErrFatal(cerr)
+	first := psbr.(*ProposedSkipBlockReply).Latest
+
+	// A compromised roster forgets about the first block and signs another
+	// one with the same index.
+	for _, s := range services {
+		s.db = &SkipBlockMap{SkipBlocks: make(map[string]*SkipBlock)}
+		s.tips = make(map[string]*ChainTip)
+		g := genesis.Copy()
+		g.ForwardLink = nil
+		log.ErrFatal(s.storeSkipBlock(g))
+	}
+	sb = NewSkipBlock()
+	sb.Roster = el
+	sb.Data = []byte("second")
+	psbr, cerr = s1.ProposeSkipBlock(&ProposeSkipBlock{LatestID: genesis.Hash, Proposed: sb})
+	log.ErrFatal(cerr)
+	second := psbr.(*ProposedSkipBlockReply).Latest
+	require.Equal(t, first.Index, second.Index)
+
+	s1.PropagateSkipBlock(first)
+	_, ok := s1.getSkipBlockByID(first.Hash)
+	assert.False(t, ok, "Conflicting block shouldn't be stored")
+	require.True(t, s1.isForked(genesis.Hash))
+
+	_, cerr = s1.ProposeSkipBlock(&ProposeSkipBlock{LatestID: second.Hash, Proposed: NewSkipBlock()})
+	require.NotNil(t, cerr)
+	assert.Equal(t, ErrorForked, cerr.ErrorCode())
+
+	proofs, err := NewClient().GetForkProofs(hosts[0].ServerIdentity, genesis.Hash)
+	log.ErrFatal(err)
+	require.Equal(t, 1, len(proofs))
+	fp := proofs[0]
+	log.ErrFatal(fp.Verify())
+	assert.True(t, fp.Previous.Hash.Equal(genesis.Hash))
+	assert.True(t, fp.First.Hash.Equal(second.Hash))
+	assert.True(t, fp.Second.Hash.Equal(first.Hash))
+
+	proofs, err = NewClient().GetForkProofs(hosts[0].ServerIdentity, first.Hash)
+	log.ErrFatal(err)
+	assert.Equal(t, 0, len(proofs))
+
+	// Tampered proofs don't verify
+	fp.Second = fp.First
+	fp.SecondLink = fp.FirstLink
+	require.NotNil(t, fp.Verify())
+	_, err = NewForkProof(second, first)
+	require.NotNil(t, err)
+	sb = first.Copy()
+	sb.Data = []byte("third")
+	sb.updateHash()
+	_, err = NewForkProof(second, sb, genesis)
+	require.NotNil(t, err, "Unsigned block can't be part of a fork")
+}
@@ -0,0 +1,212 @@
+package skipchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/dedis/paper_chainiac/bftcosi"
+	"golang.org/x/crypto/blake2b"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Versions of the format of the hashed part of a SkipBlock. The version is
+// fixed in the genesis block, so every SkipChain keeps the format it has
+// been created with. A field added to SkipBlockFix needs a new version
+// that adds it to the canonical encoding, and older versions refuse
+// blocks where it is set, so that it can't change without changing the
+// hash.
+const (
+	// BlockVersionLegacy hashes the protobuf-encoding of SkipBlockFix
+	// with SHA-256.
+	BlockVersionLegacy = 0
+	// BlockVersionCanonical hashes a canonical encoding of SkipBlockFix
+	// with the HashAlgorithm of the SkipChain.
+	BlockVersionCanonical = 1
+	// BlockVersionSigning adds SignTimeout, SignatureScheme and BLSKeys
+	// to the canonical encoding.
+	BlockVersionSigning = 2
+	// CurrentBlockVersion is used for new SkipChains.
+	CurrentBlockVersion = BlockVersionSigning
+)
+
+// HashAlgorithm is the hash function used for the blocks of a SkipChain
+// with BlockVersionCanonical.
+type HashAlgorithm int
+
+// The supported hash functions, all with 32 bytes of output.
+const (
+	HashSHA256 HashAlgorithm = iota
+	HashSHA512_256
+	HashBLAKE2b
+)
+
+// New returns a new instance of the hash function.
+func (ha HashAlgorithm) New() (hash.Hash, error) {
+	switch ha {
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashSHA512_256:
+		return sha512.New512_256(), nil
+	case HashBLAKE2b:
+		return blake2b.New256(nil)
+	}
+	return nil, fmt.Errorf("Unknown hash algorithm %d", ha)
+}
+
+// verifyFormat checks that the version and the hash algorithm of the block
+// are supported.
+func (sbf *SkipBlockFix) verifyFormat() error {
+	switch sbf.Version {
+	case BlockVersionLegacy:
+		if sbf.HashAlgorithm != HashSHA256 {
+			return errors.New("Legacy blocks only support SHA-256")
+		}
+		return sbf.verifyNoSigning()
+	case BlockVersionCanonical:
+		if err := sbf.verifyNoSigning(); err != nil {
+			return err
+		}
+		_, err := sbf.HashAlgorithm.New()
+		return err
+	case BlockVersionSigning:
+		if sbf.SignatureScheme != bftcosi.SchemeCoSi &&
+			sbf.SignatureScheme != bftcosi.SchemeBLS {
+			return fmt.Errorf("Unknown signature scheme %d", sbf.SignatureScheme)
+		}
+		_, err := sbf.HashAlgorithm.New()
+		return err
+	}
+	return fmt.Errorf("Unknown block version %d", sbf.Version)
+}
+
+// verifyNoSigning checks that the fields added in BlockVersionSigning are
+// not set in blocks of older versions.
+func (sbf *SkipBlockFix) verifyNoSigning() error {
+	if sbf.SignTimeout != 0 || sbf.SignatureScheme != bftcosi.SchemeCoSi ||
+		len(sbf.BLSKeys) > 0 {
+		return fmt.Errorf("Block version %d only supports CoSi without timeout",
+			sbf.Version)
+	}
+	return nil
+}
+
+// hash returns the hash of the block in the format of its version.
+func (sbf *SkipBlockFix) hash() (SkipBlockID, error) {
+	if err := sbf.verifyFormat(); err != nil {
+		return nil, err
+	}
+	switch sbf.Version {
+	case BlockVersionLegacy:
+		b, err := network.Marshal(sbf)
+		if err != nil {
+			return nil, err
+		}
+		return crypto.HashBytes(network.Suite.Hash(), b)
+	default:
+		h, err := sbf.HashAlgorithm.New()
+		if err != nil {
+			return nil, err
+		}
+		b, err := sbf.canonicalEncoding()
+		if err != nil {
+			return nil, err
+		}
+		h.Write(b)
+		return h.Sum(nil), nil
+	}
+}
+
+// canonicalEncoding returns a deterministic encoding of all fields of the
+// block that its version knows, in the order they are declared. Integers
+// are 8 bytes big-endian, byte-slices and lists are prefixed with their
+// length and missing pointers are encoded as an empty byte-slice.
+func (sbf *SkipBlockFix) canonicalEncoding() ([]byte, error) {
+	e := &canonicalEncoder{}
+	e.bytes([]byte("SkipBlockFix"))
+	e.int(int64(sbf.Version))
+	e.int(int64(sbf.HashAlgorithm))
+	e.int(int64(sbf.Index))
+	e.int(int64(sbf.Height))
+	e.int(int64(sbf.MaximumHeight))
+	e.int(int64(sbf.BaseHeight))
+	e.int(int64(len(sbf.BackLinkIds)))
+	for _, bl := range sbf.BackLinkIds {
+		e.bytes(bl)
+	}
+	e.bytes(sbf.VerifierID[:])
+	e.bytes(sbf.ParentBlockID)
+	e.point(sbf.Aggregate)
+	e.point(sbf.AggregateResp)
+	e.bytes(sbf.Data)
+	e.roster(sbf.Roster)
+	e.int(sbf.Timestamp)
+	e.int(int64(sbf.MaxExceptions))
+	e.bytes(sbf.PayloadHash)
+	if sbf.Version >= BlockVersionSigning {
+		e.int(sbf.SignTimeout)
+		e.int(int64(sbf.SignatureScheme))
+		e.int(int64(len(sbf.BLSKeys)))
+		for _, k := range sbf.BLSKeys {
+			if k == nil {
+				e.bytes(nil)
+				e.bytes(nil)
+				continue
+			}
+			e.bytes(k.Public)
+			e.bytes(k.Possession)
+		}
+	}
+	return e.buf.Bytes(), e.err
+}
+
+// canonicalEncoder writes the canonical encoding and remembers the first
+// error.
+type canonicalEncoder struct {
+	buf bytes.Buffer
+	err error
+}
+
+func (e *canonicalEncoder) int(i int64) {
+	binary.Write(&e.buf, binary.BigEndian, i)
+}
+
+func (e *canonicalEncoder) bytes(b []byte) {
+	e.int(int64(len(b)))
+	e.buf.Write(b)
+}
+
+func (e *canonicalEncoder) point(p abstract.Point) {
+	if p == nil {
+		e.bytes(nil)
+		return
+	}
+	b, err := p.MarshalBinary()
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+	e.bytes(b)
+}
+
+func (e *canonicalEncoder) roster(r *onet.Roster) {
+	if r == nil {
+		e.int(-1)
+		return
+	}
+	e.int(int64(len(r.List)))
+	e.bytes(r.ID[:])
+	for _, si := range r.List {
+		e.point(si.Public)
+		e.bytes(si.ID[:])
+		e.bytes([]byte(si.Address))
+		e.bytes([]byte(si.Description))
+	}
+	e.point(r.Aggregate)
+}
@@ -0,0 +1,84 @@
+package skipchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func TestSkipBlock_HashVersion(t *testing.T) {
+	local := onet.NewLocalTest()
+	_, el, _ := local.GenTree(3, false, false, false)
+	defer local.CloseAll()
+	sb := NewSkipBlock()
+	sb.Roster = el
+	sb.Data = []byte("data")
+	assert.Equal(t, CurrentBlockVersion, sb.Version)
+
+	// Legacy blocks keep their hash
+	sb.Version = BlockVersionLegacy
+	b, err := network.Marshal(sb.SkipBlockFix)
+	log.ErrFatal(err)
+	legacy, err := crypto.HashBytes(network.Suite.Hash(), b)
+	log.ErrFatal(err)
+	assert.Equal(t, SkipBlockID(legacy), sb.calculateHash())
+	sb.HashAlgorithm = HashBLAKE2b
+	assert.Nil(t, sb.calculateHash(), "Legacy blocks only use SHA-256")
+
+	// Every algorithm gives a different hash, always the same one
+	sb.Version = BlockVersionCanonical
+	hashes := map[string]bool{string(legacy): true}
+	for _, ha := range []HashAlgorithm{HashSHA256, HashSHA512_256, HashBLAKE2b} {
+		sb.HashAlgorithm = ha
+		h := sb.calculateHash()
+		require.Equal(t, 32, len(h))
+		assert.Equal(t, h, sb.Copy().calculateHash())
+		assert.False(t, hashes[string(h)])
+		hashes[string(h)] = true
+	}
+	sb.HashAlgorithm = HashBLAKE2b + 1
+	assert.Nil(t, sb.calculateHash())
+	sb.HashAlgorithm = HashSHA256
+
+	// Fields of newer versions can't be set in older ones, and are part
+	// of the hash in the newer ones
+	sb.SignTimeout = 1000
+	assert.Nil(t, sb.calculateHash(), "SignTimeout in canonical block")
+	sb.Version = BlockVersionLegacy
+	assert.Nil(t, sb.calculateHash(), "SignTimeout in legacy block")
+	sb.Version = BlockVersionSigning
+	h := sb.calculateHash()
+	require.NotNil(t, h)
+	sb.SignTimeout = 2000
+	assert.NotEqual(t, h, sb.calculateHash())
+
+	sb.Version = CurrentBlockVersion + 1
+	assert.Nil(t, sb.calculateHash())
+}
+
+func TestClient_HashAlgorithm(t *testing.T) {
+	l := onet.NewLocalTest()
+	_, el, _ := l.GenTree(3, true, true, true)
+	defer l.CloseAll()
+
+	c := NewClient()
+	c.HashAlgorithm = HashBLAKE2b
+	genesis, err := c.CreateRoster(el, 1, 1, VerifyNone, nil)
+	log.ErrFatal(err)
+	assert.Equal(t, HashBLAKE2b, genesis.HashAlgorithm)
+	reply, err := c.ProposeRoster(genesis, el)
+	log.ErrFatal(err)
+	assert.Equal(t, HashBLAKE2b, reply.Latest.HashAlgorithm)
+	update, err := c.GetVerifiedUpdateChain(genesis)
+	log.ErrFatal(err)
+	assert.Equal(t, 2, len(update))
+
+	c.HashAlgorithm = HashBLAKE2b + 1
+	_, err = c.CreateRoster(el, 1, 1, VerifyNone, nil)
+	assert.NotNil(t, err)
+}
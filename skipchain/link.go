@@ -0,0 +1,104 @@
+package skipchain
+
+import (
+	"errors"
+
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// childLinkMsg returns what the roster of the parent signs to link a child
+// SkipChain. It is different from the hash of the child, so that the
+// signature can't be taken for a forward-link.
+func childLinkMsg(parent, child SkipBlockID) []byte {
+	h := network.Suite.Hash()
+	h.Write([]byte("ChildSL"))
+	h.Write(parent)
+	h.Write(child)
+	return h.Sum(nil)
+}
+
+// verifyChildSL checks the signature of the roster of sb on its ChildSL.
+func (sb *SkipBlock) verifyChildSL() error {
+	if len(sb.ChildSL.Signature) < 64 {
+		return errors.New("Missing signature on child-link")
+	}
+	return sb.verifySig(sb.ChildSL.signature(childLinkMsg(sb.Hash, sb.ChildSL.Hash)),
+		sb.Roster)
+}
+
+// VerifyChildLink checks that child is the genesis-block of a SkipChain
+// created with parent as its parent and that the roster of parent signed
+// the link to child.
+func VerifyChildLink(parent, child *SkipBlock) error {
+	if !parent.calculateHash().Equal(parent.Hash) ||
+		!child.calculateHash().Equal(child.Hash) {
+		return errors.New("Wrong hash of block")
+	}
+	if child.Index != 0 {
+		return errors.New("Child is not a genesis block")
+	}
+	if !child.ParentBlockID.Equal(parent.Hash) {
+		return errors.New("Child doesn't point to parent")
+	}
+	if parent.ChildSL == nil || !parent.ChildSL.Hash.Equal(child.Hash) {
+		return errors.New("Parent doesn't point to child")
+	}
+	if parent.Roster == nil {
+		return errors.New("Parent has no roster")
+	}
+	return parent.verifyChildSL()
+}
+
+// VerifyHierarchy checks a path of SkipBlocks like root, control and data
+// created by CreateRootControl and CreateData: every block has to be the
+// genesis-block of a child SkipChain of the block before and be signed by
+// its roster. The first block has to be trusted by the caller.
+func VerifyHierarchy(blocks ...*SkipBlock) error {
+	if len(blocks) == 0 {
+		return errors.New("Empty hierarchy")
+	}
+	for i, child := range blocks[1:] {
+		if err := VerifyChildLink(blocks[i], child); err != nil {
+			return &ChainError{Position: i + 1, Block: child.Hash,
+				Reason: err.Error()}
+		}
+		if child.Roster == nil {
+			return errors.New("Child has no roster")
+		}
+		if err := verifyBlockSig(child, child.Roster); err != nil {
+			return &ChainError{Position: i + 1, Block: child.Hash,
+				Reason: err.Error()}
+		}
+	}
+	return nil
+}
+
+// verifyLinkChild is called by bftVerify when we're asked to sign the
+// link from a parent block to a child SkipChain.
+func (s *Service) verifyLinkChild(msg []byte, lc *LinkChild) bool {
+	parent, ok := s.getSkipBlockByID(lc.Parent)
+	if !ok {
+		log.Lvl2(s.ServerIdentity(), "doesn't know parent block")
+		return false
+	}
+	child := lc.Child
+	if !SkipBlockID(msg).Equal(childLinkMsg(parent.Hash, child.Hash)) {
+		log.Lvl2("Child-link message is not on parent and child")
+		return false
+	}
+	if parent.ChildSL != nil && !parent.ChildSL.Hash.Equal(child.Hash) {
+		log.Lvl2(s.ServerIdentity(), "refuses second child")
+		return false
+	}
+	if child.Index != 0 || !child.ParentBlockID.Equal(parent.Hash) ||
+		!child.calculateHash().Equal(child.Hash) || child.Roster == nil {
+		log.Lvl2(s.ServerIdentity(), "refuses invalid child")
+		return false
+	}
+	if err := verifyBlockSig(child, child.Roster); err != nil {
+		log.Lvl2(s.ServerIdentity(), "refuses child:", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package skipchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestService_LinkChild(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	hosts, el, service := makeHELS(local, 3)
+
+	root := makeGenesisRoster(service, el)
+	child := makeGenesisRosterArgs(service, el, root.Hash, VerifyNone, 1, 1)
+	other := makeGenesisRosterArgs(service, el, root.Hash, VerifyNone, 1, 1)
+	orphan := makeGenesisRoster(service, el)
+
+	_, cerr := service.SetChildrenSkipBlock(&SetChildrenSkipBlock{root.Hash, orphan.Hash})
+	require.NotNil(t, cerr, "Child has to point to the parent")
+
+	m, cerr := service.SetChildrenSkipBlock(&SetChildrenSkipBlock{root.Hash, child.Hash})
+	log.ErrFatal(cerr)
+	reply := m.(*SetChildrenSkipBlockReply)
+	assert.True(t, reply.Child.Equal(child))
+	assert.True(t, child.calculateHash().Equal(child.Hash))
+	log.ErrFatal(VerifyChildLink(reply.Parent, reply.Child))
+	log.ErrFatal(reply.Parent.VerifySignatures())
+	for _, h := range hosts {
+		s := local.Services[h.ServerIdentity.ID][skipchainSID].(*Service)
+		sb, ok := s.getSkipBlockByID(root.Hash)
+		require.True(t, ok)
+		require.NotNil(t, sb.ChildSL)
+		log.ErrFatal(VerifyChildLink(sb, child))
+	}
+
+	// Linking the same child again returns the link, another child is
+	// refused.
+	m, cerr = service.SetChildrenSkipBlock(&SetChildrenSkipBlock{root.Hash, child.Hash})
+	log.ErrFatal(cerr)
+	assert.Equal(t, reply.Parent.ChildSL, m.(*SetChildrenSkipBlockReply).Parent.ChildSL)
+	_, cerr = service.SetChildrenSkipBlock(&SetChildrenSkipBlock{root.Hash, other.Hash})
+	require.NotNil(t, cerr)
+
+	// The signature of the child-link can't be used as a forward-link
+	fl := &BlockLink{Hash: child.Hash, Signature: reply.Parent.ChildSL.Signature}
+	require.NotNil(t, fl.VerifySignature(el.Publics()))
+	parent := reply.Parent.Copy()
+	parent.ChildSL.Hash = other.Hash
+	require.NotNil(t, VerifyChildLink(parent, other))
+	require.NotNil(t, parent.VerifySignatures())
+}
+
+func TestClient_VerifyHierarchy(t *testing.T) {
+	l := onet.NewLocalTest()
+	_, el, _ := l.GenTree(3, true, true, true)
+	defer l.CloseAll()
+
+	c := NewClient()
+	root, control, err := c.CreateRootControl(el, el, 1, 1, 1, VerifyNone)
+	log.ErrFatal(err)
+	control, data, err := c.CreateData(control, 1, 1, VerifyNone, &testData{1, "data"})
+	log.ErrFatal(err)
+	log.ErrFatal(VerifyHierarchy(root, control, data))
+	log.ErrFatal(VerifyHierarchy(control, data))
+	require.NotNil(t, VerifyHierarchy(root, data))
+	require.NotNil(t, VerifyHierarchy(data, control))
+}
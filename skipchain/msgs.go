@@ -1,9 +1,6 @@
 package skipchain
 
 import (
-	"sync"
-
-	"github.com/dedis/paper_chainiac/bftcosi"
 	"github.com/satori/go.uuid"
 	"gopkg.in/dedis/onet.v1/network"
 )
@@ -20,9 +17,48 @@ func init() {
 		// Requests for data
 		&GetUpdateChain{},
 		&GetUpdateChainReply{},
+		&ListVerifiers{},
+		&ListVerifiersReply{},
+		&ListChains{},
+		&ListChainsReply{},
+		&GetBlockByIndex{},
+		&GetBlockByIndexReply{},
+		&GetBlockAtTime{},
+		&GetBlockAtTimeReply{},
+		&GetProof{},
+		&GetProofReply{},
+		&GetChildrenSkipList{},
+		&GetChildrenSkipListReply{},
+		&GetForkProofs{},
+		&GetForkProofsReply{},
+		&Subscribe{},
+		&SubscribeReply{},
+		&PutBlob{},
+		&PutBlobReply{},
+		&GetBlob{},
+		&GetBlobReply{},
+		&GetCheckpoint{},
+		&GetCheckpointReply{},
+		&GetStoreStats{},
+		&GetStoreStatsReply{},
+		&CancelProposal{},
+		&CancelProposalReply{},
+		&GetBLSKey{},
+		&GetBLSKeyReply{},
+		// Synchronisation between conodes
+		&GetChainTips{},
+		&GetChainTipsReply{},
+		&GetBlocks{},
+		&GetBlocksReply{},
 		// Data-structures
 		&ForwardSignature{},
+		&LinkChild{},
+		&ForkProof{},
+		&Checkpoint{},
+		&ArchiveManifest{},
+		&ArchivePayload{},
 		&SkipBlockFix{},
+		&BLSKey{},
 		&SkipBlock{},
 		// Own service
 		&Service{},
@@ -36,21 +72,6 @@ func init() {
 // deny a SkipBlock.
 type VerifierID uuid.UUID
 
-var verifiers map[VerifierID]bftcosi.VerificationFunction
-var verifiersMutex sync.Mutex
-
-// RegisterVerification stores the verification in a map and will
-// call it whenever a verification needs to be done.
-func VerificationRegistration(v VerifierID, f bftcosi.VerificationFunction) error {
-	verifiersMutex.Lock()
-	if len(verifiers) == 0 {
-		verifiers = map[VerifierID]bftcosi.VerificationFunction{}
-	}
-	verifiers[v] = f
-	verifiersMutex.Unlock()
-	return nil
-}
-
 var (
 	// VerifyNone does only basic syntax checking
 	VerifyNone = VerifierID(uuid.Nil)
@@ -77,9 +98,15 @@ var (
 // is invalid), a new SkipChain will be created.
 // The AppId will be used to call the corresponding verification-
 // routines who will have to sign off on the new Tree.
+// Timeout is how many milliseconds the leader waits for the signature of
+// the roster - it can only be shorter than the timeout of the SkipChain.
 type ProposeSkipBlock struct {
 	LatestID SkipBlockID
 	Proposed *SkipBlock
+	Timeout  int64
+	// CancelHash is the CancelHash of the secret needed to cancel the
+	// proposal. If it is empty, the proposal can't be cancelled.
+	CancelHash []byte
 }
 
 // ProposedSkipBlockReply - returns the signed SkipBlock with updated backlinks
@@ -101,6 +128,16 @@ type GetUpdateChainReply struct {
 	Update []*SkipBlock
 }
 
+// ListVerifiers asks for all verifiers registered on a conode.
+type ListVerifiers struct {
+}
+
+// ListVerifiersReply returns the description of all verifiers the conode
+// knows of.
+type ListVerifiersReply struct {
+	Verifiers []*VerifierInfo
+}
+
 // SetChildrenSkipBlock adds a link to a child-SkipBlock in the
 // parent-SkipBlock
 type SetChildrenSkipBlock struct {
@@ -115,23 +152,226 @@ type SetChildrenSkipBlockReply struct {
 	Child  *SkipBlock
 }
 
-// GetChildrenSkipList - if the SkipList doesn't exist yet, creates the
-// Genesis-block of that SkipList.
-// It returns a 'GetUpdateChainReply' with the chain from the first to
-// the last SkipBlock.
-type GetChildrenSkipList struct {
-	Current    *SkipBlock
+// ListChains asks for all SkipChains a conode holds.
+type ListChains struct {
+}
+
+// ChainInfo describes a SkipChain held by a conode.
+type ChainInfo struct {
+	Genesis    SkipBlockID
 	VerifierID VerifierID
+	// Latest is the latest block known to the conode and Index its index
+	Latest SkipBlockID
+	Index  int
+}
+
+// ListChainsReply returns all SkipChains of a conode.
+type ListChainsReply struct {
+	Chains []*ChainInfo
+}
+
+// GetBlockByIndex asks for the block with the given index in the SkipChain
+// starting with Genesis.
+type GetBlockByIndex struct {
+	Genesis SkipBlockID
+	Index   int
+}
+
+// GetBlockByIndexReply returns the shortest chain of SkipBlocks from the
+// genesis-block to the requested block, which is the last one.
+type GetBlockByIndexReply struct {
+	Proof []*SkipBlock
+}
+
+// GetBlockAtTime asks for the latest block of the SkipChain starting with
+// Genesis that has been proposed at or before Time, given in nanoseconds
+// since the Unix epoch.
+type GetBlockAtTime struct {
+	Genesis SkipBlockID
+	Time    int64
+}
+
+// GetBlockAtTimeReply returns the shortest chain of SkipBlocks from the
+// genesis-block to the requested block, which is the last one. Next is the
+// block following the requested one, which proves that no later block
+// exists before Time. It is nil if the requested block is the latest one.
+type GetBlockAtTimeReply struct {
+	Proof []*SkipBlock
+	Next  *SkipBlock
+}
+
+// GetProof asks for the shortest chain of SkipBlocks going from From to the
+// newer block To.
+type GetProof struct {
+	From SkipBlockID
+	To   SkipBlockID
+}
+
+// GetProofReply returns the chain of SkipBlocks from From to To. It can be
+// verified using VerifyChain.
+type GetProofReply struct {
+	Proof []*SkipBlock
+}
+
+// GetChildrenSkipList asks for the SkipChains that have the given
+// roster-block as parent.
+type GetChildrenSkipList struct {
+	ParentID SkipBlockID
+}
+
+// GetChildrenSkipListReply returns the genesis-blocks of all children.
+type GetChildrenSkipListReply struct {
+	Children []*SkipBlock
+}
+
+// GetForkProofs asks for the proofs of all forks detected in the SkipChain
+// starting at Genesis. If Genesis is nil, the proofs of all SkipChains are
+// returned.
+type GetForkProofs struct {
+	Genesis SkipBlockID
+}
+
+// GetForkProofsReply returns the proofs of the detected forks.
+type GetForkProofsReply struct {
+	Proofs []*ForkProof
+}
+
+// Subscribe asks for the blocks added after the given latest blocks of one
+// or more SkipChains. To get all blocks of a SkipChain, Latest holds its
+// genesis-block. If there are no new blocks, the conode waits some time for
+// them.
+type Subscribe struct {
+	Latest []SkipBlockID
+}
+
+// SubscribeReply holds an update for every SkipChain with new blocks. It
+// is empty if no block has been added in time.
+type SubscribeReply struct {
+	Updates []*SubscribeUpdate
+}
+
+// SubscribeUpdate holds the current version of a latest block of the
+// request, followed by the blocks added after it.
+type SubscribeUpdate struct {
+	Blocks []*SkipBlock
+}
+
+// PutBlob stores a payload in the blob store of a conode.
+type PutBlob struct {
+	Blob []byte
+}
+
+// PutBlobReply returns the hash of the stored payload.
+type PutBlobReply struct {
+	Hash []byte
+}
+
+// GetBlob asks for the payload with the given hash.
+type GetBlob struct {
+	Hash []byte
+}
+
+// GetBlobReply returns the payload.
+type GetBlobReply struct {
+	Blob []byte
+}
+
+// GetCheckpoint asks for the latest checkpoint of a SkipChain.
+type GetCheckpoint struct {
+	Genesis SkipBlockID
+}
+
+// GetCheckpointReply returns the latest checkpoint.
+type GetCheckpointReply struct {
+	Checkpoint *Checkpoint
+}
+
+// GetStoreStats asks a conode how many SkipBlocks it stores and how much
+// memory it uses for them.
+type GetStoreStats struct {
+}
+
+// GetStoreStatsReply holds the number of SkipBlocks and the metrics of the
+// cache, which is nil if all blocks are kept in memory.
+type GetStoreStatsReply struct {
+	Blocks int
+	Cache  *CacheStats
+}
+
+// CancelProposal stops the proposal of a block after LatestID that is in
+// progress on the conode. Secret has to match the CancelHash of the
+// proposal.
+type CancelProposal struct {
+	LatestID SkipBlockID
+	Secret   []byte
+}
+
+// CancelProposalReply is returned if a proposal has been cancelled.
+type CancelProposalReply struct {
+}
+
+// GetBLSKey asks a conode for its BLS key, which is needed to create
+// SkipChains signing with bftcosi.SchemeBLS.
+type GetBLSKey struct {
+}
+
+// GetBLSKeyReply holds the BLS key of the conode.
+type GetBLSKeyReply struct {
+	Key *BLSKey
 }
 
 // Internal calls
 
+// GetChainTips asks a conode for the latest block it knows of every
+// SkipChain. If Member is set, only the SkipChains where Member is part of
+// the roster of the latest block are returned.
+type GetChainTips struct {
+	Member network.ServerIdentityID
+}
+
+// ChainTip is the latest block of a SkipChain known to a conode.
+type ChainTip struct {
+	Genesis SkipBlockID
+	Latest  SkipBlockID
+	Index   int
+}
+
+// GetChainTipsReply returns the latest block of the SkipChains.
+type GetChainTipsReply struct {
+	Tips []*ChainTip
+}
+
+// GetBlocks asks for the SkipBlocks starting at Start and following the
+// forward-links of height 1 up to End. If End is nil, all blocks up to the
+// latest block are returned. At most Max blocks are returned - if Max is 0,
+// a default maximum is used.
+type GetBlocks struct {
+	Start SkipBlockID
+	End   SkipBlockID
+	Max   int
+}
+
+// GetBlocksReply returns the requested range of SkipBlocks. Ancestors holds
+// the older blocks that have forward-links to the range, so that their
+// forward-links can be updated, too.
+type GetBlocksReply struct {
+	Blocks    []*SkipBlock
+	Ancestors []*SkipBlock
+}
+
 // PropagateSkipBlock sends a newly signed SkipBlock to all members of
 // the Cothority
 type PropagateSkipBlock struct {
 	SkipBlock *SkipBlock
 }
 
+// LinkChild is sent along when the roster of the Parent block is asked to
+// sign the link to the genesis-block of a child SkipChain.
+type LinkChild struct {
+	Parent SkipBlockID
+	Child  *SkipBlock
+}
+
 // ForwardSignature asks this responsible for a SkipChain to sign off
 // a new ForwardLink. This will probably be sent to all members of any
 // SkipChain-definition at time 'n'
@@ -0,0 +1,154 @@
+package skipchain
+
+import (
+	"bytes"
+	"sort"
+
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// ListChains returns the genesis-block, the verifier and the latest block of
+// all SkipChains we hold.
+func (s *Service) ListChains(lc *ListChains) (network.Message, onet.ClientError) {
+	reply := &ListChainsReply{}
+	for _, tip := range s.chainTips() {
+		genesis, ok := s.getSkipBlockByID(tip.Genesis)
+		if !ok {
+			continue
+		}
+		reply.Chains = append(reply.Chains, &ChainInfo{
+			Genesis:    tip.Genesis,
+			VerifierID: genesis.VerifierID,
+			Latest:     tip.Latest,
+			Index:      tip.Index,
+		})
+	}
+	sort.Slice(reply.Chains, func(i, j int) bool {
+		return bytes.Compare(reply.Chains[i].Genesis, reply.Chains[j].Genesis) < 0
+	})
+	return reply, nil
+}
+
+// GetBlockByIndex follows the highest possible forward-links from the
+// genesis-block to the block with the requested index.
+func (s *Service) GetBlockByIndex(gbi *GetBlockByIndex) (network.Message, onet.ClientError) {
+	sb, ok := s.getSkipBlockByID(gbi.Genesis)
+	if !ok || sb.Index != 0 {
+		return nil, onet.NewClientErrorCode(4200, "Couldn't find genesis block")
+	}
+	if gbi.Index < 0 {
+		return nil, onet.NewClientErrorCode(4200, "Negative index")
+	}
+	proof := []*SkipBlock{sb}
+	for sb.Index < gbi.Index {
+		var next *SkipBlock
+		for h := len(sb.ForwardLink) - 1; h >= 0 && next == nil; h-- {
+			n, ok := s.getSkipBlockByID(sb.ForwardLink[h].Hash)
+			if !ok {
+				return nil, onet.NewClientErrorCode(4200, "Missing block in forward-chain")
+			}
+			if n.Index <= gbi.Index {
+				next = n
+			}
+		}
+		if next == nil {
+			return nil, onet.NewClientErrorCode(4200, "No block with this index")
+		}
+		sb = next
+		proof = append(proof, sb)
+	}
+	return &GetBlockByIndexReply{proof}, nil
+}
+
+// GetBlockAtTime follows the highest possible forward-links from the
+// genesis-block to the latest block that is not newer than the requested
+// time.
+func (s *Service) GetBlockAtTime(gbt *GetBlockAtTime) (network.Message, onet.ClientError) {
+	sb, ok := s.getSkipBlockByID(gbt.Genesis)
+	if !ok || sb.Index != 0 {
+		return nil, onet.NewClientErrorCode(4200, "Couldn't find genesis block")
+	}
+	if sb.Timestamp > gbt.Time {
+		return nil, onet.NewClientErrorCode(4200, "SkipChain didn't exist at that time")
+	}
+	reply := &GetBlockAtTimeReply{Proof: []*SkipBlock{sb}}
+	for len(sb.ForwardLink) > 0 {
+		var next *SkipBlock
+		for h := len(sb.ForwardLink) - 1; h >= 0 && next == nil; h-- {
+			n, ok := s.getSkipBlockByID(sb.ForwardLink[h].Hash)
+			if !ok {
+				return nil, onet.NewClientErrorCode(4200, "Missing block in forward-chain")
+			}
+			if n.Timestamp <= gbt.Time {
+				next = n
+			} else if h == 0 {
+				reply.Next = n
+			}
+		}
+		if next == nil {
+			break
+		}
+		sb = next
+		reply.Proof = append(reply.Proof, sb)
+	}
+	return reply, nil
+}
+
+// GetProof follows the highest possible back-links from To to From and
+// returns the blocks in the order from From to To.
+func (s *Service) GetProof(gp *GetProof) (network.Message, onet.ClientError) {
+	from, ok := s.getSkipBlockByID(gp.From)
+	if !ok {
+		return nil, onet.NewClientErrorCode(4200, "Couldn't find from block")
+	}
+	sb, ok := s.getSkipBlockByID(gp.To)
+	if !ok {
+		return nil, onet.NewClientErrorCode(4200, "Couldn't find to block")
+	}
+	if sb.Index < from.Index {
+		return nil, onet.NewClientErrorCode(4200, "To is older than from")
+	}
+	proof := []*SkipBlock{sb}
+	for sb.Index > from.Index {
+		var prev *SkipBlock
+		for h := len(sb.BackLinkIds) - 1; h >= 0 && prev == nil; h-- {
+			p, ok := s.getSkipBlockByID(sb.BackLinkIds[h])
+			if !ok {
+				return nil, onet.NewClientErrorCode(4200, "Missing block in backward-chain")
+			}
+			if p.Index >= from.Index {
+				prev = p
+			}
+		}
+		if prev == nil {
+			return nil, onet.NewClientErrorCode(4200, "Didn't find a path")
+		}
+		sb = prev
+		proof = append(proof, sb)
+	}
+	if !sb.Hash.Equal(from.Hash) {
+		return nil, onet.NewClientErrorCode(4200, "Blocks are not in the same SkipChain")
+	}
+	for i, j := 0, len(proof)-1; i < j; i, j = i+1, j-1 {
+		proof[i], proof[j] = proof[j], proof[i]
+	}
+	return &GetProofReply{proof}, nil
+}
+
+// GetChildrenSkipList returns the genesis-blocks of all SkipChains that
+// have the given block as parent.
+func (s *Service) GetChildrenSkipList(gcsl *GetChildrenSkipList) (network.Message, onet.ClientError) {
+	if _, ok := s.getSkipBlockByID(gcsl.ParentID); !ok {
+		return nil, onet.NewClientErrorCode(4200, "Couldn't find parent block")
+	}
+	reply := &GetChildrenSkipListReply{}
+	for _, tip := range s.chainTips() {
+		genesis, ok := s.getSkipBlockByID(tip.Genesis)
+		if !ok || !genesis.ParentBlockID.Equal(gcsl.ParentID) {
+			continue
+		}
+		reply.Children = append(reply.Children, genesis)
+	}
+	return reply, nil
+}
@@ -0,0 +1,113 @@
+package skipchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestService_Query(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, el, service := makeHELS(local, 3)
+
+	sbs := []*SkipBlock{makeGenesisRosterArgs(service, el, nil, VerifyNone, 2, 4)}
+	for i := 1; i < 10; i++ {
+		sb := NewSkipBlock()
+		sb.Roster = el
+		psbr, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: sbs[i-1].Hash, Proposed: sb})
+		log.ErrFatal(cerr)
+		sbs = append(sbs, psbr.(*ProposedSkipBlockReply).Latest)
+	}
+	child := makeGenesisRosterArgs(service, el, sbs[0].Hash, VerifyShard, 1, 1)
+
+	m, cerr := service.ListChains(&ListChains{})
+	log.ErrFatal(cerr)
+	chains := m.(*ListChainsReply).Chains
+	require.Equal(t, 2, len(chains))
+	for _, c := range chains {
+		if c.Genesis.Equal(sbs[0].Hash) {
+			assert.Equal(t, VerifyNone, c.VerifierID)
+			assert.True(t, c.Latest.Equal(sbs[9].Hash))
+			assert.Equal(t, 9, c.Index)
+		} else {
+			assert.True(t, c.Genesis.Equal(child.Hash))
+			assert.Equal(t, VerifyShard, c.VerifierID)
+		}
+	}
+
+	for i, sb := range sbs {
+		m, cerr := service.GetBlockByIndex(&GetBlockByIndex{sbs[0].Hash, i})
+		log.ErrFatal(cerr)
+		proof := m.(*GetBlockByIndexReply).Proof
+		require.True(t, proof[len(proof)-1].Equal(sb), "index %d", i)
+		log.ErrFatal(VerifyChain(sbs[0], proof))
+	}
+	m, cerr = service.GetBlockByIndex(&GetBlockByIndex{sbs[0].Hash, 10})
+	require.NotNil(t, cerr)
+	assert.Nil(t, m)
+
+	for from := range sbs {
+		for to := from; to < len(sbs); to++ {
+			m, cerr := service.GetProof(&GetProof{sbs[from].Hash, sbs[to].Hash})
+			log.ErrFatal(cerr)
+			proof := m.(*GetProofReply).Proof
+			require.True(t, proof[0].Equal(sbs[from]))
+			require.True(t, proof[len(proof)-1].Equal(sbs[to]))
+			log.ErrFatal(VerifyChain(sbs[from], proof))
+		}
+	}
+	// Logarithmic in the distance
+	m, cerr = service.GetProof(&GetProof{sbs[0].Hash, sbs[8].Hash})
+	log.ErrFatal(cerr)
+	assert.Equal(t, 2, len(m.(*GetProofReply).Proof))
+	_, cerr = service.GetProof(&GetProof{sbs[5].Hash, sbs[2].Hash})
+	require.NotNil(t, cerr)
+	_, cerr = service.GetProof(&GetProof{child.Hash, sbs[2].Hash})
+	require.NotNil(t, cerr)
+
+	m, cerr = service.GetChildrenSkipList(&GetChildrenSkipList{sbs[0].Hash})
+	log.ErrFatal(cerr)
+	children := m.(*GetChildrenSkipListReply).Children
+	require.Equal(t, 1, len(children))
+	assert.True(t, children[0].Equal(child))
+}
+
+func TestService_GetBlockAtTime(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, el, service := makeHELS(local, 3)
+
+	sbs := []*SkipBlock{makeGenesisRosterArgs(service, el, nil, VerifyNone, 2, 3)}
+	for i := 1; i < 6; i++ {
+		sb := NewSkipBlock()
+		sb.Roster = el
+		psbr, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: sbs[i-1].Hash, Proposed: sb})
+		log.ErrFatal(cerr)
+		sbs = append(sbs, psbr.(*ProposedSkipBlockReply).Latest)
+		require.True(t, sbs[i].Timestamp >= sbs[i-1].Timestamp)
+	}
+
+	for i, sb := range sbs {
+		m, cerr := service.GetBlockAtTime(&GetBlockAtTime{sbs[0].Hash, sb.Timestamp})
+		log.ErrFatal(cerr)
+		reply := m.(*GetBlockAtTimeReply)
+		latest := reply.Proof[len(reply.Proof)-1]
+		// Blocks with the same timestamp return the latest one
+		require.Equal(t, sb.Timestamp, latest.Timestamp)
+		require.True(t, latest.Index >= i)
+		log.ErrFatal(VerifyChain(sbs[0], reply.Proof))
+		if latest.Index == len(sbs)-1 {
+			assert.Nil(t, reply.Next)
+		} else {
+			require.NotNil(t, reply.Next)
+			assert.Equal(t, latest.Index+1, reply.Next.Index)
+			assert.True(t, reply.Next.Timestamp > sb.Timestamp)
+		}
+	}
+	_, cerr := service.GetBlockAtTime(&GetBlockAtTime{sbs[0].Hash, sbs[0].Timestamp - 1})
+	require.NotNil(t, cerr)
+}
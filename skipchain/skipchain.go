@@ -1,10 +1,13 @@
 package skipchain
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
-
-	"bytes"
+	"fmt"
+	"path"
 
 	"sync"
 
@@ -13,16 +16,48 @@ import (
 	"time"
 
 	"github.com/dedis/paper_chainiac/bftcosi"
+	"github.com/dedis/paper_chainiac/bls"
 	"github.com/dedis/paper_chainiac/manage"
+	"github.com/dedis/paper_chainiac/timestamp"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
 	"gopkg.in/dedis/onet.v1/network"
-	"gopkg.in/dedis/onet.v1/simul/monitor"
 )
 
 // ServiceName can be used to refer to the name of this service
 const ServiceName = "Skipchain"
 const skipchainBFT = "SkipchainBFT"
+const skipchainBLS = "SkipchainBLS"
+
+// MaxClockSkew is how far in the future of the local clock the timestamp
+// of a new SkipBlock may be.
+var MaxClockSkew = time.Minute
+
+// MaxBlockAge is how old the timestamp of a new SkipBlock may be when it is
+// verified by a conode. It has to include the time the leader needs to run
+// the verifiers and the time to collect the signatures.
+var MaxBlockAge = time.Hour
+
+// ErrorVerification is the ClientError-code returned if a verifier refused
+// the proposed SkipBlock.
+const ErrorVerification = 4201
+
+// ErrorStaleLatest is the ClientError-code returned if the latest block
+// given in ProposeSkipBlock already has a successor. The client has to
+// fetch the new latest block and propose again.
+const ErrorStaleLatest = 4202
+
+// ErrorRosterUnavailable is the ClientError-code returned if the roster
+// didn't sign the block before the signing timeout.
+const ErrorRosterUnavailable = 4204
+
+// ErrorCancelled is the ClientError-code returned if the proposal has been
+// cancelled with CancelProposal.
+const ErrorCancelled = 4205
+
+// DefaultSignTimeout is how long the leader waits for the BFT-signature of
+// the roster if neither the SkipChain nor the request define a timeout.
+var DefaultSignTimeout = 30 * time.Minute
 
 func init() {
 	onet.RegisterNewService(ServiceName, newSkipchainService)
@@ -30,7 +65,13 @@ func init() {
 	onet.GlobalProtocolRegister(skipchainBFT, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 		return bftcosi.NewBFTCoSiProtocol(n, nil)
 	})
+	onet.GlobalProtocolRegister(skipchainBLS, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		return bftcosi.NewBLSCoSiProtocol(n, nil, nil)
+	})
 	network.RegisterMessage(&SkipBlockMap{})
+	network.RegisterMessage(&forkStorage{})
+	network.RegisterMessage(&checkpointStorage{})
+	network.RegisterMessage(&blsKeyStorage{})
 }
 
 const skipblocksID = "skipblocks"
@@ -40,18 +81,56 @@ var skipchainSID onet.ServiceID
 // Service handles adding new SkipBlocks
 type Service struct {
 	*onet.ServiceProcessor
-	// SkipBlocks points from SkipBlockID to SkipBlock but SkipBlockID is not a valid
-	// key-type for maps, so we need to cast it to string
-	*SkipBlockMap
-	gMutex sync.Mutex
-	path   string
+	// db holds all SkipBlocks known to this service
+	db   BlockStore
+	path string
 	// testVerify is set to true if a verification happened - only for testing
 	testVerify bool
+	// tips points from the genesis-block of every SkipChain to its
+	// latest known block
+	tips      map[string]*ChainTip
+	tipsMutex sync.Mutex
+	// chainMutexes serialise the proposals for every SkipChain, indexed
+	// by the genesis-block
+	chainMutexes     map[string]*sync.Mutex
+	chainMutexesLock sync.Mutex
+	// forks holds the proofs of the forks detected in every SkipChain,
+	// indexed by the genesis-block
+	forks      map[string][]*ForkProof
+	forksMutex sync.Mutex
+	// stored is closed and replaced every time a block is stored
+	stored      chan struct{}
+	storedMutex sync.Mutex
+	// blobs holds the payloads of the SkipBlocks
+	blobs *blobStore
+	// checkpoints holds the signed checkpoints of every SkipChain,
+	// indexed by the genesis-block
+	checkpoints      map[string][]*Checkpoint
+	checkpointsMutex sync.Mutex
+	// proposals holds every proposal in progress, indexed by the latest
+	// block
+	proposals      map[string]*proposal
+	proposalsMutex sync.Mutex
+	// blsKey signs for SkipChains using bftcosi.SchemeBLS
+	blsKey *bls.KeyPair
+	// successors holds the block this conode signed after a block,
+	// indexed by the previous block
+	successors      map[string]*successor
+	successorsMutex sync.Mutex
+	// syncTimer starts the synchronisation loop
+	syncTimer *time.Timer
+	// closing is closed when the service shuts down
+	closing   chan struct{}
+	closeOnce sync.Once
 }
 
-// SkipBlockMap holds the map to the skipblocks so it can be marshaled.
+// SkipBlockMap holds the map to the skipblocks so it can be marshaled. It
+// is also the in-memory BlockStore.
 type SkipBlockMap struct {
+	// SkipBlocks points from SkipBlockID to SkipBlock but SkipBlockID is not a valid
+	// key-type for maps, so we need to cast it to string
 	SkipBlocks map[string]*SkipBlock
+	mutex      sync.Mutex
 }
 
 // ProposeSkipBlock takes a hash for the latest valid SkipBlock and a SkipBlock
@@ -60,9 +139,13 @@ type SkipBlockMap struct {
 // If the the latest block given is nil it verify if we are actually creating
 // the first (genesis) block and creates it. If it is called with nil although
 // there already exist previous blocks, it will return an error.
+// Proposals for the same SkipChain are handled one after the other. If the
+// latest block already has a successor, ErrorStaleLatest is returned.
+// A proposal on an existing SkipChain can be stopped with CancelProposal.
 func (s *Service) ProposeSkipBlock(psbd *ProposeSkipBlock) (network.Message, onet.ClientError) {
 	prop := psbd.Proposed
 	var prev *SkipBlock
+	sr := &signRequest{}
 
 	if !psbd.LatestID.IsNull() {
 		// We're appending a block to an existing chain
@@ -71,33 +154,41 @@ func (s *Service) ProposeSkipBlock(psbd *ProposeSkipBlock) (network.Message, one
 		if !ok {
 			return nil, onet.NewClientErrorCode(4200, "Didn't find latest block")
 		}
+		genesis, ok := s.genesisOf(prev)
+		if !ok {
+			return nil, onet.NewClientErrorCode(4200, "Didn't find genesis block")
+		}
+		m := s.chainMutex(genesis)
+		m.Lock()
+		defer m.Unlock()
+		// Another proposal might have been added while we were waiting
+		prev, ok = s.getSkipBlockByID(psbd.LatestID)
+		if !ok {
+			return nil, onet.NewClientErrorCode(4200, "Didn't find latest block")
+		}
+		if s.isForked(genesis) {
+			return nil, onet.NewClientErrorCode(ErrorForked,
+				"SkipChain is forked - refusing to extend it")
+		}
+		if len(prev.ForwardLink) > 0 {
+			return nil, onet.NewClientErrorCode(ErrorStaleLatest,
+				"Latest block is stale: the SkipChain already has a newer block")
+		}
+		cancel := s.startProposal(prev.Hash, psbd.CancelHash)
+		defer s.endProposal(prev.Hash, cancel)
+		sr.cancel = cancel
 		prop.MaximumHeight = prev.MaximumHeight
 		prop.BaseHeight = prev.BaseHeight
 		prop.ParentBlockID = prev.ParentBlockID
 		prop.VerifierID = prev.VerifierID
+		prop.MaxExceptions = prev.MaxExceptions
+		prop.Version = prev.Version
+		prop.HashAlgorithm = prev.HashAlgorithm
+		prop.SignTimeout = prev.SignTimeout
+		prop.SignatureScheme = prev.SignatureScheme
 		prop.Index = prev.Index + 1
-		index := prop.Index
-		for prop.Height = 1; index%prop.BaseHeight == 0; prop.Height++ {
-			index /= prop.BaseHeight
-			if prop.Height >= prop.MaximumHeight {
-				break
-			}
-		}
-		log.Lvl4("Found height", prop.Height, "for index", prop.Index,
-			"and maxHeight", prop.MaximumHeight, "and base", prop.BaseHeight)
-		prop.BackLinkIds = make([]SkipBlockID, prop.Height)
-		pointer := prev
-		for h := range prop.BackLinkIds {
-			for pointer.Height < h+1 {
-				var ok bool
-				pointer, ok = s.getSkipBlockByID(pointer.BackLinkIds[0])
-				if !ok {
-					return nil, onet.NewClientErrorCode(4200, "Didn't find convenient SkipBlock for height "+
-						strconv.Itoa(h))
-				}
-			}
-			prop.BackLinkIds[h] = pointer.Hash
-		}
+		// The height of random SkipChains depends on the first back-link
+		prop.BackLinkIds = []SkipBlockID{prev.Hash}
 	} else {
 		// A new chain is created, suppose all arguments in SkipBlock
 		// are correctly set up
@@ -105,32 +196,93 @@ func (s *Service) ProposeSkipBlock(psbd *ProposeSkipBlock) (network.Message, one
 		if prop.MaximumHeight == 0 {
 			return nil, onet.NewClientErrorCode(4200, "Set a maximumHeight > 0")
 		}
-		if prop.BaseHeight == 0 {
-			return nil, onet.NewClientErrorCode(4200, "Set a baseHeight > 0")
+		if prop.BaseHeight < 0 {
+			return nil, onet.NewClientErrorCode(4200, "Set a baseHeight >= 0")
+		}
+		if prop.MaxExceptions < ExceptionsBFT {
+			return nil, onet.NewClientErrorCode(4200, "Invalid maxExceptions")
+		}
+		if err := prop.verifyFormat(); err != nil {
+			return nil, onet.NewClientErrorCode(4200, err.Error())
+		}
+		if prop.SignTimeout < 0 {
+			return nil, onet.NewClientErrorCode(4200, "Invalid signTimeout")
 		}
-		prop.Height = prop.MaximumHeight
 		prop.ForwardLink = make([]*BlockLink, 0)
 		// genesis block has a random back-link:
 		bl := make([]byte, 32)
 		rand.Read(bl)
 		prop.BackLinkIds = []SkipBlockID{SkipBlockID(bl)}
 	}
-	if prop.Roster != nil {
-		prop.Aggregate = prop.Roster.Aggregate
+	prop.Timestamp = time.Now().UnixNano()
+	if prev != nil && prop.Timestamp < prev.Timestamp {
+		// Our clock is behind the one of the previous leader
+		prop.Timestamp = prev.Timestamp
 	}
 	el, err := prop.GetResponsible(s)
 	if err != nil {
-		return nil, onet.NewClientError(err)
+		return nil, onet.NewClientErrorCode(4200, err.Error())
+	}
+	if prop.Roster == nil {
+		// A data-block is signed by the roster of its parent
+		prop.Roster = el
 	}
+	if prev != nil && len(prop.BLSKeys) == 0 && sameMembers(prop.Roster, prev.Roster) {
+		// The keys of a new roster have to be given by the client
+		prop.BLSKeys = prev.BLSKeys
+	}
+	prop.Aggregate = prop.Roster.Aggregate
 	prop.AggregateResp = el.Aggregate
+	if err := s.verifyPayload(prop); err != nil {
+		return nil, onet.NewClientErrorCode(4200, "Payload error: "+err.Error())
+	}
+
+	// The height depends on the index and the first back-link, the
+	// other back-links can only be set once it is known.
+	prop.Height = blockHeight(prop.SkipBlockFix)
+	log.Lvl4("Found height", prop.Height, "for index", prop.Index,
+		"and maxHeight", prop.MaximumHeight, "and base", prop.BaseHeight)
+	if prev != nil {
+		prop.BackLinkIds = make([]SkipBlockID, prop.Height)
+		pointer := prev
+		for h := range prop.BackLinkIds {
+			for pointer.Height < h+1 {
+				// The highest back-link points to the previous block
+				// that is at least as high as pointer
+				var ok bool
+				pointer, ok = s.getSkipBlockByID(pointer.BackLinkIds[pointer.Height-1])
+				if !ok {
+					return nil, onet.NewClientErrorCode(4200, "Didn't find convenient SkipBlock for height "+
+						strconv.Itoa(h))
+				}
+			}
+			prop.BackLinkIds[h] = pointer.Hash
+		}
+	}
 
 	prop.updateHash()
 
-	prev, prop, err = s.signNewSkipBlock(prev, prop)
+	sr.timeout = prop.signTimeout()
+	if t := time.Duration(psbd.Timeout) * time.Millisecond; t > 0 && t < sr.timeout {
+		sr.timeout = t
+	}
+	prev, prop, err = s.signNewSkipBlock(prev, prop, sr)
 	if err != nil {
+		switch e := err.(type) {
+		case *VerificationError:
+			return nil, onet.NewClientErrorCode(ErrorVerification, e.Error())
+		case *signError:
+			return nil, onet.NewClientErrorCode(e.code, e.Error())
+		}
 		return nil, onet.NewClientErrorCode(4200, "Verification error: "+err.Error())
 	}
-	//s.save()
+
+	if CheckpointInterval > 0 && prop.Index > 0 &&
+		prop.Index%CheckpointInterval == 0 {
+		if err := s.createCheckpoint(prop); err != nil {
+			log.Error("Couldn't create checkpoint:", err)
+		}
+	}
 
 	reply := &ProposedSkipBlockReply{
 		Previous: prev,
@@ -165,31 +317,69 @@ func (s *Service) GetUpdateChain(latestKnown *GetUpdateChain) (network.Message,
 	return reply, nil
 }
 
-// SetChildrenSkipBlock creates a new SkipChain if that 'service' doesn't exist
-// yet.
+// SetChildrenSkipBlock links the genesis-block of a child SkipChain to its
+// parent block. The child has to be created with the parent as
+// ParentBlockID, and the roster of the parent signs the link, which is
+// stored as ChildSL in the parent block.
 func (s *Service) SetChildrenSkipBlock(scsb *SetChildrenSkipBlock) (network.Message, onet.ClientError) {
-	parentID := scsb.ParentID
-	childID := scsb.ChildID
-	parent, ok := s.getSkipBlockByID(parentID)
+	parent, ok := s.getSkipBlockByID(scsb.ParentID)
+	if !ok {
+		return nil, onet.NewClientErrorCode(4200, "Couldn't find skipblock!")
+	}
+	genesis, ok := s.genesisOf(parent)
+	if !ok {
+		return nil, onet.NewClientErrorCode(4200, "Didn't find genesis block")
+	}
+	// The parent mustn't get new forward-links while we link it
+	m := s.chainMutex(genesis)
+	m.Lock()
+	defer m.Unlock()
+	parent, ok = s.getSkipBlockByID(scsb.ParentID)
 	if !ok {
 		return nil, onet.NewClientErrorCode(4200, "Couldn't find skipblock!")
 	}
-	child, ok := s.getSkipBlockByID(childID)
+	child, ok := s.getSkipBlockByID(scsb.ChildID)
 	if !ok {
 		return nil, onet.NewClientErrorCode(4200, "Couldn't find skipblock!")
 	}
-	child.ParentBlockID = parentID
-	parent.ChildSL = NewBlockLink()
-	parent.ChildSL.Hash = childID
+	if child.Index != 0 || !child.ParentBlockID.Equal(parent.Hash) {
+		return nil, onet.NewClientErrorCode(4200,
+			"Child has to be a genesis block pointing to the parent")
+	}
+	if parent.ChildSL != nil {
+		if parent.ChildSL.Hash.Equal(child.Hash) {
+			return &SetChildrenSkipBlockReply{parent, child}, nil
+		}
+		return nil, onet.NewClientErrorCode(4200, "Parent already has a child")
+	}
+	if parent.Roster == nil {
+		return nil, onet.NewClientErrorCode(4200, "Parent has no roster")
+	}
 
-	err := s.startPropagation([]*SkipBlock{child, parent})
+	n := len(parent.Roster.List)
+	publics, err := parent.blsPublics(parent.Roster)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(4200, err.Error())
+	}
+	sig, err := s.bftSignMsg(childLinkMsg(parent.Hash, child.Hash),
+		&LinkChild{parent.Hash, child}, parent.Roster, parent.allowedExceptions(n),
+		publics, &signRequest{timeout: parent.signTimeout()})
 	if err != nil {
-		return nil, onet.NewClientError(err)
+		code := 4200
+		if se, ok := err.(*signError); ok {
+			code = se.code
+		}
+		return nil, onet.NewClientErrorCode(code,
+			"Parent roster didn't sign child-link: "+err.Error())
+	}
+	parent = parent.Copy()
+	parent.ChildSL = newLink(child.Hash, sig)
+	if err := s.startPropagation([]*SkipBlock{parent}); err != nil {
+		return nil, onet.NewClientErrorCode(4200, err.Error())
 	}
 	// Parent-block is always of type roster, but child-block can be
 	// data or roster.
 	reply := &SetChildrenSkipBlockReply{parent, child}
-	//s.save()
 
 	return reply, nil
 }
@@ -208,13 +398,34 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 		}
 		pi.(*manage.Propagate).RegisterOnData(s.PropagateSkipBlock)
 	case skipchainBFT:
-		pi, err = bftcosi.NewBFTCoSiProtocol(tn, s.bftVerify)
+		var bft *bftcosi.ProtocolBFTCoSi
+		bft, err = bftcosi.NewBFTCoSiProtocol(tn, s.bftVerify)
+		if err != nil {
+			return nil, err
+		}
+		bft.RegisterOnViewChange(s.onViewChange)
+		bft.RegisterOnRoundEnd(s.endSuccessor)
+		pi = bft
+	case skipchainBLS:
+		var blscosi *bftcosi.ProtocolBLSCoSi
+		blscosi, err = bftcosi.NewBLSCoSiProtocol(tn, s.bftVerify, s.blsKey)
+		if err != nil {
+			return nil, err
+		}
+		blscosi.RegisterOnRoundEnd(s.endSuccessor)
+		pi = blscosi
 	}
 	return pi, err
 }
 
-// PropagateSkipBlock will save a new SkipBlock
+// PropagateSkipBlock will save a new SkipBlock or checkpoint
 func (s *Service) PropagateSkipBlock(msg network.Message) {
+	if cp, ok := msg.(*Checkpoint); ok {
+		if err := s.addCheckpoint(cp); err != nil {
+			log.Error("Couldn't add checkpoint:", err)
+		}
+		return
+	}
 	sb, ok := msg.(*SkipBlock)
 	if !ok {
 		log.Error("Couldn't convert to SkipBlock")
@@ -224,7 +435,22 @@ func (s *Service) PropagateSkipBlock(msg network.Message) {
 		log.Error(err)
 		return
 	}
-	s.storeSkipBlock(sb)
+	if fp := s.detectFork(sb); fp != nil {
+		s.addFork(fp)
+		return
+	}
+	if local, ok := s.getSkipBlockByID(sb.Hash); ok {
+		for i := 0; i < len(local.ForwardLink) && i < len(sb.ForwardLink); i++ {
+			if !local.ForwardLink[i].Hash.Equal(sb.ForwardLink[i].Hash) {
+				log.Error("Received block has different forward-links")
+				return
+			}
+		}
+	}
+	if err := s.storeSkipBlock(sb); err != nil {
+		log.Error("Couldn't store skipblock:", err)
+		return
+	}
 	log.Lvlf3("Stored skip block %+v in %x", *sb, s.Context.ServerIdentity().ID[0:8])
 }
 
@@ -232,26 +458,18 @@ func (s *Service) PropagateSkipBlock(msg network.Message) {
 // which will propagate and update all forward-links of all blocks.
 // As a simple solution it verifies the validity of the block,
 // simulates a signature and propagates the latest and newest block.
-func (s *Service) signNewSkipBlock(latest, newest *SkipBlock) (*SkipBlock, *SkipBlock, error) {
+func (s *Service) signNewSkipBlock(latest, newest *SkipBlock, sr *signRequest) (*SkipBlock, *SkipBlock, error) {
 	log.Lvl4("Signing new block", newest, "on block", latest)
-	if newest != nil && newest.Roster == nil {
-		log.Lvl3("Got a data-block")
-		if newest.ParentBlockID.IsNull() {
-			return nil, nil, errors.New("Data skipblock without parent")
-		}
-		parent, ok := s.getSkipBlockByID(newest.ParentBlockID)
-		if !ok {
-			return nil, nil, errors.New("Didn't find parent block")
-		}
-		newest.Roster = parent.Roster
-	}
 	// Now verify if it's a valid block
 	if err := s.verifyNewSkipBlock(latest, newest); err != nil {
+		if _, ok := err.(*VerificationError); ok {
+			return nil, nil, err
+		}
 		return nil, nil, errors.New("Verification of newest SkipBlock failed: " + err.Error())
 	}
 
 	// Sign it
-	err := s.startBFTSignature(newest)
+	err := s.startBFTSignature(newest, sr)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -267,7 +485,7 @@ func (s *Service) signNewSkipBlock(latest, newest *SkipBlock) (*SkipBlock, *Skip
 	} else {
 		// Adjust forward-links if it's an additional block
 		var err error
-		newblocks, err = s.addForwardLinks(newest)
+		newblocks, err = s.addForwardLinks(newest, sr)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -282,80 +500,225 @@ func (s *Service) signNewSkipBlock(latest, newest *SkipBlock) (*SkipBlock, *Skip
 	return latest, newblocks[0], nil
 }
 
-func (s *Service) startBFTSignature(block *SkipBlock) error {
-	log.Lvl3("Starting bftsignature with root-node=", s.ServerIdentity())
-	done := make(chan bool)
-	// create the message we want to sign for this round
-	msg := []byte(block.Hash)
+func (s *Service) startBFTSignature(block *SkipBlock, sr *signRequest) error {
 	el, err := block.GetResponsible(s)
 	if err != nil {
 		return err
 	}
+	block.BlockSig, err = s.bftSign(block, block, el, sr)
+	return err
+}
+
+// bftSign lets the roster el of the block signer sign the hash of the block
+// with a BFT-signature, using the signature scheme of signer. The block is
+// sent along so that every node can verify it.
+func (s *Service) bftSign(block, signer *SkipBlock, el *onet.Roster, sr *signRequest) (*bftcosi.BFTSignature, error) {
+	publics, err := signer.blsPublics(el)
+	if err != nil {
+		return nil, err
+	}
+	return s.bftSignMsg(block.Hash, block, el, signer.allowedExceptions(len(el.List)),
+		publics, sr)
+}
+
+// signRequest defines how long the leader waits for a BFT-signature and
+// holds a channel that cancels the signature when it is closed.
+type signRequest struct {
+	timeout time.Duration
+	cancel  <-chan struct{}
+}
+
+// signError is returned if the roster didn't sign, with the
+// ClientError-code telling why.
+type signError struct {
+	code int
+	msg  string
+}
+
+func (se *signError) Error() string {
+	return se.msg
+}
+
+// bftSignMsg lets the roster sign msg with a BFT-signature where at most
+// maxExceptions members may be missing. If blsPublics holds the BLS keys of
+// the roster, the signature uses bftcosi.SchemeBLS, else CoSi. The data is
+// sent along so that every node can verify it in bftVerify. If the
+// signature isn't done before the timeout of sr or sr is cancelled, the
+// protocol is stopped and a *signError is returned.
+func (s *Service) bftSignMsg(msg []byte, data network.Message, el *onet.Roster,
+	maxExceptions int, blsPublics [][]byte, sr *signRequest) (*bftcosi.BFTSignature, error) {
+	log.Lvl3("Starting bftsignature with root-node=", s.ServerIdentity())
+	// The protocol might finish after we stopped waiting for it
+	done := make(chan *bftcosi.BFTSignature, 1)
 	switch len(el.List) {
 	case 0:
-		return errors.New("Found empty Roster")
+		return nil, errors.New("Found empty Roster")
 	case 1:
-		return errors.New("Need more than 1 entry for Roster")
+		return nil, errors.New("Need more than 1 entry for Roster")
 	}
 
 	// Start the protocol
 	tree := el.GenerateNaryTreeWithRoot(2, s.ServerIdentity())
-
-	node, err := s.CreateProtocol(skipchainBFT, tree)
-	if err != nil {
-		return errors.New("Couldn't create new node: " + err.Error())
+	if tree == nil {
+		return nil, errors.New("Leader is not part of the roster")
 	}
 
-	// Register the function generating the protocol instance
-	root := node.(*bftcosi.ProtocolBFTCoSi)
-	root.Msg = msg
-	data, err := network.Marshal(block)
+	// The acceptance policy of the SkipChain is part of the signature
+	policy := &bftcosi.Policy{
+		Type:      bftcosi.PolicyCount,
+		Threshold: len(el.List) - maxExceptions,
+	}
+	buf, err := network.Marshal(data)
 	if err != nil {
-		return errors.New("Couldn't marshal block: " + err.Error())
+		return nil, errors.New("Couldn't marshal data: " + err.Error())
+	}
+	// The verifiers already ran in verifyNewSkipBlock, so the root only
+	// checks it signs the correct message. This also makes sure we have
+	// the correct service in testing-mode with more than one host and
+	// service per cothority-instance.
+	verify := func(m, d []byte) bool {
+		s.testVerify = true
+		return bytes.Equal(msg, m)
 	}
-	root.Data = data
 
-	// in testing-mode with more than one host and service per cothority-instance
-	// we might have the wrong verification-function, so set it again here.
-	root.VerificationFunction = s.bftVerify
-	// function that will be called when protocol is finished by the root
-	root.RegisterOnDone(func() {
-		done <- true
-	})
+	var node onet.ProtocolInstance
+	var stop func()
+	if blsPublics == nil {
+		node, err = s.CreateProtocol(skipchainBFT, tree)
+		if err != nil {
+			return nil, errors.New("Couldn't create new node: " + err.Error())
+		}
+		root := node.(*bftcosi.ProtocolBFTCoSi)
+		root.Msg = msg
+		root.Policy = policy
+		root.Data = buf
+		root.VerificationFunction = verify
+		// function that will be called when protocol is finished by the root
+		root.RegisterOnDone(func() {
+			done <- root.Signature()
+		})
+		stop = root.Abort
+	} else {
+		node, err = s.CreateProtocol(skipchainBLS, tree)
+		if err != nil {
+			return nil, errors.New("Couldn't create new node: " + err.Error())
+		}
+		root := node.(*bftcosi.ProtocolBLSCoSi)
+		root.Msg = msg
+		root.Policy = policy
+		root.Data = buf
+		root.Publics = blsPublics
+		root.Key = s.blsKey
+		root.VerificationFunction = verify
+		root.RegisterOnSignatureDone(func(sig *bftcosi.BFTSignature) {
+			done <- sig
+		})
+		stop = root.Abort
+	}
 	go node.Start()
 	select {
-	case <-done:
-		block.BlockSig = root.Signature()
-		if len(block.BlockSig.Exceptions) != 0 {
-			return errors.New("Not everybody signed off the new block")
+	case sig := <-done:
+		n := len(el.List)
+		if err := verifyExceptions(sig.Missing(n), n, maxExceptions); err != nil {
+			return nil, &signError{ErrorVerification,
+				"Roster refused to sign: " + err.Error()}
 		}
-		if err := block.BlockSig.Verify(network.Suite, el.Publics()); err != nil {
-			return errors.New("Couldn't verify signature")
+		if blsPublics != nil {
+			err = sig.VerifyBLS(blsPublics)
+		} else {
+			err = sig.Verify(network.Suite, el.Publics())
+		}
+		if err != nil {
+			return nil, errors.New("Couldn't verify signature")
 		}
-	case <-time.After(time.Minute * 30):
-		return errors.New("Timed out while waiting for signature")
+		return sig, nil
+	case <-time.After(sr.timeout):
+		stop()
+		return nil, &signError{ErrorRosterUnavailable,
+			"Timed out while waiting for signature"}
+	case <-sr.cancel:
+		stop()
+		return nil, &signError{ErrorCancelled, "Proposal has been cancelled"}
 	}
-	return nil
 }
 
-func (s *Service) verifyNewSkipBlock(latest, newest *SkipBlock) error {
-	// Do some sanity-checks on the latest and newest skipblock
-	if latest != nil {
-		if len(latest.ForwardLink) != 0 {
-			return errors.New("Latest already has forward link")
-		}
-		if !bytes.Equal(newest.BackLinkIds[0], latest.Hash) {
-			return errors.New("Newest doesn't point to latest")
-		}
+// proposal is a proposal in progress. Its channel is closed to cancel it.
+type proposal struct {
+	cancel chan struct{}
+	// cancelHash is the CancelHash of the secret needed to cancel the
+	// proposal. If it is empty, the proposal can't be cancelled.
+	cancelHash []byte
+}
+
+// CancelHash returns the hash of the secret that a proposal has to hold,
+// so that it can be cancelled by sending the secret.
+func CancelHash(secret []byte) []byte {
+	h := sha256.Sum256(secret)
+	return h[:]
+}
+
+// startProposal returns the channel to cancel the proposal on latest.
+func (s *Service) startProposal(latest SkipBlockID, cancelHash []byte) chan struct{} {
+	s.proposalsMutex.Lock()
+	defer s.proposalsMutex.Unlock()
+	c := make(chan struct{})
+	s.proposals[string(latest)] = &proposal{c, cancelHash}
+	return c
+}
+
+// endProposal forgets the proposal on latest, unless it has been replaced
+// in the meantime.
+func (s *Service) endProposal(latest SkipBlockID, c chan struct{}) {
+	s.proposalsMutex.Lock()
+	defer s.proposalsMutex.Unlock()
+	if p, ok := s.proposals[string(latest)]; ok && p.cancel == c {
+		delete(s.proposals, string(latest))
 	}
+}
 
-	// TODO: add a registration service for verifiers
-	return nil
+// CancelProposal stops the proposal of a block after the given latest
+// block that is in progress on this conode. Only the proposer can cancel
+// it, by sending the secret of the CancelHash of the proposal. The
+// proposal returns ErrorCancelled and the roster drops the round, so the
+// block isn't signed after a view change either.
+func (s *Service) CancelProposal(cp *CancelProposal) (network.Message, onet.ClientError) {
+	s.proposalsMutex.Lock()
+	defer s.proposalsMutex.Unlock()
+	p, ok := s.proposals[string(cp.LatestID)]
+	if !ok {
+		return nil, onet.NewClientErrorCode(4200, "No proposal in progress")
+	}
+	if len(p.cancelHash) == 0 || !bytes.Equal(CancelHash(cp.Secret), p.cancelHash) {
+		return nil, onet.NewClientErrorCode(4200, "Wrong secret to cancel the proposal")
+	}
+	close(p.cancel)
+	delete(s.proposals, string(cp.LatestID))
+	return &CancelProposalReply{}, nil
+}
+
+// verifyNewSkipBlock does some sanity-checks on the latest and newest
+// skipblock and then asks the verifier of the chain whether newest is
+// acceptable. A refusal of the verifier is returned as *VerificationError.
+func (s *Service) verifyNewSkipBlock(latest, newest *SkipBlock) error {
+	if err := verifyLinks(latest, newest); err != nil {
+		return err
+	}
+	return runVerifier(newest.VerifierID, s, newest)
 }
 
 // addForwardLinks checks if we have a valid link connecting the two
-// SkipBlocks with each other.
-func (s *Service) addForwardLinks(newest *SkipBlock) ([]*SkipBlock, error) {
+// SkipBlocks with each other. Every forward-link is signed by the roster
+// responsible for the block it starts from, so that a client trusting that
+// block can follow the link even if the roster changed.
+func (s *Service) addForwardLinks(newest *SkipBlock, sr *signRequest) ([]*SkipBlock, error) {
+	elNewest, err := newest.GetResponsible(s)
+	if err != nil {
+		return nil, err
+	}
+	// The signatures of the forward-links, for every roster
+	sigs := map[onet.RosterID]*bftcosi.BFTSignature{
+		elNewest.ID: newest.BlockSig,
+	}
 	height := len(newest.BackLinkIds)
 	blocks := make([]*SkipBlock, height+1)
 	blocks[0] = newest
@@ -370,10 +733,26 @@ func (s *Service) addForwardLinks(newest *SkipBlock) ([]*SkipBlock, error) {
 		if len(bc.ForwardLink) >= h+1 {
 			return nil, errors.New("Backlinking to a block which has a forwardlink")
 		}
+		el, err := bc.GetResponsible(s)
+		if err != nil {
+			return nil, err
+		}
+		sig, ok := sigs[el.ID]
+		if !ok {
+			log.Lvl3("Asking previous roster to sign forward-link to", newest)
+			sig, err = s.bftSign(newest, bc, el, sr)
+			if err != nil {
+				if se, ok := err.(*signError); ok {
+					return nil, &signError{se.code,
+						"Previous roster didn't sign forward-link: " + se.msg}
+				}
+				return nil, errors.New("Previous roster didn't sign forward-link: " +
+					err.Error())
+			}
+			sigs[el.ID] = sig
+		}
 		for len(bc.ForwardLink) < h+1 {
-			fl := NewBlockLink()
-			fl.Hash = newest.Hash
-			bc.ForwardLink = append(bc.ForwardLink, fl)
+			bc.ForwardLink = append(bc.ForwardLink, newLink(newest.Hash, sig))
 		}
 		log.Lvl4("Block has now height of", len(bc.ForwardLink))
 		blocks[h+1] = bc
@@ -415,86 +794,254 @@ func (s *Service) bftVerify(msg []byte, data []byte) bool {
 		log.Error("Couldn't unmarshal SkipBlock", data)
 		return false
 	}
-	sb := sbN.(*SkipBlock)
+	if lc, ok := sbN.(*LinkChild); ok {
+		return s.verifyLinkChild(msg, lc)
+	}
+	if cp, ok := sbN.(*Checkpoint); ok {
+		return s.verifyCheckpoint(msg, cp)
+	}
+	sb, ok := sbN.(*SkipBlock)
+	if !ok || sb.SkipBlockFix == nil {
+		log.Error("Got unknown data to sign")
+		return false
+	}
+	if err := sb.verifyFormat(); err != nil {
+		log.Lvl2(s.ServerIdentity(), "refuses block:", err)
+		return false
+	}
 	if !sb.Hash.Equal(SkipBlockID(msg)) {
 		log.Lvlf2("Data skipBlock different from msg %x %x", msg, sb.Hash)
 		return false
 	}
-	switch sb.VerifierID {
-	case VerifyNone:
-		log.Lvl4("No verification - accepted")
-		return true
-	case VerifyShard:
-		if sb.ParentBlockID.IsNull() {
-			log.Lvl3("No parent skipblock to verify against")
-		} else {
-			sbParent, exists := s.getSkipBlockByID(sb.ParentBlockID)
-			if !exists {
-				log.Lvl3("Parent skipblock doesn't exist")
-			} else {
-				for _, e := range sb.Roster.List {
-					if i, _ := sbParent.Roster.Search(e.ID); i < 0 {
-						log.Lvl3("ServerIdentity in child doesn't exist in parent")
-						return false
-					}
-				}
-				return true
-			}
+	if !sb.calculateHash().Equal(sb.Hash) {
+		log.Lvl2("Hash of skipBlock doesn't match its content")
+		return false
+	}
+	if err := verifyTimestamp(sb, time.Now()); err != nil {
+		log.Lvl2(s.ServerIdentity(), "refuses block:", err)
+		return false
+	}
+	var latest *SkipBlock
+	if sb.Index > 0 {
+		if len(sb.BackLinkIds) == 0 || len(sb.BackLinkIds) != sb.Height {
+			log.Lvl2(s.ServerIdentity(), "refuses block with wrong number of back-links")
+			return false
+		}
+		// Without the previous block none of the links can be
+		// checked, so a node that missed it has to catch up first.
+		var ok bool
+		latest, ok = s.getSkipBlockByID(sb.BackLinkIds[0])
+		if !ok {
+			log.Lvl2(s.ServerIdentity(), "refuses block: don't know previous block")
+			return false
+		}
+		if genesis, ok := s.genesisOf(latest); ok && s.isForked(genesis) {
+			log.Lvl2(s.ServerIdentity(), "refuses to extend forked SkipChain")
+			return false
+		}
+	}
+	if err := verifyLinks(latest, sb); err != nil {
+		log.Lvl2(s.ServerIdentity(), "refuses block:", err)
+		return false
+	}
+	if err := s.verifyPayload(sb); err != nil {
+		log.Lvl2(s.ServerIdentity(), "refuses block:", err)
+		return false
+	}
+	if err := runVerifier(sb.VerifierID, s, sb); err != nil {
+		log.Lvl2(s.ServerIdentity(), "refuses block:", err)
+		return false
+	}
+	if latest != nil {
+		if err := s.signSuccessor(latest, sb); err != nil {
+			log.Lvl2(s.ServerIdentity(), "refuses block:", err)
+			return false
+		}
+	}
+	return true
+}
+
+// successor is a block this conode agreed to sign after another block.
+type successor struct {
+	hash    SkipBlockID
+	expires time.Time
+	// rounds is the number of running rounds that verified the block
+	rounds int
+	// signed is set once we signed the block in a commit round
+	signed bool
+}
+
+// signSuccessor remembers that sb is signed as the block following latest.
+// Until the rounds signing sb ended without our signature, the forward-link
+// of latest is stored or the signing of sb timed out, no other block
+// following latest is signed, so that two proposals sent to different
+// leaders can't both be signed.
+func (s *Service) signSuccessor(latest, sb *SkipBlock) error {
+	s.successorsMutex.Lock()
+	defer s.successorsMutex.Unlock()
+	now := time.Now()
+	succ, ok := s.successors[string(latest.Hash)]
+	if ok && succ.hash.Equal(sb.Hash) {
+		succ.rounds++
+		succ.expires = now.Add(sb.signTimeout())
+		return nil
+	}
+	if ok && now.Before(succ.expires) {
+		return errors.New("Already signed another block following the latest block")
+	}
+	s.successors[string(latest.Hash)] = &successor{
+		hash:    sb.Hash,
+		expires: now.Add(sb.signTimeout()),
+		rounds:  1,
+	}
+	return nil
+}
+
+// endSuccessor is called when a round that verified the block with hash
+// msg ended. Once no round holds the block anymore, another block can
+// follow the latest block, unless we signed the block in a commit round:
+// then the roster might have its signature, so only the forward-link or
+// the timeout releases it.
+func (s *Service) endSuccessor(msg []byte, signed bool) {
+	s.successorsMutex.Lock()
+	defer s.successorsMutex.Unlock()
+	for latest, succ := range s.successors {
+		if !succ.hash.Equal(SkipBlockID(msg)) {
+			continue
 		}
-	case VerifySwup:
-		log.Fatal("Not implemented")
-		var pkgName string
-		verifyT := monitor.NewTimeMeasure("verify_" + pkgName)
-		// Verify all signatures
-		verifyT.Record()
-		buildT := monitor.NewTimeMeasure("build_" + pkgName)
-		// launch the reproducible build
-		buildT.Record()
+		succ.rounds--
+		succ.signed = succ.signed || signed
+		if succ.rounds <= 0 && !succ.signed {
+			delete(s.successors, latest)
+		}
+	}
+}
+
+// ListVerifiers returns all verifiers registered on this conode.
+func (s *Service) ListVerifiers(lv *ListVerifiers) (network.Message, onet.ClientError) {
+	return &ListVerifiersReply{RegisteredVerifiers()}, nil
+}
+
+// blockHeight returns the height a block must have. Deterministic
+// SkipChains derive it from the index, random SkipChains from the content
+// of the block, so that the leader can't choose it. A genesis-block always
+// has the maximum height.
+func blockHeight(sbf *SkipBlockFix) int {
+	switch {
+	case sbf.Index == 0:
+		return sbf.MaximumHeight
+	case sbf.BaseHeight > 0:
+		return deterministicHeight(sbf.Index, sbf.BaseHeight, sbf.MaximumHeight)
 	default:
-		f, ok := verifiers[sb.VerifierID]
-		if ok {
-			log.Lvlf3("Found user verification %x", sb.VerifierID)
-			return f(msg, data)
+		return randomHeight(sbf)
+	}
+}
+
+// randomHeight returns the height of a block of a random SkipChain. It is
+// one more than the level of the hash of the previous block and the index,
+// so every level is half as probable as the one below. The leader chooses
+// the other fields, like the timestamp, so it could try them until it gets
+// the height it wants.
+func randomHeight(sbf *SkipBlockFix) int {
+	if len(sbf.BackLinkIds) == 0 {
+		return 1
+	}
+	seed := make([]byte, 8, 8+len(sbf.BackLinkIds[0]))
+	binary.BigEndian.PutUint64(seed, uint64(sbf.Index))
+	h := sha256.Sum256(append(seed, sbf.BackLinkIds[0]...))
+	id := timestamp.HashID(h[:])
+	height := id.Level() + 1
+	if height > sbf.MaximumHeight {
+		height = sbf.MaximumHeight
+	}
+	return height
+}
+
+// deterministicHeight returns the height of the block at the given index
+// of a deterministic SkipChain.
+func deterministicHeight(index, base, maxHeight int) int {
+	if index == 0 {
+		return maxHeight
+	}
+	height := 1
+	for ; index%base == 0; height++ {
+		index /= base
+		if height >= maxHeight {
+			break
 		}
 	}
-	return false
+	return height
+}
+
+// chainMutex returns the mutex serialising the proposals for the SkipChain
+// starting at genesis.
+func (s *Service) chainMutex(genesis SkipBlockID) *sync.Mutex {
+	s.chainMutexesLock.Lock()
+	defer s.chainMutexesLock.Unlock()
+	m, ok := s.chainMutexes[string(genesis)]
+	if !ok {
+		m = &sync.Mutex{}
+		s.chainMutexes[string(genesis)] = m
+	}
+	return m
 }
 
 // getSkipBlockByID returns the skip-block or false if it doesn't exist
 func (s *Service) getSkipBlockByID(sbID SkipBlockID) (*SkipBlock, bool) {
-	s.gMutex.Lock()
-	b, ok := s.SkipBlocks[string(sbID)]
-	s.gMutex.Unlock()
-	return b, ok
+	return s.db.GetByID(sbID)
 }
 
 // storeSkipBlock stores the given SkipBlock in the service-list
-func (s *Service) storeSkipBlock(sb *SkipBlock) SkipBlockID {
-	s.gMutex.Lock()
-	s.SkipBlocks[string(sb.Hash)] = sb
-	s.gMutex.Unlock()
-	return sb.Hash
+func (s *Service) storeSkipBlock(sb *SkipBlock) error {
+	if err := s.db.Store(sb); err != nil {
+		return err
+	}
+	if len(sb.PayloadHash) > 0 {
+		s.blobs.referenced(sb.PayloadHash)
+	}
+	if len(sb.ForwardLink) > 0 {
+		s.successorsMutex.Lock()
+		delete(s.successors, string(sb.Hash))
+		s.successorsMutex.Unlock()
+	}
+	s.updateTip(sb)
+	s.notifyStored()
+	return nil
 }
 
-// lenSkipBlock returns the actual length using mutexes
+// lenSkipBlocks returns the number of stored SkipBlocks
 func (s *Service) lenSkipBlocks() int {
-	s.gMutex.Lock()
-	defer s.gMutex.Unlock()
-	return len(s.SkipBlocks)
+	return s.db.Len()
 }
 
-// saves the actual identity
-func (s *Service) save() {
-	log.Lvl3("Saving service")
-	err := s.Save(skipblocksID, s.SkipBlockMap)
-	if err != nil {
-		log.Error("Couldn't save file:", err)
-	}
+// Close stops the synchronisation and closes the block store. onet doesn't
+// tell the services when the conode stops, so whoever shuts down the server
+// has to call Close afterwards.
+func (s *Service) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		if s.syncTimer != nil {
+			s.syncTimer.Stop()
+		}
+		close(s.closing)
+		err = s.db.Close()
+	})
+	return err
 }
 
-// Tries to load the configuration and updates the data in the service
-// if it finds a valid config-file.
+// Tries to open the block store on disk and recovers all SkipBlocks stored
+// in there. SkipBlocks saved by an older version of the service are moved to
+// the new store. If no data path is available, the SkipBlocks are only kept
+// in memory, else only the recently used ones are cached in memory.
 func (s *Service) tryLoad() error {
+	if s.path == "" {
+		return nil
+	}
+	fs, err := NewFileStore(s.path)
+	if err != nil {
+		return err
+	}
+	s.db = NewCachedStore(fs, BlockCacheBytes)
 	if !s.DataAvailable(skipblocksID) {
 		return nil
 	}
@@ -502,25 +1049,75 @@ func (s *Service) tryLoad() error {
 	if err != nil {
 		return err
 	}
-	var ok bool
-	s.SkipBlockMap, ok = msg.(*SkipBlockMap)
+	sbm, ok := msg.(*SkipBlockMap)
 	if !ok {
 		return errors.New("Data of wrong type")
 	}
-	return nil
+	log.Lvl2("Importing", len(sbm.SkipBlocks), "skipblocks from old storage")
+	sbs := make([]*SkipBlock, 0, len(sbm.SkipBlocks))
+	for _, sb := range sbm.SkipBlocks {
+		sbs = append(sbs, sb)
+	}
+	if err := fs.StoreBatch(sbs); err != nil {
+		return err
+	}
+	return s.Save(skipblocksID, &SkipBlockMap{SkipBlocks: map[string]*SkipBlock{}})
 }
 
 func newSkipchainService(c *onet.Context) onet.Service {
 	s := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
-		SkipBlockMap:     &SkipBlockMap{make(map[string]*SkipBlock)},
+		db:               &SkipBlockMap{SkipBlocks: make(map[string]*SkipBlock)},
+		tips:             make(map[string]*ChainTip),
+		chainMutexes:     make(map[string]*sync.Mutex),
+		forks:            make(map[string][]*ForkProof),
+		checkpoints:      make(map[string][]*Checkpoint),
+		proposals:        make(map[string]*proposal),
+		stored:           make(chan struct{}),
+		closing:          make(chan struct{}),
+		successors:       make(map[string]*successor),
+	}
+	if onet.ContextDataPath != "" {
+		pub, _ := c.ServerIdentity().Public.MarshalBinary()
+		s.path = path.Join(onet.ContextDataPath, fmt.Sprintf("%x-skipchain", pub))
 	}
 	if err := s.tryLoad(); err != nil {
 		log.Error(err)
 	}
+	blobDir := ""
+	if s.path != "" {
+		blobDir = path.Join(s.path, PayloadDir)
+	}
+	var err error
+	if s.blobs, err = newBlobStore(blobDir); err != nil {
+		log.Error(err)
+		s.blobs, _ = newBlobStore("")
+	}
+	s.loadTips()
+	if err := s.loadPayloads(); err != nil {
+		log.Error("Couldn't load payloads:", err)
+	}
+	if err := s.loadBLSKey(); err != nil {
+		log.Error("Couldn't load BLS key:", err)
+	}
+	if err := s.loadForks(); err != nil {
+		log.Error(err)
+	}
+	if err := s.loadCheckpoints(); err != nil {
+		log.Error(err)
+	}
 	if err := s.RegisterHandlers(s.ProposeSkipBlock, s.SetChildrenSkipBlock,
-		s.GetUpdateChain); err != nil {
+		s.GetUpdateChain, s.ListVerifiers, s.GetChainTips,
+		s.GetBlocks, s.ListChains, s.GetBlockByIndex, s.GetBlockAtTime,
+		s.GetProof, s.GetForkProofs, s.Subscribe, s.PutBlob, s.GetBlob,
+		s.GetCheckpoint, s.GetStoreStats, s.CancelProposal,
+		s.GetChildrenSkipList, s.GetBLSKey); err != nil {
 		log.Fatal("Registration error:", err)
 	}
+	if SyncInterval > 0 {
+		s.syncTimer = time.AfterFunc(SyncInterval, func() {
+			s.syncLoop(SyncInterval)
+		})
+	}
 	return s
 }
@@ -9,11 +9,15 @@ import (
 
 	"errors"
 	"fmt"
+	"time"
 
+	"github.com/dedis/paper_chainiac/bftcosi"
 	"github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
 )
 
 func TestMain(m *testing.M) {
@@ -56,7 +60,7 @@ func TestService_ProposeSkipBlock(t *testing.T) {
 	local := onet.NewLocalTest()
 	defer local.CloseAll()
 	_, el, service := makeHELS(local, 5)
-	service.SkipBlocks = make(map[string]*SkipBlock)
+	service.db = &SkipBlockMap{SkipBlocks: make(map[string]*SkipBlock)}
 
 	// Setting up root roster
 	sbRoot := makeGenesisRoster(service, el)
@@ -69,7 +73,7 @@ func TestService_ProposeSkipBlock(t *testing.T) {
 	genesis.ParentBlockID = sbRoot.Hash
 	genesis.Roster = sbRoot.Roster
 	blockCount := 0
-	psbrMsg, err := service.ProposeSkipBlock(nil, &ProposeSkipBlock{nil, genesis})
+	psbrMsg, err := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: nil, Proposed: genesis})
 	assert.Nil(t, err)
 	psbr := psbrMsg.(*ProposedSkipBlockReply)
 	latest := psbr.Latest
@@ -87,7 +91,7 @@ func TestService_ProposeSkipBlock(t *testing.T) {
 	next.ParentBlockID = sbRoot.Hash
 	next.Roster = sbRoot.Roster
 	id := psbr.Latest.Hash
-	psbrMsg, err = service.ProposeSkipBlock(nil, &ProposeSkipBlock{id, next})
+	psbrMsg, err = service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: id, Proposed: next})
 	assert.Nil(t, err)
 	psbr2 := psbrMsg.(*ProposedSkipBlockReply)
 	log.Lvl2(psbr2)
@@ -120,15 +124,15 @@ func TestService_GetUpdateChain(t *testing.T) {
 	for i := 1; i < sbLength; i++ {
 		newSB := NewSkipBlock()
 		newSB.Roster = el
-		psbrMsg, err := s.ProposeSkipBlock(nil,
-			&ProposeSkipBlock{sbs[i-1].Hash, newSB})
+		psbrMsg, err := s.ProposeSkipBlock(
+			&ProposeSkipBlock{LatestID: sbs[i-1].Hash, Proposed: newSB})
 		assert.Nil(t, err)
 		reply := psbrMsg.(*ProposedSkipBlockReply)
 		sbs[i] = reply.Latest
 	}
 
 	for i := 0; i < sbLength; i++ {
-		m, err := s.GetUpdateChain(nil, &GetUpdateChain{sbs[i].Hash})
+		m, err := s.GetUpdateChain(&GetUpdateChain{sbs[i].Hash})
 		sbc := m.(*GetUpdateChainReply)
 		log.ErrFatal(err)
 		if !sbc.Update[0].Equal(sbs[i]) {
@@ -174,13 +178,13 @@ func TestService_SetChildrenSkipBlock(t *testing.T) {
 	sbRoot := makeGenesisRoster(service, el)
 	sbInter := makeGenesisRosterArgs(service, el, sbRoot.Hash, VerifyNone, 1, 1)
 	scsb := &SetChildrenSkipBlock{sbRoot.Hash, sbInter.Hash}
-	service.SetChildrenSkipBlock(nil, scsb)
+	service.SetChildrenSkipBlock(scsb)
 	// Verifying other nodes also got the updated chains
 	// Check for the root-chain
 	for i, h := range hosts {
 		log.Lvlf2("%x", skipchainSID)
 		s := local.Services[h.ServerIdentity.ID][skipchainSID].(*Service)
-		m, err := s.GetUpdateChain(h.ServerIdentity, &GetUpdateChain{sbRoot.Hash})
+		m, err := s.GetUpdateChain(&GetUpdateChain{sbRoot.Hash})
 		log.ErrFatal(err, "Failed in iteration="+strconv.Itoa(i)+":")
 		sb := m.(*GetUpdateChainReply)
 		log.Lvl2(s.Context)
@@ -194,7 +198,7 @@ func TestService_SetChildrenSkipBlock(t *testing.T) {
 		}
 		// We need to verify the signature on the child-link, too. This
 		// has to be signed by the collective signature of sbRoot.
-		if err = sbRoot.VerifySignatures(); err != nil {
+		if err := sbRoot.VerifySignatures(); err != nil {
 			t.Fatal("Signature on child-link is not valid")
 		}
 	}
@@ -203,7 +207,7 @@ func TestService_SetChildrenSkipBlock(t *testing.T) {
 	for _, h := range hosts {
 		s := local.Services[h.ServerIdentity.ID][skipchainSID].(*Service)
 
-		m, err := s.GetUpdateChain(h.ServerIdentity, &GetUpdateChain{sbInter.Hash})
+		m, err := s.GetUpdateChain(&GetUpdateChain{sbInter.Hash})
 		sb := m.(*GetUpdateChainReply)
 
 		log.ErrFatal(err)
@@ -213,7 +217,7 @@ func TestService_SetChildrenSkipBlock(t *testing.T) {
 		if !bytes.Equal(sb.Update[0].ParentBlockID, sbRoot.Hash) {
 			t.Fatal("The intermediate SkipBlock doesn't point to the root")
 		}
-		if err = sb.Update[0].VerifySignatures(); err != nil {
+		if err := sb.Update[0].VerifySignatures(); err != nil {
 			t.Fatal("Signature of that SkipBlock doesn't fit")
 		}
 	}
@@ -236,8 +240,8 @@ func TestService_MultiLevel(t *testing.T) {
 			for sbi := 1; sbi < 10; sbi++ {
 				sb := NewSkipBlock()
 				sb.Roster = el
-				psbr, err := service.ProposeSkipBlock(nil,
-					&ProposeSkipBlock{latest.Hash, sb})
+				psbr, err := service.ProposeSkipBlock(
+					&ProposeSkipBlock{LatestID: latest.Hash, Proposed: sb})
 				log.ErrFatal(err)
 				latest = psbr.(*ProposedSkipBlockReply).Latest
 			}
@@ -249,6 +253,53 @@ func TestService_MultiLevel(t *testing.T) {
 	// Setting up two chains and linking one to the other
 }
 
+func TestService_RandomSkipChain(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, el, service := makeHELS(local, 3)
+
+	sbs := []*SkipBlock{makeGenesisRosterArgs(service, el, nil, VerifyNone, 0, 5)}
+	for i := 1; i < 30; i++ {
+		sb := NewSkipBlock()
+		sb.Roster = el
+		psbr, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: sbs[i-1].Hash, Proposed: sb})
+		log.ErrFatal(cerr)
+		sb = psbr.(*ProposedSkipBlockReply).Latest
+		require.Equal(t, randomHeight(sb.SkipBlockFix), sb.Height)
+		// Every back-link points to the latest block that is high enough
+		for h, bl := range sb.BackLinkIds {
+			j := i - 1
+			for sbs[j].Height < h+1 {
+				j--
+			}
+			require.True(t, bl.Equal(sbs[j].Hash), "back-link %d of %d", h, i)
+		}
+		sbs = append(sbs, sb)
+	}
+
+	m, cerr := service.GetUpdateChain(&GetUpdateChain{sbs[0].Hash})
+	log.ErrFatal(cerr)
+	update := m.(*GetUpdateChainReply).Update
+	require.True(t, update[len(update)-1].Equal(sbs[len(sbs)-1]))
+	assert.True(t, len(update) < len(sbs))
+	log.ErrFatal(VerifyChain(sbs[0], update))
+
+	// A leader can't choose the height of a block
+	sb := sbs[len(sbs)-1].Copy()
+	sb.Height++
+	sb.BackLinkIds = append(sb.BackLinkIds, sbs[0].Hash)
+	sb.updateHash()
+	require.NotNil(t, verifyLinks(sbs[len(sbs)-2], sb))
+
+	// Nor by changing the fields it chooses
+	sb = sbs[len(sbs)-1].Copy()
+	for i := 0; i < 16; i++ {
+		sb.Timestamp++
+		sb.Data = []byte(strconv.Itoa(i))
+		require.Equal(t, sbs[len(sbs)-1].Height, randomHeight(sb.SkipBlockFix))
+	}
+}
+
 func checkMLForwardBackward(service *Service, root *SkipBlock, base, height int) error {
 	genesis, ok := service.getSkipBlockByID(root.Hash)
 	if !ok {
@@ -262,7 +313,7 @@ func checkMLForwardBackward(service *Service, root *SkipBlock, base, height int)
 }
 
 func checkMLUpdate(service *Service, root, latest *SkipBlock, base, height int) error {
-	chain, err := service.GetUpdateChain(nil, &GetUpdateChain{root.Hash})
+	chain, err := service.GetUpdateChain(&GetUpdateChain{root.Hash})
 	if err != nil {
 		return err
 	}
@@ -304,8 +355,8 @@ func TestService_Verification(t *testing.T) {
 	sb.BaseHeight = 1
 	sb.ParentBlockID = sbRoot.Hash
 	sb.VerifierID = VerifyShard
-	_, err := service.ProposeSkipBlock(nil,
-		&ProposeSkipBlock{nil, sb})
+	_, err := service.ProposeSkipBlock(
+		&ProposeSkipBlock{LatestID: nil, Proposed: sb})
 	if err == nil {
 		t.Fatal("Shouldn't accept a non-confoirming skipblock")
 	}
@@ -316,7 +367,7 @@ func TestService_Verification(t *testing.T) {
 	elSub := onet.NewRoster(el.List[0:2])
 	sbInter = makeGenesisRosterArgs(service, elSub, sbRoot.Hash, VerifyShard, 1, 1)
 	scsb := &SetChildrenSkipBlock{sbRoot.Hash, sbInter.Hash}
-	service.SetChildrenSkipBlock(nil, scsb)
+	service.SetChildrenSkipBlock(scsb)
 }
 
 func TestCopy(t *testing.T) {
@@ -354,8 +405,8 @@ func TestService_SignBlock(t *testing.T) {
 	el2 := onet.NewRoster(el.List[0:2])
 	sb := NewSkipBlock()
 	sb.Roster = el2
-	psbr, err := service.ProposeSkipBlock(nil,
-		&ProposeSkipBlock{sbRoot.Hash, sb})
+	psbr, err := service.ProposeSkipBlock(
+		&ProposeSkipBlock{LatestID: sbRoot.Hash, Proposed: sb})
 	log.ErrFatal(err)
 	reply := psbr.(*ProposedSkipBlockReply)
 	sbRoot = reply.Previous
@@ -386,8 +437,8 @@ func launchVerification(t *testing.T, services []*Service, n int, prev *SkipBloc
 	for _, s := range services {
 		s.testVerify = false
 	}
-	sb, err := services[n].ProposeSkipBlock(nil,
-		&ProposeSkipBlock{prev.Hash, next})
+	sb, err := services[n].ProposeSkipBlock(
+		&ProposeSkipBlock{LatestID: prev.Hash, Proposed: next})
 	log.ErrFatal(err)
 	for _, s := range services {
 		if !s.testVerify {
@@ -398,6 +449,130 @@ func launchVerification(t *testing.T, services []*Service, n int, prev *SkipBloc
 }
 
 func TestService_ForwardSignature(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, el, service := makeHELS(local, 4)
+
+	genesis := NewSkipBlock()
+	genesis.Roster = el
+	genesis.MaximumHeight = 1
+	genesis.BaseHeight = 1
+	psbr, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: nil, Proposed: genesis})
+	log.ErrFatal(cerr)
+	genesis = psbr.(*ProposedSkipBlockReply).Latest
+
+	// The new roster has to be authorized by the old one
+	el2 := onet.NewRoster(el.List[0:3])
+	sb := NewSkipBlock()
+	sb.Roster = el2
+	psbr, cerr = service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: genesis.Hash, Proposed: sb})
+	log.ErrFatal(cerr)
+	reply := psbr.(*ProposedSkipBlockReply)
+	genesis, sb = reply.Previous, reply.Latest
+	log.ErrFatal(genesis.VerifySignatures())
+	log.ErrFatal(genesis.VerifyForward(sb))
+	if genesis.ForwardLink[0].VerifySignature(el2.Publics()) == nil {
+		t.Fatal("Forward-link should be signed by the old roster")
+	}
+
+	// A client only knowing the genesis-block can follow the roster
+	sb3 := NewSkipBlock()
+	sb3.Roster = el2
+	psbr, cerr = service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: sb.Hash, Proposed: sb3})
+	log.ErrFatal(cerr)
+	m, cerr := service.GetUpdateChain(&GetUpdateChain{genesis.Hash})
+	log.ErrFatal(cerr)
+	update := m.(*GetUpdateChainReply).Update
+	assert.Equal(t, 3, len(update))
+	for i := 0; i < len(update)-1; i++ {
+		log.ErrFatal(update[i].VerifyForward(update[i+1]))
+	}
+
+	// Tampering with the link is detected
+	fl := update[0].ForwardLink[0]
+	fl.Hash = update[2].Hash
+	assert.NotNil(t, update[0].VerifyForward(update[2]))
+}
+
+func TestService_Timestamp(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, el, service := makeHELS(local, 3)
+	genesis := makeGenesisRoster(service, el)
+	now := time.Now()
+	require.Nil(t, verifyTimestamp(genesis, now))
+
+	// A block from the future or from long ago is refused
+	sb := NewSkipBlock()
+	sb.Roster = el
+	sb.MaximumHeight = 1
+	sb.BaseHeight = 1
+	for _, ts := range []time.Time{now.Add(2 * MaxClockSkew),
+		now.Add(-2 * MaxBlockAge)} {
+		sb.Timestamp = ts.UnixNano()
+		sb.updateHash()
+		require.NotNil(t, verifyTimestamp(sb, now))
+		data, err := network.Marshal(sb)
+		log.ErrFatal(err)
+		require.False(t, service.bftVerify(sb.Hash, data))
+	}
+
+	// Timestamps must not go backwards
+	sb2 := NewSkipBlock()
+	sb2.Roster = el
+	psbr, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: genesis.Hash, Proposed: sb2})
+	log.ErrFatal(cerr)
+	sb2 = psbr.(*ProposedSkipBlockReply).Latest.Copy()
+	sb2.Timestamp = genesis.Timestamp - 1
+	sb2.updateHash()
+	require.NotNil(t, verifyLinks(genesis, sb2))
+}
+
+func TestService_RefuseUnlinked(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, el, service := makeHELS(local, 3)
+	genesis := makeGenesisRoster(service, el)
+
+	verify := func(sb *SkipBlock) bool {
+		sb.updateHash()
+		data, err := network.Marshal(sb)
+		log.ErrFatal(err)
+		return service.bftVerify(sb.Hash, data)
+	}
+	sb := genesis.Copy()
+	sb.Index = 1
+	sb.Height = 1
+	sb.Timestamp = time.Now().UnixNano()
+
+	// Missing back-links must not panic
+	sb.BackLinkIds = nil
+	require.False(t, verify(sb))
+
+	// An unknown previous block doesn't skip the checks of the links
+	sb.BackLinkIds = []SkipBlockID{SkipBlockID("unknown")}
+	require.False(t, verify(sb))
+
+	// Only one block following the same block is signed
+	first := sb.Copy()
+	first.BackLinkIds = []SkipBlockID{genesis.Hash}
+	first.updateHash()
+	second := first.Copy()
+	second.Data = []byte("second")
+	second.updateHash()
+	log.ErrFatal(service.signSuccessor(genesis, first))
+	log.ErrFatal(service.signSuccessor(genesis, first))
+	require.NotNil(t, service.signSuccessor(genesis, second))
+
+	// Once both rounds of the first block ended without our signature,
+	// the second block can follow
+	service.endSuccessor(first.Hash, false)
+	require.NotNil(t, service.signSuccessor(genesis, second))
+	service.endSuccessor(first.Hash, false)
+	log.ErrFatal(service.signSuccessor(genesis, second))
+	// A block we signed in a commit round stays reserved
+	service.endSuccessor(second.Hash, true)
+	require.NotNil(t, service.signSuccessor(genesis, first))
 }
 
 func TestService_RegisterVerification(t *testing.T) {
@@ -417,6 +592,227 @@ func TestService_RegisterVerification(t *testing.T) {
 	assert.Equal(t, 3, len(ver))
 }
 
+func TestService_ComposedVerifier(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, el, s1 := makeHELS(local, 3)
+	sbRoot := makeGenesisRoster(s1, el)
+
+	VerifyRefuse := VerifierID(uuid.NewV5(uuid.NamespaceURL, "Refuse"))
+	log.ErrFatal(RegisterVerifier(&VerifierInfo{
+		ID:      VerifyRefuse,
+		Name:    "Refuse",
+		Version: 2,
+	}, func(s *Service, newest *SkipBlock) error {
+		if string(newest.Data) == "refuse" {
+			return errors.New("data says refuse")
+		}
+		return nil
+	}))
+	vid, err := RegisterComposedVerifier("ShardRefuse", 1, VerifyShard, VerifyRefuse)
+	log.ErrFatal(err)
+	info, ok := DescribeVerifier(vid)
+	assert.True(t, ok)
+	assert.Equal(t, []VerifierID{VerifyShard, VerifyRefuse}, info.Composed)
+	found := false
+	for _, v := range RegisteredVerifiers() {
+		if v.ID == vid {
+			found = true
+		}
+	}
+	assert.True(t, found)
+
+	sb := NewSkipBlock()
+	sb.Roster = el
+	sb.MaximumHeight = 1
+	sb.BaseHeight = 1
+	sb.ParentBlockID = sbRoot.Hash
+	sb.VerifierID = vid
+	sb.Data = []byte("refuse")
+	_, cerr := s1.ProposeSkipBlock(&ProposeSkipBlock{LatestID: nil, Proposed: sb})
+	if cerr == nil {
+		t.Fatal("Composed verifier should refuse")
+	}
+	assert.Equal(t, ErrorVerification, cerr.ErrorCode())
+	assert.Contains(t, cerr.ErrorMsg(), "data says refuse")
+
+	sb.Data = []byte("accept")
+	_, cerr = s1.ProposeSkipBlock(&ProposeSkipBlock{LatestID: nil, Proposed: sb})
+	if cerr != nil {
+		t.Fatal("Composed verifier should accept:", cerr)
+	}
+}
+
+func TestService_AcceptancePolicy(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, el, s1 := makeHELS(local, 4)
+
+	// The last node of the roster refuses all blocks
+	VerifyRefuseLast := VerifierID(uuid.NewV5(uuid.NamespaceURL, "RefuseLast"))
+	log.ErrFatal(RegisterVerifier(&VerifierInfo{
+		ID:      VerifyRefuseLast,
+		Name:    "RefuseLast",
+		Version: 1,
+	}, func(s *Service, newest *SkipBlock) error {
+		if s.ServerIdentity().ID.Equal(el.List[3].ID) {
+			return errors.New("refusing everything")
+		}
+		return nil
+	}))
+
+	newGenesis := func(max int) *SkipBlock {
+		sb := NewSkipBlock()
+		sb.Roster = el
+		sb.MaximumHeight = 2
+		sb.BaseHeight = 2
+		sb.VerifierID = VerifyRefuseLast
+		sb.MaxExceptions = max
+		return sb
+	}
+	_, cerr := s1.ProposeSkipBlock(&ProposeSkipBlock{LatestID: nil, Proposed: newGenesis(0)})
+	require.NotNil(t, cerr, "All nodes need to sign")
+	_, cerr = s1.ProposeSkipBlock(&ProposeSkipBlock{LatestID: nil, Proposed: newGenesis(-2)})
+	require.NotNil(t, cerr)
+
+	var genesis *SkipBlock
+	for _, max := range []int{1, ExceptionsBFT} {
+		psbr, cerr := s1.ProposeSkipBlock(&ProposeSkipBlock{LatestID: nil, Proposed: newGenesis(max)})
+		log.ErrFatal(cerr)
+		genesis = psbr.(*ProposedSkipBlockReply).Latest
+		missing := genesis.BlockSig.Missing(len(el.List))
+		require.Equal(t, 1, len(missing))
+		assert.Equal(t, 3, missing[0].Index)
+		require.NotNil(t, genesis.BlockSig.Policy)
+		assert.Equal(t, 3, genesis.BlockSig.Policy.Threshold)
+		log.ErrFatal(genesis.VerifySignatures())
+
+		sb := NewSkipBlock()
+		sb.Roster = el
+		psbr, cerr = s1.ProposeSkipBlock(&ProposeSkipBlock{LatestID: genesis.Hash, Proposed: sb})
+		log.ErrFatal(cerr)
+		reply := psbr.(*ProposedSkipBlockReply)
+		assert.Equal(t, max, reply.Latest.MaxExceptions)
+		log.ErrFatal(reply.Previous.VerifySignatures())
+		log.ErrFatal(reply.Latest.VerifySignatures())
+		log.ErrFatal(VerifyChain(reply.Previous, []*SkipBlock{reply.Latest}))
+	}
+
+	ex := genesis.BlockSig.Missing(len(el.List))
+	require.Nil(t, verifyExceptions(ex, 4, 1))
+	require.NotNil(t, verifyExceptions(ex, 4, 0))
+	require.NotNil(t, verifyExceptions(append(ex, ex[0]), 4, 2))
+	require.NotNil(t, verifyExceptions([]bftcosi.Exception{{Index: 4}}, 4, 1))
+	// Exceptions with commitments chosen by the signer are refused
+	legacy := genesis.Copy()
+	legacy.BlockSig.Bitmap = nil
+	legacy.BlockSig.Exceptions = []bftcosi.Exception{{Index: 3,
+		Commitment: network.Suite.Point().Null()}}
+	require.NotNil(t, legacy.VerifySignatures())
+	// A block can't claim a stricter policy than it has been signed with
+	genesis.MaxExceptions = 0
+	require.NotNil(t, genesis.VerifySignatures())
+}
+
+func TestService_ConcurrentProposals(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, el, service := makeHELS(local, 3)
+	genesis := makeGenesisRosterArgs(service, el, nil, VerifyNone, 2, 3)
+
+	nbr := 5
+	errs := make(chan onet.ClientError, nbr)
+	for i := 0; i < nbr; i++ {
+		go func() {
+			sb := NewSkipBlock()
+			sb.Roster = el
+			_, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: genesis.Hash, Proposed: sb})
+			errs <- cerr
+		}()
+	}
+	accepted := 0
+	for i := 0; i < nbr; i++ {
+		if cerr := <-errs; cerr != nil {
+			assert.Equal(t, ErrorStaleLatest, cerr.ErrorCode())
+		} else {
+			accepted++
+		}
+	}
+	assert.Equal(t, 1, accepted)
+	tip, ok := service.chainTip(genesis.Hash)
+	require.True(t, ok)
+	assert.Equal(t, 1, tip.Index)
+}
+
+func TestService_SignTimeout(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, el, service := makeHELS(local, 3)
+
+	// For all blocks after the genesis block, all nodes except the leader
+	// wait until release is closed
+	release := make(chan struct{})
+	defer close(release)
+	VerifyStuck := VerifierID(uuid.NewV5(uuid.NamespaceURL, "Stuck"))
+	log.ErrFatal(RegisterVerifier(&VerifierInfo{
+		ID:      VerifyStuck,
+		Name:    "Stuck",
+		Version: 1,
+	}, func(s *Service, newest *SkipBlock) error {
+		if newest.Index > 0 && !s.ServerIdentity().ID.Equal(el.List[0].ID) {
+			<-release
+		}
+		return nil
+	}))
+	genesis := makeGenesisRosterArgs(service, el, nil, VerifyStuck, 1, 1)
+
+	sb := NewSkipBlock()
+	sb.Roster = el
+	_, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: genesis.Hash,
+		Proposed: sb, Timeout: 500})
+	require.NotNil(t, cerr)
+	assert.Equal(t, ErrorRosterUnavailable, cerr.ErrorCode())
+
+	// Cancel a proposal that would wait for the default timeout. Only
+	// the proposer knows the secret to cancel it.
+	secret := []byte("secret")
+	errs := make(chan onet.ClientError)
+	go func() {
+		sb := NewSkipBlock()
+		sb.Roster = el
+		_, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: genesis.Hash,
+			Proposed: sb, CancelHash: CancelHash(secret)})
+		errs <- cerr
+	}()
+	for {
+		_, cerr = service.CancelProposal(&CancelProposal{genesis.Hash, []byte("wrong")})
+		require.NotNil(t, cerr, "Cancelled with wrong secret")
+		if _, cerr = service.CancelProposal(&CancelProposal{genesis.Hash, secret}); cerr == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cerr = <-errs
+	require.NotNil(t, cerr)
+	assert.Equal(t, ErrorCancelled, cerr.ErrorCode())
+	_, cerr = service.CancelProposal(&CancelProposal{genesis.Hash, secret})
+	assert.NotNil(t, cerr, "Nothing to cancel")
+
+	c := NewClient()
+	_, err := c.CancelProposal(genesis)
+	assert.NotNil(t, err, "Client without secret")
+	c.CancelSecret = secret
+	results, err := c.CancelProposal(genesis)
+	assert.NotNil(t, err, "Nothing to cancel")
+	require.Equal(t, len(el.List), len(results))
+	for _, e := range results {
+		assert.NotNil(t, e)
+	}
+	tip, ok := service.chainTip(genesis.Hash)
+	require.True(t, ok)
+	assert.Equal(t, 0, tip.Index)
+}
+
 // makes a genesis Roster-block
 func makeGenesisRosterArgs(s *Service, el *onet.Roster, parent SkipBlockID,
 	vid VerifierID, base, height int) *SkipBlock {
@@ -426,8 +822,8 @@ func makeGenesisRosterArgs(s *Service, el *onet.Roster, parent SkipBlockID,
 	sb.BaseHeight = base
 	sb.ParentBlockID = parent
 	sb.VerifierID = vid
-	psbrMsg, err := s.ProposeSkipBlock(nil,
-		&ProposeSkipBlock{nil, sb})
+	psbrMsg, err := s.ProposeSkipBlock(
+		&ProposeSkipBlock{LatestID: nil, Proposed: sb})
 	log.ErrFatal(err)
 	psbr := psbrMsg.(*ProposedSkipBlockReply)
 	return psbr.Latest
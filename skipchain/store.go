@@ -0,0 +1,538 @@
+package skipchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// BlockStore is the interface the service uses to keep its SkipBlocks. A
+// SkipBlock is stored under its hash and storing a block with an already
+// known hash replaces the previous version, which happens every time a
+// forward-link or a child-link is added.
+type BlockStore interface {
+	// GetByID returns the SkipBlock with the given hash or false if it
+	// is not known.
+	GetByID(id SkipBlockID) (*SkipBlock, bool)
+	// Store adds or replaces the SkipBlock. Once Store returned without
+	// error, the block must survive a restart of the conode.
+	Store(sb *SkipBlock) error
+	// Len returns how many different SkipBlocks are stored.
+	Len() int
+	// Range calls f for every stored SkipBlock, in no particular order,
+	// until f returns false.
+	Range(f func(sb *SkipBlock) bool)
+	// Close releases all resources held by the store.
+	Close() error
+}
+
+// GetByID returns the SkipBlock or false if it doesn't exist.
+func (sbm *SkipBlockMap) GetByID(id SkipBlockID) (*SkipBlock, bool) {
+	sbm.mutex.Lock()
+	defer sbm.mutex.Unlock()
+	sb, ok := sbm.SkipBlocks[string(id)]
+	return sb, ok
+}
+
+// Store keeps the SkipBlock in memory only.
+func (sbm *SkipBlockMap) Store(sb *SkipBlock) error {
+	sbm.mutex.Lock()
+	defer sbm.mutex.Unlock()
+	sbm.SkipBlocks[string(sb.Hash)] = sb
+	return nil
+}
+
+// Len returns the number of SkipBlocks in the map.
+func (sbm *SkipBlockMap) Len() int {
+	sbm.mutex.Lock()
+	defer sbm.mutex.Unlock()
+	return len(sbm.SkipBlocks)
+}
+
+// Range calls f for all SkipBlocks in the map. The map can be changed by f.
+func (sbm *SkipBlockMap) Range(f func(sb *SkipBlock) bool) {
+	sbm.mutex.Lock()
+	sbs := make([]*SkipBlock, 0, len(sbm.SkipBlocks))
+	for _, sb := range sbm.SkipBlocks {
+		sbs = append(sbs, sb)
+	}
+	sbm.mutex.Unlock()
+	for _, sb := range sbs {
+		if !f(sb) {
+			return
+		}
+	}
+}
+
+// Close does nothing for an in-memory map.
+func (sbm *SkipBlockMap) Close() error {
+	return nil
+}
+
+const (
+	// storeLogName is the append-only file holding all SkipBlocks.
+	storeLogName = "skipblocks.log"
+	// storeIndexName is the checkpoint of the index of the log.
+	storeIndexName = "skipblocks.idx"
+	// storeLockName is locked by the process using the store.
+	storeLockName = "skipblocks.lock"
+	// storeIndexInterval is how many records are appended to the log
+	// before the index is written again.
+	storeIndexInterval = 64
+	// recordHeaderSize is the length and the crc32 of a record.
+	recordHeaderSize = 8
+	// storeCompactSize is the size of the log from which on it is
+	// compacted once more than half of it are outdated records.
+	storeCompactSize = 1 << 20
+)
+
+// FileStore is a crash-safe BlockStore on disk. Every SkipBlock is
+// appended as a record to a write-ahead log which is fsync'ed before
+// Store returns. A record is
+//
+//	length uint32 | crc32 uint32 | network.Marshal(SkipBlock)
+//
+// The offset of the latest record of every SkipBlock is kept in an index
+// that is checkpointed from time to time by atomically replacing the index
+// file. On startup the checkpoint is loaded and all records appended after
+// it are replayed. A torn record at the end of the log, as left behind by a
+// power loss, is cut off. As every new forward-link appends the whole block
+// again, the log is compacted to the latest records once most of it is
+// outdated. Only one process at a time can open the store.
+type FileStore struct {
+	mutex sync.Mutex
+	dir   string
+	lock  *os.File
+	log   *os.File
+	// size is the end of the last valid record in the log
+	size int64
+	// index points from the SkipBlockID to the offset of its last record
+	index map[string]int64
+	// live is the length of all records pointed to by the index
+	live int64
+	// unindexed counts the records appended since the last checkpoint
+	unindexed int
+}
+
+// NewFileStore opens or creates the store in the directory and recovers
+// all SkipBlocks that have been stored in there before.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := lockStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path.Join(dir, storeLogName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	fs := &FileStore{
+		dir:   dir,
+		lock:  lock,
+		log:   f,
+		index: map[string]int64{},
+	}
+	if err := fs.recover(); err != nil {
+		f.Close()
+		lock.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// GetByID reads the latest version of the SkipBlock from the log.
+func (fs *FileStore) GetByID(id SkipBlockID) (*SkipBlock, bool) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	off, ok := fs.index[string(id)]
+	if !ok {
+		return nil, false
+	}
+	sb, _, err := fs.readRecord(off, fs.size)
+	if err != nil {
+		log.Error("Couldn't read skipblock", id, ":", err)
+		return nil, false
+	}
+	return sb, true
+}
+
+// Store appends the SkipBlock to the log and returns once it is on disk.
+func (fs *FileStore) Store(sb *SkipBlock) error {
+	return fs.StoreBatch([]*SkipBlock{sb})
+}
+
+// StoreBatch appends all SkipBlocks to the log and returns once they are on
+// disk. This is much faster than storing them one by one, as the log is
+// only synced once.
+func (fs *FileStore) StoreBatch(sbs []*SkipBlock) error {
+	var recs []byte
+	offs := make([]int, len(sbs))
+	for i, sb := range sbs {
+		buf, err := network.Marshal(sb)
+		if err != nil {
+			return err
+		}
+		offs[i] = len(recs)
+		rec := make([]byte, recordHeaderSize+len(buf))
+		binary.BigEndian.PutUint32(rec[0:4], uint32(len(buf)))
+		binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(buf))
+		copy(rec[recordHeaderSize:], buf)
+		recs = append(recs, rec...)
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if _, err := fs.log.WriteAt(recs, fs.size); err != nil {
+		// Don't leave a half-written record behind
+		fs.log.Truncate(fs.size)
+		return err
+	}
+	if err := fs.log.Sync(); err != nil {
+		return err
+	}
+	fs.size += int64(len(recs))
+	for i, sb := range sbs {
+		fs.setIndex(string(sb.Hash), fs.size-int64(len(recs))+int64(offs[i]))
+	}
+	fs.unindexed += len(sbs)
+	if fs.size > storeCompactSize && fs.size > 2*fs.live {
+		if err := fs.compact(); err != nil {
+			log.Error("Couldn't compact log:", err)
+		}
+	} else if fs.unindexed >= storeIndexInterval {
+		if err := fs.writeIndex(); err != nil {
+			log.Error("Couldn't write index:", err)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of different SkipBlocks in the log.
+func (fs *FileStore) Len() int {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return len(fs.index)
+}
+
+// Range reads all SkipBlocks from the log and calls f with them. The store
+// can be changed by f.
+func (fs *FileStore) Range(f func(sb *SkipBlock) bool) {
+	fs.mutex.Lock()
+	offs := make([]int64, 0, len(fs.index))
+	for _, off := range fs.index {
+		offs = append(offs, off)
+	}
+	fs.mutex.Unlock()
+	for _, off := range offs {
+		fs.mutex.Lock()
+		sb, _, err := fs.readRecord(off, fs.size)
+		fs.mutex.Unlock()
+		if err != nil {
+			log.Error("Couldn't read skipblock at", off, ":", err)
+			continue
+		}
+		if !f(sb) {
+			return
+		}
+	}
+}
+
+// Close writes the index, closes the log and releases the lock.
+func (fs *FileStore) Close() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.unindexed > 0 {
+		if err := fs.writeIndex(); err != nil {
+			log.Error("Couldn't write index:", err)
+		}
+	}
+	err := fs.log.Close()
+	fs.lock.Close()
+	return err
+}
+
+// Compact rewrites the log with only the latest record of every SkipBlock.
+func (fs *FileStore) Compact() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.compact()
+}
+
+// compact copies the latest records to a new log and atomically replaces
+// the old log with it. The index checkpoint is removed before, so a crash
+// in between replays whichever log is in place.
+func (fs *FileStore) compact() error {
+	offs := make([]int64, 0, len(fs.index))
+	ids := map[int64]string{}
+	for id, off := range fs.index {
+		offs = append(offs, off)
+		ids[off] = id
+	}
+	sort.Slice(offs, func(i, j int) bool { return offs[i] < offs[j] })
+
+	name := path.Join(fs.dir, storeLogName)
+	f, err := os.OpenFile(name+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	index := map[string]int64{}
+	var size int64
+	for _, off := range offs {
+		buf, err := fs.readPayload(off, fs.size)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		rec := make([]byte, recordHeaderSize+len(buf))
+		binary.BigEndian.PutUint32(rec[0:4], uint32(len(buf)))
+		binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(buf))
+		copy(rec[recordHeaderSize:], buf)
+		if _, err := f.WriteAt(rec, size); err != nil {
+			f.Close()
+			return err
+		}
+		index[ids[off]] = size
+		size += int64(len(rec))
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	err = os.Remove(path.Join(fs.dir, storeIndexName))
+	if err != nil && !os.IsNotExist(err) {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		f.Close()
+		return err
+	}
+	if d, err := os.Open(fs.dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	log.Lvlf3("Compacted log %s from %d to %d bytes", fs.dir, fs.size, size)
+	fs.log.Close()
+	fs.log = f
+	fs.index = index
+	fs.size = size
+	fs.live = size
+	return fs.writeIndex()
+}
+
+// setIndex points id to the record at off and updates the length of the
+// live records.
+func (fs *FileStore) setIndex(id string, off int64) {
+	if old, ok := fs.index[id]; ok {
+		fs.live -= fs.recordLength(old)
+	}
+	fs.index[id] = off
+	fs.live += fs.recordLength(off)
+}
+
+// recordLength returns the length of the record at off including its
+// header, or 0 if it can't be read.
+func (fs *FileStore) recordLength(off int64) int64 {
+	hdr := make([]byte, recordHeaderSize)
+	if _, err := fs.log.ReadAt(hdr, off); err != nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint32(hdr[0:4])) + recordHeaderSize
+}
+
+// recover loads the last index checkpoint and replays the log from there.
+func (fs *FileStore) recover() error {
+	st, err := fs.log.Stat()
+	if err != nil {
+		return err
+	}
+	if err := fs.readIndex(st.Size()); err != nil {
+		log.Lvl2("Ignoring index and replaying whole log:", err)
+		fs.index = map[string]int64{}
+		fs.size = 0
+	}
+	for _, off := range fs.index {
+		fs.live += fs.recordLength(off)
+	}
+	for fs.size < st.Size() {
+		sb, n, err := fs.readRecord(fs.size, st.Size())
+		if err != nil {
+			log.Warnf("Cutting log %s at %d of %d: %s", fs.dir, fs.size,
+				st.Size(), err)
+			if err := fs.log.Truncate(fs.size); err != nil {
+				return err
+			}
+			if err := fs.log.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+		fs.setIndex(string(sb.Hash), fs.size)
+		fs.size += n
+		fs.unindexed++
+	}
+	log.Lvlf3("Recovered %d skipblocks from %s", len(fs.index), fs.dir)
+	return nil
+}
+
+// readRecord returns the SkipBlock stored at the offset and the length of
+// the record. The record has to end before end.
+func (fs *FileStore) readRecord(off, end int64) (*SkipBlock, int64, error) {
+	buf, err := fs.readPayload(off, end)
+	if err != nil {
+		return nil, 0, err
+	}
+	_, msg, err := network.Unmarshal(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	sb, ok := msg.(*SkipBlock)
+	if !ok {
+		return nil, 0, errors.New("record is not a skipblock")
+	}
+	return sb, int64(len(buf)) + recordHeaderSize, nil
+}
+
+// readPayload returns the checked payload of the record at the offset. A
+// length in the header that reaches beyond end is reported as a truncated
+// record, so a corrupt header doesn't allocate more than the log holds.
+func (fs *FileStore) readPayload(off, end int64) ([]byte, error) {
+	if off+recordHeaderSize > end {
+		return nil, errors.New("truncated record")
+	}
+	hdr := make([]byte, recordHeaderSize)
+	if _, err := fs.log.ReadAt(hdr, off); err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(hdr[0:4]))
+	if length > end-off-recordHeaderSize {
+		return nil, errors.New("truncated record")
+	}
+	buf := make([]byte, length)
+	if _, err := fs.log.ReadAt(buf, off+recordHeaderSize); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("truncated record")
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(buf) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return nil, errors.New("wrong checksum")
+	}
+	return buf, nil
+}
+
+// writeIndex atomically replaces the index file with the current index.
+// The index file is
+//
+//	size int64 | (length uint16 | SkipBlockID | offset int64)* | crc32 uint32
+//
+// where size is the part of the log covered by this index.
+func (fs *FileStore) writeIndex() error {
+	ids := make([]string, 0, len(fs.index))
+	for id := range fs.index {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(fs.size))
+	for _, id := range ids {
+		entry := make([]byte, 2+len(id)+8)
+		binary.BigEndian.PutUint16(entry[0:2], uint16(len(id)))
+		copy(entry[2:], id)
+		binary.BigEndian.PutUint64(entry[2+len(id):], uint64(fs.index[id]))
+		buf = append(buf, entry...)
+	}
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(buf))
+	buf = append(buf, crc...)
+
+	if err := writeFileAtomic(path.Join(fs.dir, storeIndexName), buf); err != nil {
+		return err
+	}
+	fs.unindexed = 0
+	return nil
+}
+
+// readIndex loads the index checkpoint, if it exists and fits a log of
+// length logSize.
+func (fs *FileStore) readIndex(logSize int64) error {
+	buf, err := ioutil.ReadFile(path.Join(fs.dir, storeIndexName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(buf) < 12 {
+		return errors.New("index too short")
+	}
+	body := buf[:len(buf)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(buf[len(buf)-4:]) {
+		return errors.New("index has wrong checksum")
+	}
+	size := int64(binary.BigEndian.Uint64(body[0:8]))
+	if size > logSize {
+		return errors.New("index covers more than the log")
+	}
+	index := map[string]int64{}
+	for pos := 8; pos < len(body); {
+		if pos+2 > len(body) {
+			return errors.New("corrupt index entry")
+		}
+		l := int(binary.BigEndian.Uint16(body[pos : pos+2]))
+		pos += 2
+		if pos+l+8 > len(body) {
+			return errors.New("corrupt index entry")
+		}
+		id := string(body[pos : pos+l])
+		pos += l
+		index[id] = int64(binary.BigEndian.Uint64(body[pos : pos+8]))
+		pos += 8
+	}
+	fs.index = index
+	fs.size = size
+	return nil
+}
+
+// writeFileAtomic writes the data to a temporary file, syncs it and renames
+// it to name, so that name holds either the old or the new content.
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	// Make the rename itself durable
+	d, err := os.Open(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
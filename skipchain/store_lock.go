@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package skipchain
+
+import (
+	"errors"
+	"os"
+	"path"
+	"syscall"
+)
+
+// lockStore takes an exclusive lock on the lock-file of the store in dir.
+// The lock is released when the returned file is closed or the process
+// exits, so a crashed conode doesn't leave it behind.
+func lockStore(dir string) (*os.File, error) {
+	f, err := os.OpenFile(path.Join(dir, storeLockName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errors.New("Store in " + dir + " is used by another process")
+		}
+		return nil, err
+	}
+	return f, nil
+}
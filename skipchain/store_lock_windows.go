@@ -0,0 +1,23 @@
+package skipchain
+
+import (
+	"os"
+	"path"
+	"syscall"
+)
+
+// lockStore opens the lock-file of the store in dir without sharing it, so
+// no other process can open it as long as the returned file is open.
+func lockStore(dir string) (*os.File, error) {
+	name := path.Join(dir, storeLockName)
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(p, syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+		0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "lock", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(h), name), nil
+}
@@ -0,0 +1,168 @@
+package skipchain
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestFileStore_Recover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skipchain_store")
+	log.ErrFatal(err)
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileStore(dir)
+	log.ErrFatal(err)
+	sbs := make([]*SkipBlock, storeIndexInterval+10)
+	for i := range sbs {
+		sbs[i] = NewSkipBlock()
+		sbs[i].Index = i
+		sbs[i].Data = []byte(strconv.Itoa(i))
+		sbs[i].updateHash()
+		log.ErrFatal(fs.Store(sbs[i]))
+	}
+	// Replacing a block keeps only the latest version
+	sbs[0].ForwardLink = []*BlockLink{{Hash: sbs[1].Hash, Signature: []byte{}}}
+	log.ErrFatal(fs.Store(sbs[0]))
+	require.Equal(t, len(sbs), fs.Len())
+
+	// Reopen without closing, so only the first checkpoint is available,
+	// as if the process had crashed and released the lock
+	log.ErrFatal(fs.lock.Close())
+	fs2, err := NewFileStore(dir)
+	log.ErrFatal(err)
+	require.Equal(t, len(sbs), fs2.Len())
+	for _, sb := range sbs {
+		sb2, ok := fs2.GetByID(sb.Hash)
+		require.True(t, ok)
+		require.True(t, sb.Equal(sb2))
+		require.Equal(t, sb.Index, sb2.Index)
+	}
+	sb0, _ := fs2.GetByID(sbs[0].Hash)
+	require.Equal(t, 1, len(sb0.ForwardLink))
+	log.ErrFatal(fs2.Close())
+	log.ErrFatal(fs.Close())
+}
+
+func TestFileStore_TornWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skipchain_store")
+	log.ErrFatal(err)
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileStore(dir)
+	log.ErrFatal(err)
+	sb := NewSkipBlock()
+	sb.Data = []byte("first")
+	sb.updateHash()
+	log.ErrFatal(fs.Store(sb))
+	log.ErrFatal(fs.Close())
+
+	// Simulate a power loss in the middle of appending a record
+	f, err := os.OpenFile(path.Join(dir, storeLogName), os.O_WRONLY|os.O_APPEND, 0600)
+	log.ErrFatal(err)
+	_, err = f.Write([]byte{0, 0, 1, 0, 1, 2, 3})
+	log.ErrFatal(err)
+	log.ErrFatal(f.Close())
+
+	fs, err = NewFileStore(dir)
+	log.ErrFatal(err)
+	require.Equal(t, 1, fs.Len())
+	sb2 := NewSkipBlock()
+	sb2.Data = []byte("second")
+	sb2.updateHash()
+	log.ErrFatal(fs.Store(sb2))
+	log.ErrFatal(fs.Close())
+
+	fs, err = NewFileStore(dir)
+	log.ErrFatal(err)
+	defer fs.Close()
+	require.Equal(t, 2, fs.Len())
+	_, ok := fs.GetByID(sb2.Hash)
+	require.True(t, ok)
+}
+
+func TestFileStore_CorruptLength(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skipchain_store")
+	log.ErrFatal(err)
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileStore(dir)
+	log.ErrFatal(err)
+	sb := NewSkipBlock()
+	sb.Data = []byte("first")
+	sb.updateHash()
+	log.ErrFatal(fs.Store(sb))
+	log.ErrFatal(fs.Close())
+
+	// A header claiming a record of almost 4GB must not be allocated
+	f, err := os.OpenFile(path.Join(dir, storeLogName), os.O_WRONLY|os.O_APPEND, 0600)
+	log.ErrFatal(err)
+	_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xf0, 1, 2, 3, 4, 5})
+	log.ErrFatal(err)
+	log.ErrFatal(f.Close())
+
+	fs, err = NewFileStore(dir)
+	log.ErrFatal(err)
+	defer fs.Close()
+	require.Equal(t, 1, fs.Len())
+	st, err := os.Stat(path.Join(dir, storeLogName))
+	log.ErrFatal(err)
+	require.Equal(t, fs.size, st.Size())
+}
+
+func TestFileStore_Compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skipchain_store")
+	log.ErrFatal(err)
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileStore(dir)
+	log.ErrFatal(err)
+	sb := NewSkipBlock()
+	sb.Data = make([]byte, 1024)
+	sb.updateHash()
+	other := NewSkipBlock()
+	other.Data = []byte("other")
+	other.updateHash()
+	log.ErrFatal(fs.Store(other))
+	// Every new forward-link appends the whole block again, until the
+	// log is compacted
+	for size := int64(0); size < fs.size; {
+		size = fs.size
+		sb.ForwardLink = append(sb.ForwardLink,
+			&BlockLink{Hash: other.Hash, Signature: []byte{}})
+		log.ErrFatal(fs.Store(sb))
+	}
+	require.True(t, fs.size < storeCompactSize)
+	require.Equal(t, fs.live, fs.size)
+	log.ErrFatal(fs.Close())
+
+	fs, err = NewFileStore(dir)
+	log.ErrFatal(err)
+	defer fs.Close()
+	require.Equal(t, 2, fs.Len())
+	sb2, ok := fs.GetByID(sb.Hash)
+	require.True(t, ok)
+	require.Equal(t, len(sb.ForwardLink), len(sb2.ForwardLink))
+	_, ok = fs.GetByID(other.Hash)
+	require.True(t, ok)
+}
+
+func TestFileStore_Lock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skipchain_store")
+	log.ErrFatal(err)
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileStore(dir)
+	log.ErrFatal(err)
+	_, err = NewFileStore(dir)
+	require.NotNil(t, err, "Store is already used")
+	log.ErrFatal(fs.Close())
+	fs, err = NewFileStore(dir)
+	log.ErrFatal(err)
+	log.ErrFatal(fs.Close())
+}
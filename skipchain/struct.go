@@ -6,12 +6,11 @@ import (
 	"fmt"
 
 	"errors"
+	"time"
 
 	"github.com/dedis/paper_chainiac/bftcosi"
 	"gopkg.in/dedis/crypto.v0/abstract"
-	"gopkg.in/dedis/crypto.v0/cosi"
 	"gopkg.in/dedis/onet.v1"
-	"gopkg.in/dedis/onet.v1/crypto"
 	"gopkg.in/dedis/onet.v1/log"
 	"gopkg.in/dedis/onet.v1/network"
 )
@@ -73,18 +72,80 @@ type SkipBlockFix struct {
 	Data []byte
 	// Roster holds the roster-definition of that SkipBlock
 	Roster *onet.Roster
+	// Timestamp is the time the leader proposed the SkipBlock, in
+	// nanoseconds since the Unix epoch
+	Timestamp int64
+	// MaxExceptions is the acceptance policy of the SkipChain and is fixed
+	// in the genesis-block: how many members of the roster may be missing
+	// in the collective signatures. ExceptionsBFT allows up to a third.
+	MaxExceptions int
+	// PayloadHash is set for blocks whose data is too big to be stored in
+	// Data: it is the hash of the payload, which is kept in the blob store
+	// of the conodes. See HashPayload.
+	PayloadHash []byte
+	// Version is the format of the block, which defines how it is hashed.
+	// It is fixed in the genesis-block.
+	Version int
+	// HashAlgorithm is the hash function of the SkipChain for blocks with
+	// BlockVersionCanonical or newer. It is fixed in the genesis-block.
+	HashAlgorithm HashAlgorithm
+	// SignTimeout is how many milliseconds the leader waits for the
+	// signature of the roster. It is fixed in the genesis-block, 0 uses
+	// DefaultSignTimeout.
+	SignTimeout int64
+	// SignatureScheme is how the roster signs the blocks and links of the
+	// SkipChain. It is fixed in the genesis-block.
+	SignatureScheme bftcosi.Scheme
+	// BLSKeys holds the BLS key of every member of the roster, in the
+	// order of the roster, if the SkipChain signs with bftcosi.SchemeBLS.
+	BLSKeys []*BLSKey
 }
 
-// addSliceToHash hashes the whole SkipBlockFix plus a slice of bytes.
-// This is used
-func (sbf *SkipBlockFix) calculateHash() SkipBlockID {
-	b, err := network.Marshal(sbf)
-	if err != nil {
-		log.Panic("Couldn't marshal SkipBlockFix:", err)
+// ExceptionsBFT as MaxExceptions accepts signatures where less than a third
+// of the roster is missing.
+const ExceptionsBFT = -1
+
+// allowedExceptions returns how many members of a roster of size n may be
+// missing in a signature.
+func (sbf *SkipBlockFix) allowedExceptions(n int) int {
+	if sbf.MaxExceptions == ExceptionsBFT {
+		return (n - 1) / 3
+	}
+	return sbf.MaxExceptions
+}
+
+// signTimeout returns how long the leader waits for a signature.
+func (sbf *SkipBlockFix) signTimeout() time.Duration {
+	if sbf.SignTimeout > 0 {
+		return time.Duration(sbf.SignTimeout) * time.Millisecond
+	}
+	return DefaultSignTimeout
+}
+
+// verifyExceptions checks that the exceptions of a signature by a roster of
+// size n are valid and that there are at most max of them.
+func verifyExceptions(exceptions []bftcosi.Exception, n, max int) error {
+	if len(exceptions) > max {
+		return fmt.Errorf("%d members didn't sign, but only %d are allowed",
+			len(exceptions), max)
 	}
-	h, err := crypto.HashBytes(network.Suite.Hash(), b)
+	seen := make(map[int]bool)
+	for _, ex := range exceptions {
+		if ex.Index < 0 || ex.Index >= n || seen[ex.Index] {
+			return errors.New("Invalid exception in signature")
+		}
+		seen[ex.Index] = true
+	}
+	return nil
+}
+
+// calculateHash hashes the SkipBlockFix in the format given by its version.
+// Blocks with an unknown format have no valid hash and nil is returned.
+func (sbf *SkipBlockFix) calculateHash() SkipBlockID {
+	h, err := sbf.hash()
 	if err != nil {
-		log.Panic("Couldn't hash SkipBlockFix:", err)
+		log.Error("Couldn't hash SkipBlockFix:", err)
+		return nil
 	}
 	return h
 }
@@ -111,7 +172,8 @@ type SkipBlock struct {
 func NewSkipBlock() *SkipBlock {
 	return &SkipBlock{
 		SkipBlockFix: &SkipBlockFix{
-			Data: make([]byte, 0),
+			Data:    make([]byte, 0),
+			Version: CurrentBlockVersion,
 		},
 		BlockSig: &bftcosi.BFTSignature{
 			Sig: make([]byte, 0),
@@ -122,22 +184,48 @@ func NewSkipBlock() *SkipBlock {
 
 // VerifySignatures returns whether all signatures are correctly signed
 // by the aggregate public key of the roster. It needs the aggregate key.
+// The number of members that didn't sign must follow the acceptance policy
+// of the SkipChain.
 func (sb *SkipBlock) VerifySignatures() error {
-	if err := sb.BlockSig.Verify(network.Suite, sb.Roster.Publics()); err != nil {
+	if err := sb.verifySig(sb.BlockSig, sb.Roster); err != nil {
 		log.Error(err.Error() + log.Stack())
 		return err
 	}
-	//for _, fl := range sb.ForwardLink {
-	//	if err := fl.VerifySignature(sb.Aggregate); err != nil {
-	//		return err
-	//	}
-	//}
-	//if sb.ChildSL != nil && sb.ChildSL.Hash == nil {
-	//	return sb.ChildSL.VerifySignature(sb.Aggregate)
-	//}
+	for _, fl := range sb.ForwardLink {
+		if err := sb.verifyLink(fl); err != nil {
+			return err
+		}
+	}
+	if sb.ChildSL != nil {
+		return sb.verifyChildSL()
+	}
 	return nil
 }
 
+// VerifyForward checks that the SkipBlock has a forward-link to next that
+// is signed by our roster. Like this a client that trusts us can trust next
+// and its roster, even if the roster changed.
+func (sb *SkipBlock) VerifyForward(next *SkipBlock) error {
+	if !next.calculateHash().Equal(next.Hash) {
+		return errors.New("Wrong hash of next block")
+	}
+	for _, fl := range sb.ForwardLink {
+		if fl.Hash.Equal(next.Hash) {
+			return sb.verifyLink(fl)
+		}
+	}
+	return errors.New("No forward-link to next block")
+}
+
+// verifyLink checks the signature of a link of our SkipBlock against our
+// roster and acceptance policy.
+func (sb *SkipBlock) verifyLink(bl *BlockLink) error {
+	if len(bl.Signature) < 64 {
+		return errors.New("Missing signature on link")
+	}
+	return sb.verifySig(bl.signature(bl.Hash), sb.Roster)
+}
+
 // Equal returns bool if both hashes are equal
 func (sb *SkipBlock) Equal(other *SkipBlock) bool {
 	return bytes.Equal(sb.Hash, other.Hash)
@@ -151,9 +239,13 @@ func (sb *SkipBlock) Copy() *SkipBlock {
 	sigCopy := make([]byte, len(b.BlockSig.Sig))
 	copy(sigCopy, b.BlockSig.Sig)
 	b.BlockSig = &bftcosi.BFTSignature{
-		Sig:        sigCopy,
-		Msg:        b.BlockSig.Msg,
-		Exceptions: b.BlockSig.Exceptions,
+		Sig:             sigCopy,
+		Msg:             b.BlockSig.Msg,
+		Exceptions:      b.BlockSig.Exceptions,
+		Policy:          b.BlockSig.Policy,
+		Scheme:          b.BlockSig.Scheme,
+		Bitmap:          b.BlockSig.Bitmap,
+		ExceptionCommit: b.BlockSig.ExceptionCommit,
 	}
 	b.ForwardLink = make([]*BlockLink, len(sb.ForwardLink))
 	for i, fl := range sb.ForwardLink {
@@ -198,8 +290,36 @@ func (sb *SkipBlock) updateHash() SkipBlockID {
 
 // BlockLink has the hash and a signature of a block
 type BlockLink struct {
-	Hash      SkipBlockID
+	Hash SkipBlockID
+	// Signature is the collective signature on Hash by the roster
+	// responsible for the block holding this link
 	Signature []byte
+	// Exceptions are the nodes that didn't sign
+	Exceptions []bftcosi.Exception
+	// Policy is the acceptance policy the roster signed together with
+	// Hash, nil for older links
+	Policy *bftcosi.Policy
+	// Scheme is the signature scheme of Signature
+	Scheme bftcosi.Scheme
+	// Bitmap marks the nodes that signed, nil for links whose Exceptions
+	// list the nodes that didn't sign
+	Bitmap []byte
+	// ExceptionCommit is the aggregate commitment of the nodes missing in
+	// the Bitmap of a bftcosi.SchemeCoSi signature
+	ExceptionCommit abstract.Point
+}
+
+// newLink returns the link to hash signed with sig.
+func newLink(hash SkipBlockID, sig *bftcosi.BFTSignature) *BlockLink {
+	return &BlockLink{
+		Hash:            hash,
+		Signature:       sig.Sig,
+		Exceptions:      sig.Exceptions,
+		Policy:          sig.Policy,
+		Scheme:          sig.Scheme,
+		Bitmap:          sig.Bitmap,
+		ExceptionCommit: sig.ExceptionCommit,
+	}
 }
 
 // NewBlockLink pre-initialises the signature so it can be sent
@@ -214,16 +334,43 @@ func NewBlockLink() *BlockLink {
 func (bl *BlockLink) Copy() *BlockLink {
 	sigCopy := make([]byte, len(bl.Signature))
 	copy(sigCopy, bl.Signature)
+	exCopy := make([]bftcosi.Exception, len(bl.Exceptions))
+	copy(exCopy, bl.Exceptions)
 	return &BlockLink{
-		Hash:      bl.Hash,
-		Signature: sigCopy,
+		Hash:            bl.Hash,
+		Signature:       sigCopy,
+		Exceptions:      exCopy,
+		Policy:          bl.Policy,
+		Scheme:          bl.Scheme,
+		Bitmap:          bl.Bitmap,
+		ExceptionCommit: bl.ExceptionCommit,
+	}
+}
+
+// signature returns the signature of the link on msg.
+func (bl *BlockLink) signature(msg []byte) *bftcosi.BFTSignature {
+	return &bftcosi.BFTSignature{
+		Sig:             bl.Signature,
+		Msg:             msg,
+		Exceptions:      bl.Exceptions,
+		Policy:          bl.Policy,
+		Scheme:          bl.Scheme,
+		Bitmap:          bl.Bitmap,
+		ExceptionCommit: bl.ExceptionCommit,
 	}
 }
 
 // VerifySignature returns whether the BlockLink has been signed
-// correctly using the aggregate key given.
+// correctly by the given public keys. It only verifies CoSi signatures,
+// links signed with bftcosi.SchemeBLS are refused - use
+// SkipBlock.VerifyForward, which verifies them with the BLS keys of the
+// block holding them.
 func (bl *BlockLink) VerifySignature(publics []abstract.Point) error {
-	// TODO: enable real verification once we have signatures
-	//return nil
-	return cosi.VerifySignature(network.Suite, publics, bl.Hash, bl.Signature)
+	if len(bl.Signature) < 64 {
+		return errors.New("Missing signature on link")
+	}
+	if bl.Scheme != bftcosi.SchemeCoSi {
+		return errors.New("Link is not signed with CoSi")
+	}
+	return bl.signature(bl.Hash).Verify(network.Suite, publics)
 }
@@ -0,0 +1,66 @@
+package skipchain
+
+import (
+	"time"
+
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// SubscribeWait is how long a Subscribe-request waits for new blocks before
+// it returns an empty reply and has to be sent again.
+var SubscribeWait = 30 * time.Second
+
+// Subscribe returns the blocks that have been added after the latest
+// blocks given in the request. If there are none, it waits until a new
+// block is stored or SubscribeWait passed.
+func (s *Service) Subscribe(sub *Subscribe) (network.Message, onet.ClientError) {
+	timeout := time.After(SubscribeWait)
+	for {
+		// Get the channel before looking at the blocks, so that we
+		// don't miss a block stored in between.
+		stored := s.blockStored()
+		reply := &SubscribeReply{}
+		for _, id := range sub.Latest {
+			sb, ok := s.getSkipBlockByID(id)
+			if !ok {
+				return nil, onet.NewClientErrorCode(4200, "Couldn't find latest block")
+			}
+			update := &SubscribeUpdate{Blocks: []*SkipBlock{sb}}
+			for len(sb.ForwardLink) > 0 && len(update.Blocks) <= maxGetBlocks {
+				sb, ok = s.getSkipBlockByID(sb.ForwardLink[0].Hash)
+				if !ok {
+					return nil, onet.NewClientErrorCode(4200, "Missing block in forward-chain")
+				}
+				update.Blocks = append(update.Blocks, sb)
+			}
+			if len(update.Blocks) > 1 {
+				reply.Updates = append(reply.Updates, update)
+			}
+		}
+		if len(reply.Updates) > 0 {
+			return reply, nil
+		}
+		select {
+		case <-stored:
+		case <-timeout:
+			return reply, nil
+		}
+	}
+}
+
+// blockStored returns a channel that is closed as soon as the next block
+// is stored.
+func (s *Service) blockStored() <-chan struct{} {
+	s.storedMutex.Lock()
+	defer s.storedMutex.Unlock()
+	return s.stored
+}
+
+// notifyStored wakes up all requests waiting for a new block.
+func (s *Service) notifyStored() {
+	s.storedMutex.Lock()
+	defer s.storedMutex.Unlock()
+	close(s.stored)
+	s.stored = make(chan struct{})
+}
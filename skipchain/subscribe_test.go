@@ -0,0 +1,65 @@
+package skipchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestService_Subscribe(t *testing.T) {
+	defer func(w time.Duration) { SubscribeWait = w }(SubscribeWait)
+	SubscribeWait = 100 * time.Millisecond
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	hosts, el, service := makeHELS(local, 3)
+
+	genesis := makeGenesisRosterArgs(service, el, nil, VerifyNone, 2, 3)
+	m, cerr := service.Subscribe(&Subscribe{[]SkipBlockID{genesis.Hash}})
+	log.ErrFatal(cerr)
+	assert.Equal(t, 0, len(m.(*SubscribeReply).Updates))
+
+	blocks := make(chan *SkipBlock)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- NewClient().Subscribe(hosts[1].ServerIdentity,
+			[]*SkipBlock{genesis}, blocks, stop)
+	}()
+	var sbs []*SkipBlock
+	latest := genesis
+	for i := 1; i <= 3; i++ {
+		sb := NewSkipBlock()
+		sb.Roster = el
+		psbr, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: latest.Hash, Proposed: sb})
+		log.ErrFatal(cerr)
+		latest = psbr.(*ProposedSkipBlockReply).Latest
+		select {
+		case sb := <-blocks:
+			require.True(t, sb.Equal(latest))
+			sbs = append(sbs, sb)
+		case <-time.After(10 * time.Second):
+			t.Fatal("Didn't get new block")
+		}
+	}
+	close(stop)
+	log.ErrFatal(<-done)
+
+	// Resuming from the first block returns the missing blocks
+	blocks = make(chan *SkipBlock, 2)
+	stop = make(chan struct{})
+	go func() {
+		done <- NewClient().Subscribe(hosts[2].ServerIdentity,
+			[]*SkipBlock{sbs[0]}, blocks, stop)
+	}()
+	assert.True(t, (<-blocks).Equal(sbs[1]))
+	assert.True(t, (<-blocks).Equal(sbs[2]))
+	close(stop)
+	log.ErrFatal(<-done)
+
+	_, cerr = service.Subscribe(&Subscribe{[]SkipBlockID{SkipBlockID("unknown")}})
+	assert.NotNil(t, cerr)
+}
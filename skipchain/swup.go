@@ -0,0 +1,137 @@
+package skipchain
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+	"gopkg.in/dedis/onet.v1/simul/monitor"
+)
+
+// SwupRelease has to be implemented by the data stored in a SkipBlock that
+// is verified by VerifySwup. The skipchain doesn't know how releases and
+// developer signatures look like, so it asks the release itself.
+type SwupRelease interface {
+	// SwupPackage returns the name and the version of the package.
+	SwupPackage() (name, version string)
+	// SwupSignatures returns how many of the developer signatures on the
+	// release are valid and how many are needed by the policy.
+	SwupSignatures() (valid, threshold int)
+	// SwupBuild returns whether a reproducible build has to be done and
+	// which hash the binary has to have. An empty hash is not checked.
+	SwupBuild() (build bool, binaryHash string)
+}
+
+// SwupBuildCommand is the reproducible build run by VerifySwup. The name of
+// the package is appended as last argument. The last line of the output of
+// the command has to be
+//
+//	Success wall user system [binaryHash]
+//
+// with the times in seconds.
+var SwupBuildCommand = []string{"./crawler.py", "cli"}
+
+// verifySwup checks the developer signatures of the release stored in the
+// newest block and runs the reproducible build if the release asks for it.
+func verifySwup(s *Service, newest *SkipBlock) error {
+	payload, err := s.Payload(newest)
+	if err != nil {
+		return err
+	}
+	_, msg, err := network.Unmarshal(payload)
+	if err != nil {
+		return errors.New("Couldn't unmarshal release: " + err.Error())
+	}
+	release, ok := msg.(SwupRelease)
+	if !ok {
+		return errors.New("Data is not a release")
+	}
+	pkgName, version := release.SwupPackage()
+	if err := verifyPackageName(pkgName); err != nil {
+		return err
+	}
+
+	verifyT := monitor.NewTimeMeasure("verify_" + pkgName)
+	// Verify all signatures
+	valid, threshold := release.SwupSignatures()
+	verifyT.Record()
+	if threshold <= 0 {
+		return fmt.Errorf("Invalid threshold %d for %s", threshold, pkgName)
+	}
+	if valid < threshold {
+		return fmt.Errorf("Only %d out of %d needed developer signatures for %s/%s",
+			valid, threshold, pkgName, version)
+	}
+
+	build, binaryHash := release.SwupBuild()
+	if !build {
+		return nil
+	}
+	buildT := monitor.NewTimeMeasure("build_" + pkgName)
+	// launch the reproducible build
+	hash, err := swupBuild(pkgName)
+	buildT.Record()
+	if err != nil {
+		return fmt.Errorf("Reproducible build of %s/%s failed: %s", pkgName,
+			version, err)
+	}
+	if binaryHash != "" && hash == "" {
+		return fmt.Errorf("Reproducible build of %s/%s didn't give a hash",
+			pkgName, version)
+	}
+	if binaryHash != "" && hash != binaryHash {
+		return fmt.Errorf("Reproducible build of %s/%s gives %s instead of %s",
+			pkgName, version, hash, binaryHash)
+	}
+	log.Lvl2("Verified reproducible build of", pkgName, version)
+	return nil
+}
+
+// verifyPackageName makes sure the name of the package, which comes from
+// the block, is passed as a name to the build and not as an option or a
+// path.
+func verifyPackageName(pkgName string) error {
+	if pkgName == "" || strings.HasPrefix(pkgName, "-") ||
+		strings.HasPrefix(pkgName, ".") ||
+		strings.ContainsAny(pkgName, "/\\\x00") {
+		return fmt.Errorf("Invalid package name %q", pkgName)
+	}
+	return nil
+}
+
+// swupBuild runs SwupBuildCommand on the package and returns the binary
+// hash printed by the build, if any.
+func swupBuild(pkgName string) (string, error) {
+	if len(SwupBuildCommand) == 0 {
+		return "", errors.New("No build command configured")
+	}
+	args := append([]string{}, SwupBuildCommand[1:]...)
+	args = append(args, pkgName)
+	cmd := exec.Command(SwupBuildCommand[0], args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	res := strings.Fields(lines[len(lines)-1])
+	if len(res) < 4 || res[0] != "Success" {
+		return "", errors.New("build didn't succeed: " + lines[len(lines)-1])
+	}
+	for i, m := range []string{"wall", "user", "system"} {
+		t, err := strconv.ParseFloat(res[i+1], 64)
+		if err != nil {
+			return "", err
+		}
+		monitor.RecordSingleMeasure("build_"+m, t)
+	}
+	if len(res) > 4 {
+		return res[4], nil
+	}
+	return "", nil
+}
@@ -0,0 +1,78 @@
+package skipchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func init() {
+	network.RegisterMessage(&testRelease{})
+}
+
+func TestVerifySwup(t *testing.T) {
+	defer func(cmd []string) { SwupBuildCommand = cmd }(SwupBuildCommand)
+
+	rel := &testRelease{Name: "test", Version: "1.0", Valid: 2,
+		Threshold: 3}
+	require.NotNil(t, verifySwup(nil, swupBlock(rel)), "too few signatures")
+
+	rel.Valid = 3
+	require.Nil(t, verifySwup(nil, swupBlock(rel)))
+
+	rel.Build = true
+	rel.BinaryHash = "abcd"
+	SwupBuildCommand = []string{"sh", "-c", "echo Success 1.0 0.5 0.2 abcd"}
+	require.Nil(t, verifySwup(nil, swupBlock(rel)))
+
+	SwupBuildCommand = []string{"sh", "-c", "echo Success 1.0 0.5 0.2 ef01"}
+	require.NotNil(t, verifySwup(nil, swupBlock(rel)), "wrong binary hash")
+
+	SwupBuildCommand = []string{"sh", "-c", "echo Success 1.0 0.5 0.2"}
+	require.NotNil(t, verifySwup(nil, swupBlock(rel)), "missing binary hash")
+
+	SwupBuildCommand = []string{"sh", "-c", "echo Success 1.0 0.5 0.2 abcd"}
+	for _, name := range []string{"-rf", "../test", "a/b", ""} {
+		rel.Name = name
+		require.NotNil(t, verifySwup(nil, swupBlock(rel)), "package name "+name)
+	}
+	rel.Name = "test"
+
+	SwupBuildCommand = []string{"sh", "-c", "echo Failure; exit 1"}
+	require.NotNil(t, verifySwup(nil, swupBlock(rel)), "failing build")
+
+	sb := NewSkipBlock()
+	sb.Data = []byte("no release")
+	require.NotNil(t, verifySwup(nil, sb))
+}
+
+func swupBlock(rel *testRelease) *SkipBlock {
+	sb := NewSkipBlock()
+	var err error
+	sb.Data, err = network.Marshal(rel)
+	log.ErrFatal(err)
+	return sb
+}
+
+type testRelease struct {
+	Name       string
+	Version    string
+	Valid      int
+	Threshold  int
+	Build      bool
+	BinaryHash string
+}
+
+func (tr *testRelease) SwupPackage() (string, string) {
+	return tr.Name, tr.Version
+}
+
+func (tr *testRelease) SwupSignatures() (int, int) {
+	return tr.Valid, tr.Threshold
+}
+
+func (tr *testRelease) SwupBuild() (bool, string) {
+	return tr.Build, tr.BinaryHash
+}
@@ -0,0 +1,319 @@
+package skipchain
+
+import (
+	"errors"
+	"time"
+
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// SyncInterval is how often a conode compares its SkipChains with the other
+// members of their rosters and fetches the blocks it missed, e.g. because
+// it was down during a propagation. 0 disables the synchronisation.
+var SyncInterval = 5 * time.Minute
+
+// maxGetBlocks is the maximum number of blocks returned by GetBlocks.
+const maxGetBlocks = 256
+
+// GetChainTips returns the latest known block of all SkipChains.
+func (s *Service) GetChainTips(gct *GetChainTips) (network.Message, onet.ClientError) {
+	reply := &GetChainTipsReply{}
+	for _, tip := range s.chainTips() {
+		if gct.Member != (network.ServerIdentityID{}) {
+			sb, ok := s.getSkipBlockByID(tip.Latest)
+			if !ok || sb.Roster == nil {
+				continue
+			}
+			if i, _ := sb.Roster.Search(gct.Member); i < 0 {
+				continue
+			}
+		}
+		reply.Tips = append(reply.Tips, tip)
+	}
+	return reply, nil
+}
+
+// GetBlocks returns the blocks from Start to End, following the
+// forward-links of height 1.
+func (s *Service) GetBlocks(gb *GetBlocks) (network.Message, onet.ClientError) {
+	max := gb.Max
+	if max <= 0 || max > maxGetBlocks {
+		max = maxGetBlocks
+	}
+	sb, ok := s.getSkipBlockByID(gb.Start)
+	if !ok {
+		return nil, onet.NewClientErrorCode(4200, "Couldn't find start block")
+	}
+	reply := &GetBlocksReply{Blocks: []*SkipBlock{sb}}
+	for !sb.Hash.Equal(gb.End) && len(sb.ForwardLink) > 0 &&
+		len(reply.Blocks) < max {
+		sb, ok = s.getSkipBlockByID(sb.ForwardLink[0].Hash)
+		if !ok {
+			return nil, onet.NewClientErrorCode(4200, "Missing block in forward-chain")
+		}
+		reply.Blocks = append(reply.Blocks, sb)
+	}
+	seen := map[string]bool{}
+	for _, b := range reply.Blocks {
+		seen[string(b.Hash)] = true
+	}
+	for _, b := range reply.Blocks[1:] {
+		for _, id := range b.BackLinkIds[1:] {
+			if seen[string(id)] {
+				continue
+			}
+			seen[string(id)] = true
+			if anc, ok := s.getSkipBlockByID(id); ok {
+				reply.Ancestors = append(reply.Ancestors, anc)
+			}
+		}
+	}
+	return reply, nil
+}
+
+// syncLoop compares the SkipChains with the other conodes every interval
+// until the service is closed. It is started after the first interval, so
+// a service that is closed before never runs it.
+func (s *Service) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closing:
+			return
+		default:
+		}
+		s.syncChains()
+		select {
+		case <-ticker.C:
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// syncChains asks all members of the rosters of our SkipChains for their
+// latest blocks and fetches the ones we're missing.
+func (s *Service) syncChains() {
+	peers := map[network.ServerIdentityID]*network.ServerIdentity{}
+	for _, tip := range s.chainTips() {
+		sb, ok := s.getSkipBlockByID(tip.Latest)
+		if !ok || sb.Roster == nil {
+			continue
+		}
+		for _, si := range sb.Roster.List {
+			if !si.ID.Equal(s.ServerIdentity().ID) {
+				peers[si.ID] = si
+			}
+		}
+	}
+	for _, si := range peers {
+		if err := s.syncWith(si); err != nil {
+			log.Lvl2(s.ServerIdentity(), "couldn't sync with", si, ":", err)
+		}
+	}
+}
+
+// syncWith fetches all blocks of SkipChains we're part of where si knows
+// of newer blocks than we do.
+func (s *Service) syncWith(si *network.ServerIdentity) error {
+	c := NewClient()
+	reply := &GetChainTipsReply{}
+	cerr := c.SendProtobuf(si, &GetChainTips{s.ServerIdentity().ID}, reply)
+	if cerr != nil {
+		return cerr
+	}
+	for _, remote := range reply.Tips {
+		start := remote.Genesis
+		if local, ok := s.chainTip(remote.Genesis); ok {
+			if local.Index >= remote.Index {
+				continue
+			}
+			start = local.Latest
+		}
+		log.Lvlf2("%s: fetching blocks up to index %d from %s",
+			s.ServerIdentity(), remote.Index, si)
+		if err := s.fetchBlocks(c, si, start, remote.Latest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchBlocks gets the blocks from start to end from si, verifies them and
+// stores them. If start is not known, it has to be the genesis-block of a
+// SkipChain that includes us.
+func (s *Service) fetchBlocks(c *Client, si *network.ServerIdentity, start, end SkipBlockID) error {
+	for {
+		reply := &GetBlocksReply{}
+		cerr := c.SendProtobuf(si, &GetBlocks{Start: start, End: end}, reply)
+		if cerr != nil {
+			return cerr
+		}
+		if len(reply.Blocks) == 0 {
+			return errors.New("Didn't get any blocks")
+		}
+		trusted, ok := s.getSkipBlockByID(start)
+		if !ok {
+			genesis := reply.Blocks[0]
+			if err := s.verifyGenesis(genesis, start); err != nil {
+				return err
+			}
+			trusted = genesis
+		}
+		if err := VerifyChain(trusted, reply.Blocks); err != nil {
+			return err
+		}
+		for i, sb := range reply.Blocks {
+			if fp := s.detectFork(sb, reply.Blocks[:i]...); fp != nil {
+				s.addFork(fp)
+				return errors.New("Found a fork in the SkipChain")
+			}
+		}
+		for _, sb := range append(reply.Blocks, reply.Ancestors...) {
+			if err := s.mergeSkipBlock(sb); err != nil {
+				return err
+			}
+		}
+		last := reply.Blocks[len(reply.Blocks)-1]
+		if last.Hash.Equal(end) || len(last.ForwardLink) == 0 ||
+			len(reply.Blocks) == 1 {
+			return nil
+		}
+		start = last.Hash
+	}
+}
+
+// verifyGenesis checks that the genesis-block we don't know yet has the
+// expected hash and is signed by its roster, including us. Anybody can
+// create a genesis-block with us in the roster, so only the chains we
+// signed ourselves are synchronised.
+func (s *Service) verifyGenesis(genesis *SkipBlock, id SkipBlockID) error {
+	if genesis.Index != 0 || !genesis.Hash.Equal(id) ||
+		!genesis.calculateHash().Equal(genesis.Hash) {
+		return errors.New("Got wrong genesis block")
+	}
+	if genesis.Roster == nil {
+		return errors.New("Genesis block without roster")
+	}
+	if i, _ := genesis.Roster.Search(s.ServerIdentity().ID); i < 0 {
+		return errors.New("Not part of the roster of the genesis block")
+	}
+	if err := verifyBlockSig(genesis, genesis.Roster); err != nil {
+		return err
+	}
+	signers, err := genesis.BlockSig.Signers(genesis.Roster)
+	if err != nil {
+		return err
+	}
+	for _, si := range signers {
+		if si.ID.Equal(s.ServerIdentity().ID) {
+			return nil
+		}
+	}
+	return errors.New("Didn't sign the genesis block")
+}
+
+// mergeSkipBlock stores a block received from another conode if it has
+// more forward-links or a child-link our copy misses and all its signatures
+// verify.
+func (s *Service) mergeSkipBlock(sb *SkipBlock) error {
+	if !sb.calculateHash().Equal(sb.Hash) {
+		return errors.New("Wrong hash of received block")
+	}
+	if fp := s.detectFork(sb); fp != nil {
+		s.addFork(fp)
+		return errors.New("Received block is part of a fork")
+	}
+	if local, ok := s.getSkipBlockByID(sb.Hash); ok {
+		newChild := local.ChildSL == nil && sb.ChildSL != nil
+		if len(local.ForwardLink) > len(sb.ForwardLink) ||
+			len(local.ForwardLink) == len(sb.ForwardLink) && !newChild {
+			return nil
+		}
+		for i, fl := range local.ForwardLink {
+			if !fl.Hash.Equal(sb.ForwardLink[i].Hash) {
+				return errors.New("Received block has different forward-links")
+			}
+		}
+		if sb.ChildSL == nil && local.ChildSL != nil {
+			sb = sb.Copy()
+			sb.ChildSL = local.ChildSL
+		}
+	}
+	if err := sb.VerifySignatures(); err != nil {
+		return err
+	}
+	return s.storeSkipBlock(sb)
+}
+
+// chainTips returns the latest known block of every SkipChain.
+func (s *Service) chainTips() []*ChainTip {
+	s.tipsMutex.Lock()
+	defer s.tipsMutex.Unlock()
+	tips := make([]*ChainTip, 0, len(s.tips))
+	for _, tip := range s.tips {
+		tips = append(tips, tip)
+	}
+	return tips
+}
+
+// chainTip returns the latest known block of the SkipChain starting with
+// genesis.
+func (s *Service) chainTip(genesis SkipBlockID) (*ChainTip, bool) {
+	s.tipsMutex.Lock()
+	defer s.tipsMutex.Unlock()
+	tip, ok := s.tips[string(genesis)]
+	return tip, ok
+}
+
+// updateTip remembers sb as the latest block of its SkipChain if it is
+// newer than the one we know.
+func (s *Service) updateTip(sb *SkipBlock) {
+	if len(sb.ForwardLink) > 0 {
+		return
+	}
+	genesis, ok := s.genesisOf(sb)
+	if !ok {
+		log.Lvl3("Don't know genesis block of", sb)
+		return
+	}
+	s.tipsMutex.Lock()
+	defer s.tipsMutex.Unlock()
+	if tip, ok := s.tips[string(genesis)]; ok && tip.Index > sb.Index {
+		return
+	}
+	s.tips[string(genesis)] = &ChainTip{
+		Genesis: genesis,
+		Latest:  sb.Hash,
+		Index:   sb.Index,
+	}
+}
+
+// loadTips searches the latest block of all stored SkipChains.
+func (s *Service) loadTips() {
+	var tips []*SkipBlock
+	s.db.Range(func(sb *SkipBlock) bool {
+		if len(sb.ForwardLink) == 0 {
+			tips = append(tips, sb)
+		}
+		return true
+	})
+	for _, sb := range tips {
+		s.updateTip(sb)
+	}
+}
+
+// genesisOf follows the highest back-links of sb to the genesis-block.
+func (s *Service) genesisOf(sb *SkipBlock) (SkipBlockID, bool) {
+	for sb.Index > 0 {
+		var ok bool
+		sb, ok = s.getSkipBlockByID(sb.BackLinkIds[len(sb.BackLinkIds)-1])
+		if !ok {
+			return nil, false
+		}
+	}
+	return sb.Hash, true
+}
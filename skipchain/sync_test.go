@@ -0,0 +1,109 @@
+package skipchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestService_Sync(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	hosts, el, s1 := makeHELS(local, 3)
+	s2 := local.Services[hosts[1].ServerIdentity.ID][skipchainSID].(*Service)
+	s3 := local.Services[hosts[2].ServerIdentity.ID][skipchainSID].(*Service)
+
+	genesis := makeGenesisRosterArgs(s1, el, nil, VerifyNone, 2, 3)
+	latest := genesis
+	for i := 0; i < 4; i++ {
+		sb := NewSkipBlock()
+		sb.Roster = el
+		psbr, cerr := s1.ProposeSkipBlock(&ProposeSkipBlock{LatestID: latest.Hash, Proposed: sb})
+		log.ErrFatal(cerr)
+		latest = psbr.(*ProposedSkipBlockReply).Latest
+	}
+
+	// s2 missed everything after the genesis-block
+	s2.db = &SkipBlockMap{SkipBlocks: make(map[string]*SkipBlock)}
+	s2.tips = make(map[string]*ChainTip)
+	g := genesis.Copy()
+	g.ForwardLink = nil
+	log.ErrFatal(s2.storeSkipBlock(g))
+	_, cerr := s2.ProposeSkipBlock(&ProposeSkipBlock{LatestID: latest.Hash, Proposed: NewSkipBlock()})
+	require.NotNil(t, cerr)
+
+	s2.syncChains()
+	tip, ok := s2.chainTip(genesis.Hash)
+	require.True(t, ok)
+	assert.Equal(t, latest.Index, tip.Index)
+	assert.True(t, tip.Latest.Equal(latest.Hash))
+	g, ok = s2.getSkipBlockByID(genesis.Hash)
+	require.True(t, ok)
+	assert.Equal(t, genesis.Height, len(g.ForwardLink))
+
+	// s2 can now add a block as a leader
+	sb := NewSkipBlock()
+	sb.Roster = el
+	psbr, cerr := s2.ProposeSkipBlock(&ProposeSkipBlock{LatestID: latest.Hash, Proposed: sb})
+	log.ErrFatal(cerr)
+	latest = psbr.(*ProposedSkipBlockReply).Latest
+
+	// s3 lost all blocks
+	s3.db = &SkipBlockMap{SkipBlocks: make(map[string]*SkipBlock)}
+	s3.tips = make(map[string]*ChainTip)
+	log.ErrFatal(s3.syncWith(hosts[0].ServerIdentity))
+	assert.Equal(t, s1.lenSkipBlocks(), s3.lenSkipBlocks())
+	tip, ok = s3.chainTip(genesis.Hash)
+	require.True(t, ok)
+	assert.True(t, tip.Latest.Equal(latest.Hash))
+}
+
+func TestService_GetBlocks(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, el, service := makeHELS(local, 2)
+
+	genesis := makeGenesisRosterArgs(service, el, nil, VerifyNone, 2, 3)
+	blocks := []*SkipBlock{genesis}
+	for i := 0; i < 5; i++ {
+		sb := NewSkipBlock()
+		sb.Roster = el
+		psbr, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{
+			LatestID: blocks[len(blocks)-1].Hash, Proposed: sb})
+		log.ErrFatal(cerr)
+		blocks = append(blocks, psbr.(*ProposedSkipBlockReply).Latest)
+	}
+
+	m, cerr := service.GetBlocks(&GetBlocks{Start: blocks[1].Hash,
+		End: blocks[4].Hash})
+	log.ErrFatal(cerr)
+	reply := m.(*GetBlocksReply)
+	require.Equal(t, 4, len(reply.Blocks))
+	for i, sb := range reply.Blocks {
+		assert.True(t, sb.Hash.Equal(blocks[i+1].Hash))
+	}
+	// Block 4 has a back-link to block 0 which is not in the range
+	require.Equal(t, 1, len(reply.Ancestors))
+	assert.True(t, reply.Ancestors[0].Hash.Equal(genesis.Hash))
+
+	m, cerr = service.GetBlocks(&GetBlocks{Start: genesis.Hash, Max: 2})
+	log.ErrFatal(cerr)
+	assert.Equal(t, 2, len(m.(*GetBlocksReply).Blocks))
+}
+
+func TestService_SyncClose(t *testing.T) {
+	defer func(interval time.Duration) { SyncInterval = interval }(SyncInterval)
+	SyncInterval = 10 * time.Millisecond
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, _, service := makeHELS(local, 1)
+
+	// Closing the service stops the synchronisation
+	time.Sleep(5 * SyncInterval)
+	log.ErrFatal(service.Close())
+	log.ErrFatal(service.Close())
+}
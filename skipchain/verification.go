@@ -0,0 +1,301 @@
+package skipchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dedis/paper_chainiac/bftcosi"
+	"github.com/satori/go.uuid"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// SkipBlockVerifier checks whether the newest SkipBlock may be added to its
+// chain. It returns nil if the block is accepted, else an error describing
+// why it is refused. The service is passed so that the verifier can look up
+// other SkipBlocks, like the parent of the newest block.
+type SkipBlockVerifier func(s *Service, newest *SkipBlock) error
+
+// VerifierInfo describes a registered verifier.
+type VerifierInfo struct {
+	ID VerifierID
+	// Name is a human readable name of the verifier
+	Name string
+	// Version is increased whenever the rules of the verifier change
+	Version int
+	// Description tells what is checked by the verifier
+	Description string
+	// Composed is the list of verifiers that all have to accept a
+	// SkipBlock - it is empty if this is not a composed verifier.
+	Composed []VerifierID
+}
+
+// VerificationError is returned if a verifier refused a SkipBlock.
+type VerificationError struct {
+	// Verifier is the verifier that refused the SkipBlock
+	Verifier VerifierID
+	// Name of the verifier
+	Name string
+	// Version of the verifier
+	Version int
+	// Reason why the SkipBlock has been refused
+	Reason string
+}
+
+func (ve *VerificationError) Error() string {
+	return fmt.Sprintf("verifier %s (v%d) refused block: %s", ve.Name,
+		ve.Version, ve.Reason)
+}
+
+type verifier struct {
+	info *VerifierInfo
+	f    SkipBlockVerifier
+}
+
+var verifiers = map[VerifierID]*verifier{}
+var verifiersMutex sync.Mutex
+
+func init() {
+	RegisterVerifier(&VerifierInfo{
+		ID:          VerifyNone,
+		Name:        "None",
+		Version:     1,
+		Description: "Accepts all syntactically correct SkipBlocks",
+	}, verifyNone)
+	RegisterVerifier(&VerifierInfo{
+		ID:          VerifyShard,
+		Name:        "Shard",
+		Version:     1,
+		Description: "All nodes of the roster must be part of the parent's roster",
+	}, verifyShard)
+	RegisterVerifier(&VerifierInfo{
+		ID:          VerifySwup,
+		Name:        "Swup",
+		Version:     1,
+		Description: "Developer signatures and reproducible build of a release",
+	}, verifySwup)
+}
+
+// RegisterVerifier adds the verifier to the registry. A verifier already
+// registered with the same ID is replaced.
+func RegisterVerifier(info *VerifierInfo, f SkipBlockVerifier) error {
+	if info == nil || f == nil {
+		return errors.New("Need both the information and the function")
+	}
+	verifiersMutex.Lock()
+	defer verifiersMutex.Unlock()
+	if v, exists := verifiers[info.ID]; exists {
+		log.Lvlf2("Replacing verifier %s v%d with v%d", v.info.Name,
+			v.info.Version, info.Version)
+	}
+	verifiers[info.ID] = &verifier{info: info, f: f}
+	return nil
+}
+
+// RegisterComposedVerifier registers a verifier that only accepts a
+// SkipBlock if all verifiers given in ids accept it. The ID of the new
+// verifier is derived from its name and returned.
+func RegisterComposedVerifier(name string, version int, ids ...VerifierID) (VerifierID, error) {
+	if len(ids) == 0 {
+		return VerifyNone, errors.New("Need at least one verifier to compose")
+	}
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		info, ok := DescribeVerifier(id)
+		if !ok {
+			return VerifyNone, fmt.Errorf("Unknown verifier %x", id[:])
+		}
+		names[i] = info.Name
+	}
+	composed := make([]VerifierID, len(ids))
+	copy(composed, ids)
+	id := VerifierID(uuid.NewV5(uuid.NamespaceURL, name))
+	info := &VerifierInfo{
+		ID:          id,
+		Name:        name,
+		Version:     version,
+		Description: fmt.Sprintf("All of %v must accept", names),
+		Composed:    composed,
+	}
+	return id, RegisterVerifier(info, func(s *Service, newest *SkipBlock) error {
+		for _, c := range composed {
+			if err := runVerifier(c, s, newest); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// VerificationRegistration stores a verification-function that follows the
+// bftcosi-interface in the registry. It will be called with the hash of the
+// SkipBlock and the marshalled SkipBlock whenever a verification needs to be
+// done. For a SkipBlock with a PayloadHash, Data holds the payload.
+func VerificationRegistration(v VerifierID, f bftcosi.VerificationFunction) error {
+	info := &VerifierInfo{
+		ID:          v,
+		Name:        uuid.UUID(v).String(),
+		Description: "User supplied verification",
+	}
+	return RegisterVerifier(info, func(s *Service, newest *SkipBlock) error {
+		if len(newest.PayloadHash) > 0 {
+			// f only knows about Data, so hand it the payload there
+			payload, err := s.Payload(newest)
+			if err != nil {
+				return err
+			}
+			sb := *newest
+			sbf := *newest.SkipBlockFix
+			sbf.Data = payload
+			sb.SkipBlockFix = &sbf
+			newest = &sb
+		}
+		data, err := network.Marshal(newest)
+		if err != nil {
+			return err
+		}
+		if !f(newest.Hash, data) {
+			return errors.New("verification function returned false")
+		}
+		return nil
+	})
+}
+
+// DescribeVerifier returns the information about the verifier or false if
+// it is not registered.
+func DescribeVerifier(id VerifierID) (*VerifierInfo, bool) {
+	verifiersMutex.Lock()
+	defer verifiersMutex.Unlock()
+	v, ok := verifiers[id]
+	if !ok {
+		return nil, false
+	}
+	return v.info, true
+}
+
+// RegisteredVerifiers returns all registered verifiers sorted by name.
+func RegisteredVerifiers() []*VerifierInfo {
+	verifiersMutex.Lock()
+	defer verifiersMutex.Unlock()
+	list := make([]*VerifierInfo, 0, len(verifiers))
+	for _, v := range verifiers {
+		list = append(list, v.info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// runVerifier calls the verifier with the given ID. The error returned is
+// always a *VerificationError.
+func runVerifier(id VerifierID, s *Service, newest *SkipBlock) error {
+	verifiersMutex.Lock()
+	v, ok := verifiers[id]
+	verifiersMutex.Unlock()
+	if !ok {
+		return &VerificationError{
+			Verifier: id,
+			Name:     uuid.UUID(id).String(),
+			Reason:   "unknown verifier",
+		}
+	}
+	err := v.f(s, newest)
+	if err == nil {
+		return nil
+	}
+	if ve, ok := err.(*VerificationError); ok {
+		return ve
+	}
+	return &VerificationError{
+		Verifier: id,
+		Name:     v.info.Name,
+		Version:  v.info.Version,
+		Reason:   err.Error(),
+	}
+}
+
+// verifyLinks does the sanity-checks of the newest block against the
+// latest block of the chain. If latest is nil, newest has to be a genesis
+// block.
+func verifyLinks(latest, newest *SkipBlock) error {
+	if err := newest.verifyFormat(); err != nil {
+		return err
+	}
+	if newest.Height != blockHeight(newest.SkipBlockFix) {
+		return errors.New("Newest has wrong height")
+	}
+	if err := newest.verifyBLSKeys(); err != nil {
+		return err
+	}
+	if latest == nil {
+		if newest.Index != 0 {
+			return errors.New("Missing previous block")
+		}
+		return nil
+	}
+	if newest.Version != latest.Version ||
+		newest.HashAlgorithm != latest.HashAlgorithm {
+		return errors.New("Newest has a different format than latest")
+	}
+	if newest.SignTimeout != latest.SignTimeout {
+		return errors.New("Newest has a different signTimeout than latest")
+	}
+	if newest.SignatureScheme != latest.SignatureScheme {
+		return errors.New("Newest has a different signature scheme than latest")
+	}
+	if len(newest.BackLinkIds) != newest.Height {
+		return errors.New("Newest has wrong number of back-links")
+	}
+	if len(latest.ForwardLink) != 0 {
+		return errors.New("Latest already has forward link")
+	}
+	if !bytes.Equal(newest.BackLinkIds[0], latest.Hash) {
+		return errors.New("Newest doesn't point to latest")
+	}
+	if newest.Index != latest.Index+1 {
+		return errors.New("Newest doesn't follow latest")
+	}
+	if newest.Timestamp < latest.Timestamp {
+		return errors.New("Newest is older than latest")
+	}
+	return nil
+}
+
+// verifyTimestamp checks that the timestamp of a new block is close enough
+// to now.
+func verifyTimestamp(newest *SkipBlock, now time.Time) error {
+	ts := time.Unix(0, newest.Timestamp)
+	if ts.After(now.Add(MaxClockSkew)) {
+		return fmt.Errorf("Timestamp is %s in the future", ts.Sub(now))
+	}
+	if ts.Before(now.Add(-MaxBlockAge)) {
+		return fmt.Errorf("Timestamp is %s old", now.Sub(ts))
+	}
+	return nil
+}
+
+func verifyNone(s *Service, newest *SkipBlock) error {
+	log.Lvl4("No verification - accepted")
+	return nil
+}
+
+func verifyShard(s *Service, newest *SkipBlock) error {
+	if newest.ParentBlockID.IsNull() {
+		return errors.New("No parent skipblock to verify against")
+	}
+	parent, exists := s.getSkipBlockByID(newest.ParentBlockID)
+	if !exists {
+		return errors.New("Parent skipblock doesn't exist")
+	}
+	for _, e := range newest.Roster.List {
+		if i, _ := parent.Roster.Search(e.ID); i < 0 {
+			return fmt.Errorf("ServerIdentity %s in child doesn't exist in parent", e)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package skipchain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/dedis/onet.v1"
+)
+
+// ChainError is returned by VerifyChain and describes the first block of the
+// update that couldn't be verified.
+type ChainError struct {
+	// Position of the offending block in the update-slice
+	Position int
+	// Block is the hash of the offending block
+	Block SkipBlockID
+	// Index of the offending block in the SkipChain
+	Index int
+	// Reason why the block has been refused
+	Reason string
+}
+
+func (ce *ChainError) Error() string {
+	return fmt.Sprintf("block %d (index %d, %x) refused: %s", ce.Position,
+		ce.Index, []byte(ce.Block), ce.Reason)
+}
+
+// VerifyChain checks that the update can be trusted by a client that trusts
+// the block 'trusted'. The update has to be ordered and can start with the
+// trusted block, as returned by GetUpdateChain. For every block it checks
+// that the hash is the hash of the SkipBlockFix, that the block is cosigned
+// by its responsible roster and that the previous block has a forward-link
+// to it, cosigned by the roster of the previous block, so that changes of
+// the roster are authorized. The back-link on the same level has to point
+// back to the previous block, and index and height have to follow the
+// parameters of the chain. Timestamps must not decrease and not be in the
+// future of the local clock.
+// It doesn't need to contact any conode and returns a *ChainError for the
+// first block that fails.
+func VerifyChain(trusted *SkipBlock, update []*SkipBlock) error {
+	if trusted == nil {
+		return errors.New("Need a trusted block")
+	}
+	if err := trusted.verifyFormat(); err != nil {
+		return err
+	}
+	if !trusted.calculateHash().Equal(trusted.Hash) {
+		return errors.New("Trusted block has wrong hash")
+	}
+	prev := trusted
+	responsible := trusted.Roster
+	now := time.Now()
+	for i, next := range update {
+		fail := func(reason string, args ...interface{}) error {
+			return &ChainError{
+				Position: i,
+				Block:    next.Hash,
+				Index:    next.Index,
+				Reason:   fmt.Sprintf(reason, args...),
+			}
+		}
+		if next == nil || next.SkipBlockFix == nil {
+			return &ChainError{Position: i, Reason: "empty block"}
+		}
+		if err := next.verifyFormat(); err != nil {
+			return fail("%s", err)
+		}
+		if !next.calculateHash().Equal(next.Hash) {
+			return fail("hash doesn't match content")
+		}
+		if time.Unix(0, next.Timestamp).After(now.Add(MaxClockSkew)) {
+			return fail("block is from the future")
+		}
+		if i == 0 && next.Hash.Equal(trusted.Hash) {
+			// The update starts with the trusted block, but only
+			// this copy holds the forward-links.
+			prev = next
+			continue
+		}
+		if responsible == nil {
+			return fail("no roster to verify the previous block")
+		}
+		if err := verifyStep(prev, next, responsible); err != nil {
+			return fail("%s", err)
+		}
+		// Data-blocks don't have a roster and are signed by the
+		// roster of the chain.
+		if next.Roster != nil {
+			responsible = next.Roster
+		}
+		if err := verifyBlockSig(next, responsible); err != nil {
+			return fail("block signature: %s", err)
+		}
+		prev = next
+	}
+	return nil
+}
+
+// GetVerifiedUpdateChain asks the roster of trusted for the update-chain and
+// only returns it if VerifyChain accepts it.
+func (c *Client) GetVerifiedUpdateChain(trusted *SkipBlock) ([]*SkipBlock, error) {
+	reply, err := c.GetUpdateChain(trusted, trusted.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyChain(trusted, reply.Update); err != nil {
+		return nil, err
+	}
+	return reply.Update, nil
+}
+
+// verifyProof checks that the proof returned by a conode is a chain
+// starting at trusted and returns its last block. A conode can return an
+// empty proof, which is refused.
+func verifyProof(trusted *SkipBlock, proof []*SkipBlock) (*SkipBlock, error) {
+	if len(proof) == 0 {
+		return nil, errors.New("Got empty proof")
+	}
+	if err := VerifyChain(trusted, proof); err != nil {
+		return nil, err
+	}
+	return proof[len(proof)-1], nil
+}
+
+// verifyBlockSig checks that the BFT-signature of the block is on its hash
+// and has been created by the roster.
+func verifyBlockSig(sb *SkipBlock, roster *onet.Roster) error {
+	if sb.BlockSig == nil {
+		return errors.New("missing signature")
+	}
+	if !SkipBlockID(sb.BlockSig.Msg).Equal(sb.Hash) {
+		return errors.New("signature is not on the hash of the block")
+	}
+	return sb.verifySig(sb.BlockSig, roster)
+}
+
+// verifyStep checks the link between two blocks of the same SkipChain that
+// follow each other in an update-chain. roster is responsible for prev.
+func verifyStep(prev, next *SkipBlock, roster *onet.Roster) error {
+	if prev.MaximumHeight != next.MaximumHeight ||
+		prev.BaseHeight != next.BaseHeight ||
+		prev.MaxExceptions != next.MaxExceptions ||
+		prev.Version != next.Version ||
+		prev.HashAlgorithm != next.HashAlgorithm ||
+		prev.SignTimeout != next.SignTimeout ||
+		prev.SignatureScheme != next.SignatureScheme {
+		return errors.New("parameters of the chain changed")
+	}
+	if prev.VerifierID != next.VerifierID {
+		return errors.New("verifier of the chain changed")
+	}
+	if next.Index <= prev.Index {
+		return fmt.Errorf("index %d doesn't follow %d", next.Index, prev.Index)
+	}
+	if next.Timestamp < prev.Timestamp {
+		return errors.New("timestamp is before the one of the previous block")
+	}
+	if next.Height < 1 || next.Height > next.MaximumHeight ||
+		next.Height != len(next.BackLinkIds) {
+		return fmt.Errorf("invalid height %d", next.Height)
+	}
+	if h := blockHeight(next.SkipBlockFix); next.Height != h {
+		return fmt.Errorf("height %d instead of %d", next.Height, h)
+	}
+	level := -1
+	for l, fl := range prev.ForwardLink {
+		if fl.Hash.Equal(next.Hash) {
+			level = l
+			break
+		}
+	}
+	if level < 0 {
+		return errors.New("no forward-link from previous block")
+	}
+	if level >= next.Height {
+		return fmt.Errorf("forward-link on level %d is above height", level)
+	}
+	if !next.BackLinkIds[level].Equal(prev.Hash) {
+		return fmt.Errorf("back-link on level %d doesn't point to previous block",
+			level)
+	}
+	if next.BaseHeight > 0 {
+		// Only deterministic SkipChains have fixed distances
+		dist := 1
+		for l := 0; l < level; l++ {
+			dist *= next.BaseHeight
+		}
+		if next.Index-prev.Index != dist {
+			return fmt.Errorf("link on level %d spans %d blocks instead of %d",
+				level, next.Index-prev.Index, dist)
+		}
+	}
+	fl := prev.ForwardLink[level]
+	if len(fl.Signature) < 64 {
+		return errors.New("forward-link signature: missing")
+	}
+	if err := prev.verifySig(fl.signature(fl.Hash), roster); err != nil {
+		return fmt.Errorf("forward-link signature: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package skipchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestVerifyChain(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, el, service := makeHELS(local, 4)
+	el2 := onet.NewRoster(el.List[0:3])
+
+	genesis := makeGenesisRosterArgs(service, el, nil, VerifyNone, 2, 3)
+	latest := genesis
+	for i := 1; i < 6; i++ {
+		sb := NewSkipBlock()
+		sb.Roster = el
+		if i >= 3 {
+			sb.Roster = el2
+		}
+		psbr, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: latest.Hash, Proposed: sb})
+		log.ErrFatal(cerr)
+		latest = psbr.(*ProposedSkipBlockReply).Latest
+	}
+	m, cerr := service.GetUpdateChain(&GetUpdateChain{genesis.Hash})
+	log.ErrFatal(cerr)
+	update := m.(*GetUpdateChainReply).Update
+	require.True(t, len(update) > 2)
+	log.ErrFatal(VerifyChain(genesis, update))
+	// The trusted block doesn't need to be part of the update
+	log.ErrFatal(VerifyChain(update[0], update[1:]))
+
+	tamper := func(pos int, f func(sb *SkipBlock)) error {
+		upd := make([]*SkipBlock, len(update))
+		for i, sb := range update {
+			upd[i] = sb.Copy()
+		}
+		f(upd[pos])
+		err := VerifyChain(genesis, upd)
+		require.NotNil(t, err)
+		ce, ok := err.(*ChainError)
+		require.True(t, ok, err.Error())
+		assert.Equal(t, pos, ce.Position)
+		return ce
+	}
+	last := len(update) - 1
+	tamper(last, func(sb *SkipBlock) {
+		sb.Data = []byte("changed")
+	})
+	tamper(last, func(sb *SkipBlock) {
+		sb.BlockSig.Msg = update[0].Hash
+	})
+	tamper(last, func(sb *SkipBlock) {
+		sb.BlockSig.Sig[0] ^= 1
+	})
+	tamper(1, func(sb *SkipBlock) {
+		sb.Index++
+		sb.updateHash()
+	})
+	tamper(last, func(sb *SkipBlock) {
+		sb.Roster = el
+		sb.updateHash()
+	})
+
+	// Missing forward-link on the previous block
+	upd := []*SkipBlock{update[0].Copy(), update[1]}
+	upd[0].ForwardLink = nil
+	err := VerifyChain(genesis, append(upd, update[2:]...))
+	require.NotNil(t, err)
+	assert.Equal(t, 1, err.(*ChainError).Position)
+
+	// A conode returning an empty proof is refused
+	sb, err := verifyProof(genesis, update)
+	log.ErrFatal(err)
+	assert.True(t, sb.Hash.Equal(latest.Hash))
+	_, err = verifyProof(genesis, nil)
+	require.NotNil(t, err)
+}
+
+func TestDeterministicHeight(t *testing.T) {
+	for _, c := range [][4]int{
+		// index, base, maxHeight, height
+		{0, 2, 3, 3},
+		{1, 2, 3, 1},
+		{2, 2, 3, 2},
+		{4, 2, 3, 3},
+		{8, 2, 3, 3},
+		{6, 2, 3, 2},
+		{9, 3, 4, 3},
+		{5, 1, 3, 3},
+	} {
+		assert.Equal(t, c[3], deterministicHeight(c[0], c[1], c[2]), "%v", c)
+	}
+}
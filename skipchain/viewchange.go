@@ -0,0 +1,99 @@
+package skipchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/paper_chainiac/bftcosi"
+	"github.com/dedis/paper_chainiac/manage"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// onViewChange is called on the conode that leads the new round of a
+// BFT-signature after the leader went silent. The replaced leader can't
+// store and propagate what has been signed anymore, and its proposer gets
+// an error, so the new leader finishes the block or checkpoint once the
+// roster signed it.
+func (s *Service) onViewChange(next *bftcosi.ProtocolBFTCoSi) {
+	msg := next.Msg
+	// The followers verified the data already
+	next.VerificationFunction = func(m, d []byte) bool {
+		return bytes.Equal(msg, m)
+	}
+	next.RegisterOnSignatureDone(func(sig *bftcosi.BFTSignature) {
+		go func() {
+			if err := s.finishViewChange(next.Data, sig); err != nil {
+				log.Error(s.ServerIdentity(), "couldn't finish view change:", err)
+			}
+		}()
+	})
+}
+
+// finishViewChange stores and propagates the block or checkpoint in data
+// with the signature of the new round.
+func (s *Service) finishViewChange(data []byte, sig *bftcosi.BFTSignature) error {
+	_, msg, err := network.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+	switch m := msg.(type) {
+	case *SkipBlock:
+		return s.finishViewChangeBlock(m, sig)
+	case *Checkpoint:
+		m.Signature = sig
+		if err := s.addCheckpoint(m); err != nil {
+			return err
+		}
+		_, err := manage.PropagateStartAndWait(s.Context, m.Roster, m, 120000,
+			s.PropagateSkipBlock)
+		return err
+	}
+	return fmt.Errorf("Can't finish view change of %T", msg)
+}
+
+// finishViewChangeBlock adds the forward-links to the block signed in a
+// new round and propagates it, like signNewSkipBlock does for the leader.
+// Only the signature of the block itself can be finished: if the leader
+// went silent while a previous roster signed a forward-link, the signature
+// of the block is lost with it.
+func (s *Service) finishViewChangeBlock(sb *SkipBlock, sig *bftcosi.BFTSignature) error {
+	if sb.SkipBlockFix == nil || !sb.calculateHash().Equal(sb.Hash) {
+		return errors.New("Block has wrong hash")
+	}
+	el, err := sb.GetResponsible(s)
+	if err != nil {
+		return err
+	}
+	sb.BlockSig = sig
+	if err := verifyBlockSig(sb, el); err != nil {
+		return errors.New("Signature is not the one of the block: " + err.Error())
+	}
+	blocks := []*SkipBlock{sb}
+	if sb.Index > 0 {
+		if len(sb.BackLinkIds) == 0 {
+			return errors.New("Block has no back-links")
+		}
+		prev, ok := s.getSkipBlockByID(sb.BackLinkIds[0])
+		if !ok {
+			return errors.New("Don't know previous block")
+		}
+		genesis, ok := s.genesisOf(prev)
+		if !ok {
+			return errors.New("Didn't find genesis block")
+		}
+		m := s.chainMutex(genesis)
+		m.Lock()
+		defer m.Unlock()
+		if prev, ok = s.getSkipBlockByID(prev.Hash); !ok || len(prev.ForwardLink) > 0 {
+			return errors.New("Previous block already has a successor")
+		}
+		blocks, err = s.addForwardLinks(sb, &signRequest{timeout: sb.signTimeout()})
+		if err != nil {
+			return err
+		}
+	}
+	log.Lvl2(s.ServerIdentity(), "finished block", sb.Index, "after view change")
+	return s.startPropagation(blocks)
+}
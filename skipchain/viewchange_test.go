@@ -0,0 +1,170 @@
+package skipchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/paper_chainiac/bftcosi"
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestService_ViewChange(t *testing.T) {
+	defer func(d time.Duration) {
+		bftcosi.DefaultViewChangeTimeout = d
+	}(bftcosi.DefaultViewChangeTimeout)
+	bftcosi.DefaultViewChangeTimeout = time.Second
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	hosts, el, service := makeHELS(local, 4)
+
+	// The followers verify the second block only once release is closed.
+	// The leader stays silent while it waits for their commitments.
+	release := make(chan struct{})
+	verifying := make(chan bool, 10)
+	VerifyStuck := VerifierID(uuid.NewV5(uuid.NamespaceURL, "StuckViewChange"))
+	log.ErrFatal(RegisterVerifier(&VerifierInfo{
+		ID:      VerifyStuck,
+		Name:    "StuckViewChange",
+		Version: 1,
+	}, func(s *Service, newest *SkipBlock) error {
+		if newest.Index > 0 && !s.ServerIdentity().ID.Equal(el.List[0].ID) {
+			verifying <- true
+			<-release
+		}
+		return nil
+	}))
+	genesis := NewSkipBlock()
+	genesis.Roster = el
+	genesis.MaximumHeight = 1
+	genesis.BaseHeight = 1
+	genesis.VerifierID = VerifyStuck
+	genesis.MaxExceptions = 1
+	psbr, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: nil, Proposed: genesis})
+	log.ErrFatal(cerr)
+	genesis = psbr.(*ProposedSkipBlockReply).Latest
+
+	errs := make(chan onet.ClientError, 1)
+	go func() {
+		sb := NewSkipBlock()
+		sb.Roster = el
+		_, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: genesis.Hash,
+			Proposed: sb, Timeout: 5000})
+		errs <- cerr
+	}()
+	// Three followers verify in the round of the leader, and two again in
+	// the round of the next leader after the view change.
+	for i := 0; i < 5; i++ {
+		select {
+		case <-verifying:
+		case <-time.After(10 * time.Second):
+			t.Fatal("No view change")
+		}
+	}
+	close(release)
+
+	// The next member of the roster signs the block without the leader
+	// and all members store it.
+	for _, h := range hosts {
+		s := local.Services[h.ServerIdentity.ID][skipchainSID].(*Service)
+		var tip *ChainTip
+		for i := 0; i < 100; i++ {
+			if tip, _ = s.chainTip(genesis.Hash); tip != nil && tip.Index == 1 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		require.NotNil(t, tip)
+		require.Equal(t, 1, tip.Index, "Block of view change not stored")
+	}
+	reply, cerr := service.GetUpdateChain(&GetUpdateChain{genesis.Hash})
+	log.ErrFatal(cerr)
+	update := reply.(*GetUpdateChainReply).Update
+	require.Equal(t, 2, len(update))
+	log.ErrFatal(VerifyChain(genesis, update))
+	missing := update[1].BlockSig.Missing(len(el.List))
+	require.Equal(t, 1, len(missing))
+	assert.Equal(t, 0, missing[0].Index)
+
+	// The leader only times out after the block has been stored.
+	cerr = <-errs
+	require.NotNil(t, cerr)
+	assert.Equal(t, ErrorRosterUnavailable, cerr.ErrorCode())
+}
+
+func TestService_CancelNoViewChange(t *testing.T) {
+	defer func(d time.Duration) {
+		bftcosi.DefaultViewChangeTimeout = d
+	}(bftcosi.DefaultViewChangeTimeout)
+	bftcosi.DefaultViewChangeTimeout = time.Second
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	hosts, el, service := makeHELS(local, 4)
+
+	release := make(chan struct{})
+	verifying := make(chan bool, 10)
+	VerifyStuck := VerifierID(uuid.NewV5(uuid.NamespaceURL, "StuckCancel"))
+	log.ErrFatal(RegisterVerifier(&VerifierInfo{
+		ID:      VerifyStuck,
+		Name:    "StuckCancel",
+		Version: 1,
+	}, func(s *Service, newest *SkipBlock) error {
+		if newest.Index > 0 && !s.ServerIdentity().ID.Equal(el.List[0].ID) {
+			verifying <- true
+			<-release
+		}
+		return nil
+	}))
+	genesis := NewSkipBlock()
+	genesis.Roster = el
+	genesis.MaximumHeight = 1
+	genesis.BaseHeight = 1
+	genesis.VerifierID = VerifyStuck
+	genesis.MaxExceptions = 1
+	psbr, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: nil, Proposed: genesis})
+	log.ErrFatal(cerr)
+	genesis = psbr.(*ProposedSkipBlockReply).Latest
+
+	secret := []byte("secret")
+	errs := make(chan onet.ClientError, 1)
+	go func() {
+		sb := NewSkipBlock()
+		sb.Roster = el
+		_, cerr := service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: genesis.Hash,
+			Proposed: sb, CancelHash: CancelHash(secret)})
+		errs <- cerr
+	}()
+	for i := 0; i < 3; i++ {
+		<-verifying
+	}
+	_, cerr = service.CancelProposal(&CancelProposal{genesis.Hash, secret})
+	log.ErrFatal(cerr)
+	cerr = <-errs
+	require.NotNil(t, cerr)
+	assert.Equal(t, ErrorCancelled, cerr.ErrorCode())
+
+	// The followers dropped the round, so they don't replace the leader
+	// once they verified the block.
+	close(release)
+	time.Sleep(3 * bftcosi.DefaultViewChangeTimeout)
+	assert.Equal(t, 0, len(verifying), "New round after cancel")
+	for _, h := range hosts {
+		s := local.Services[h.ServerIdentity.ID][skipchainSID].(*Service)
+		reply, cerr := s.GetUpdateChain(&GetUpdateChain{genesis.Hash})
+		log.ErrFatal(cerr)
+		assert.Equal(t, 1, len(reply.(*GetUpdateChainReply).Update),
+			"Cancelled block has been stored")
+	}
+
+	// The followers released the cancelled block, so another one can
+	// follow the genesis block.
+	sb := NewSkipBlock()
+	sb.Roster = el
+	psbr, cerr = service.ProposeSkipBlock(&ProposeSkipBlock{LatestID: genesis.Hash,
+		Proposed: sb})
+	log.ErrFatal(cerr)
+	assert.Equal(t, 1, psbr.(*ProposedSkipBlockReply).Latest.Index)
+}
@@ -60,19 +60,23 @@ func (p *PGP) Verify(data []byte, sigStr string) error {
 	in := bytes.NewBufferString(sigStr)
 
 	block, err := armor.Decode(in)
-	log.ErrFatal(err)
+	if err != nil {
+		return err
+	}
 
 	if block.Type != openpgp.SignatureType {
-		log.Fatal("Invalid signature file")
+		return errors.New("Invalid signature file")
 	}
 
 	reader := packet.NewReader(block.Body)
 	pkt, err := reader.Next()
-	log.ErrFatal(err)
+	if err != nil {
+		return err
+	}
 
 	sig, ok := pkt.(*packet.Signature)
 	if !ok {
-		log.Fatal("Invalid signature")
+		return errors.New("Invalid signature")
 	}
 
 	hash := sig.Hash.New()
@@ -180,21 +184,33 @@ func DecodePrivate(priv string) *packet.PrivateKey {
 }
 
 func DecodePublic(pub string) *packet.PublicKey {
+	key, err := decodePublic(pub)
+	log.ErrFatal(err)
+	return key
+}
+
+// decodePublic is like DecodePublic but returns an error instead of
+// stopping the program.
+func decodePublic(pub string) (*packet.PublicKey, error) {
 	in := bytes.NewBufferString(pub)
 	block, err := armor.Decode(in)
-	log.ErrFatal(err)
+	if err != nil {
+		return nil, err
+	}
 
 	if block.Type != openpgp.PublicKeyType {
-		log.Fatal("Invalid private key file")
+		return nil, errors.New("Invalid public key file")
 	}
 
 	reader := packet.NewReader(block.Body)
 	pkt, err := reader.Next()
-	log.ErrFatal(err)
+	if err != nil {
+		return nil, err
+	}
 
 	key, ok := pkt.(*packet.PublicKey)
 	if !ok {
-		log.Fatal("Invalid public key")
+		return nil, errors.New("Invalid public key")
 	}
-	return key
+	return key, nil
 }
@@ -49,6 +49,55 @@ type Release struct {
 	VerifyBuild bool
 }
 
+// SwupPackage returns the name and version of the release, so that it can
+// be verified by skipchain.VerifySwup.
+func (r *Release) SwupPackage() (string, string) {
+	if r.Policy == nil {
+		return "", ""
+	}
+	return r.Policy.Name, r.Policy.Version
+}
+
+// SwupSignatures returns how many developer signatures on the policy are
+// valid and how many are needed. A threshold of 0 means all keys have to
+// sign.
+func (r *Release) SwupSignatures() (int, int) {
+	if r.Policy == nil {
+		return 0, 0
+	}
+	threshold := r.Policy.Threshold
+	if threshold == 0 {
+		threshold = len(r.Policy.Keys)
+	}
+	policyBin, err := network.Marshal(r.Policy)
+	if err != nil {
+		return 0, threshold
+	}
+	valid := 0
+	for i, s := range r.Signatures {
+		if i >= len(r.Policy.Keys) {
+			break
+		}
+		pub, err := decodePublic(r.Policy.Keys[i])
+		if err != nil {
+			continue
+		}
+		if (&PGP{Public: pub}).Verify(policyBin, s) == nil {
+			valid++
+		}
+	}
+	return valid, threshold
+}
+
+// SwupBuild returns whether the release asks for a reproducible build and
+// the expected hash of the binary.
+func (r *Release) SwupBuild() (bool, string) {
+	if r.Policy == nil {
+		return r.VerifyBuild, ""
+	}
+	return r.VerifyBuild, r.Policy.BinaryHash
+}
+
 type SwupChain struct {
 	Root    *skipchain.SkipBlock
 	Data    *skipchain.SkipBlock
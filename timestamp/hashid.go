@@ -10,13 +10,14 @@ type HashID []byte
 
 // Bit returns if the given bit is set or not
 func (id HashID) Bit(i uint) int {
-	return int(id[i>>3] >> (i & 7))
+	return int(id[i>>3]>>(i&7)) & 1
 }
 
-// Level finds the skip-chain level of an ID
+// Level finds the skip-chain level of an ID, which is the number of
+// trailing zero bits. Each level is half as probable as the one below.
 func (id *HashID) Level() int {
 	var level uint
-	for id.Bit(level) == 0 {
+	for level < uint(len(*id))*8 && id.Bit(level) == 0 {
 		level++
 	}
 	return int(level)